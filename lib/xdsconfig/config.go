@@ -56,6 +56,67 @@ const (
 	DefaultShareDir      = "${HOME}/.xds/server/projects"
 	DefaultSTHomeDir     = "${HOME}/.xds/server/syncthing-config"
 	DefaultSdkScriptsDir = "${EXEPATH}/sdks"
+	DefaultExecHistDir   = "${HOME}/.xds/server/exec-history"
+	DefaultExecHistMax   = 100
+	DefaultExecTimeout   = 24 * 60 * 60 // 1 day
+	DefaultExecMaxPrio   = 10
+	DefaultSandboxBwrap  = "bwrap"
+	DefaultCifsMount     = "mount.cifs"
+	DefaultCifsUmount    = "umount"
+	DefaultEventsJournal = 1000
+	DefaultWebhookRetry  = 5
+	DefaultWebhookDead   = "${HOME}/.xds/server/webhooks-dead-letter.log"
+	DefaultJWTUserClaim  = "sub"
+	DefaultJWTRolesClaim = "roles"
+	DefaultAuthRole      = "user"
+	DefaultMaxSessions   = 100000
+	DefaultTLSCert       = "${HOME}/.xds/server/tls/server.crt"
+	DefaultTLSKey        = "${HOME}/.xds/server/tls/server.key"
+	DefaultTLSMinVersion = "1.2"
+)
+
+// DefaultSandboxSystemPaths Host paths visible (read-only) by commands
+// executed in sandbox (needed to run shell and tools)
+var DefaultSandboxSystemPaths = []string{
+	"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64",
+	"/etc/alternatives", "/etc/ld.so.cache", "/etc/ld.so.conf", "/etc/ld.so.conf.d",
+	"/etc/passwd", "/etc/group", "/etc/localtime", "/etc/hosts", "/etc/resolv.conf",
+}
+
+// DefaultAuthRoles Permissions granted by roles (see AuthConfig.Roles)
+var DefaultAuthRoles = map[string][]string{
+	"admin":    {"*"},
+	"user":     {"folders.create", "exec"},
+	"readonly": {},
+}
+
+// DefaultRateLimitClasses Limits of requests (first matching class is used)
+var DefaultRateLimitClasses = []RateLimitClass{
+	{
+		Name:    "sdks",
+		Methods: []string{"POST", "DELETE"},
+		Paths:   []string{"/api/v1/sdks"},
+		Session: RateLimit{Rate: 1.0 / 60, Burst: 3},
+		IP:      RateLimit{Rate: 2.0 / 60, Burst: 6},
+	},
+	{
+		Name:    "exec",
+		Methods: []string{"POST"},
+		Paths:   []string{"/api/v1/exec", "/api/v1/signal", "/api/v1/attach"},
+		Session: RateLimit{Rate: 2, Burst: 10},
+		IP:      RateLimit{Rate: 5, Burst: 30},
+	},
+	{
+		Name:    "default",
+		Session: RateLimit{Rate: 20, Burst: 100},
+		IP:      RateLimit{Rate: 50, Burst: 300},
+	},
+}
+
+// Order of commands queued when concurrency limits are reached
+const (
+	ExecQueueFIFO     = "fifo"
+	ExecQueuePriority = "priority"
 )
 
 // Init loads the configuration on start-up
@@ -64,12 +125,28 @@ func Init(cliCtx *cli.Context, log *logrus.Logger) (*Config, error) {
 
 	dfltShareDir := DefaultShareDir
 	dfltSTHomeDir := DefaultSTHomeDir
+	dfltExecHistDir := DefaultExecHistDir
 	if resDir, err := common.ResolveEnvVar(DefaultShareDir); err == nil {
 		dfltShareDir = resDir
 	}
 	if resDir, err := common.ResolveEnvVar(DefaultSTHomeDir); err == nil {
 		dfltSTHomeDir = resDir
 	}
+	if resDir, err := common.ResolveEnvVar(DefaultExecHistDir); err == nil {
+		dfltExecHistDir = resDir
+	}
+	dfltWebhookDead := DefaultWebhookDead
+	if resFile, err := common.ResolveEnvVar(DefaultWebhookDead); err == nil {
+		dfltWebhookDead = resFile
+	}
+	dfltTLSCert := DefaultTLSCert
+	if resFile, err := common.ResolveEnvVar(DefaultTLSCert); err == nil {
+		dfltTLSCert = resFile
+	}
+	dfltTLSKey := DefaultTLSKey
+	if resFile, err := common.ResolveEnvVar(DefaultTLSKey); err == nil {
+		dfltTLSKey = resFile
+	}
 
 	// Retrieve Server ID (or create one the first time)
 	uuid, err := ServerIDGet()
@@ -101,6 +178,39 @@ func Init(cliCtx *cli.Context, log *logrus.Logger) (*Config, error) {
 			HTTPPort:      DefaultPort,
 			SThgConf:      &SyncThingConf{Home: dfltSTHomeDir},
 			LogsDir:       "",
+			ExecConf: ExecConfig{
+				HistoryDir:  dfltExecHistDir,
+				HistoryMax:  DefaultExecHistMax,
+				QueueOrder:  ExecQueueFIFO,
+				MaxPriority: DefaultExecMaxPrio,
+				Timeout:     DefaultExecTimeout,
+				Sandbox: ExecSandboxConfig{
+					BwrapPath:   DefaultSandboxBwrap,
+					SystemPaths: DefaultSandboxSystemPaths,
+				},
+			},
+			CifsConf: CifsConfig{
+				MountHelper:  DefaultCifsMount,
+				UmountHelper: DefaultCifsUmount,
+			},
+			EventsConf: EventsConfig{
+				JournalSize:       DefaultEventsJournal,
+				WebhookRetries:    DefaultWebhookRetry,
+				WebhookDeadLetter: dfltWebhookDead,
+			},
+			AuthConf: AuthConfig{
+				Roles:        DefaultAuthRoles,
+				DefaultRoles: []string{DefaultAuthRole},
+			},
+			RateLimitConf: RateLimitConfig{
+				MaxSessions: DefaultMaxSessions,
+				Classes:     DefaultRateLimitClasses,
+			},
+			TLSConf: TLSConfig{
+				CertFile:   dfltTLSCert,
+				KeyFile:    dfltTLSKey,
+				MinVersion: DefaultTLSMinVersion,
+			},
 		},
 		Log: log,
 	}
@@ -121,6 +231,11 @@ func Init(cliCtx *cli.Context, log *logrus.Logger) (*Config, error) {
 	}
 	c.Log.Infoln("Share root directory: ", c.FileConf.ShareRootDir)
 
+	// Additional path mappings of folders are restricted to shared dir
+	if c.FileConf.PathMappingRoots == nil {
+		c.FileConf.PathMappingRoots = []string{c.FileConf.ShareRootDir}
+	}
+
 	// Where Logs are redirected:
 	//  default 'stdout' (logfile option default value)
 	//  else use file (or filepath) set by --logfile option
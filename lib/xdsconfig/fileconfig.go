@@ -26,6 +26,7 @@ import (
 	"strings"
 
 	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
 )
 
 // ConfigDir Directory in user HOME directory where xds config will be saved
@@ -38,6 +39,8 @@ const (
 	ServerDataFilename = "server-data.xml"
 	// FoldersConfigFilename Folders config filename
 	FoldersConfigFilename = "server-config_folders.xml"
+	// SessionsFilename Client sessions filename
+	SessionsFilename = "server-sessions.xml"
 )
 
 // SyncThingConf definition
@@ -49,14 +52,153 @@ type SyncThingConf struct {
 	RescanIntervalS int    `json:"rescanIntervalS"`
 }
 
+// ExecConfig definition (settings of commands executed by /exec)
+type ExecConfig struct {
+	HistoryDir          string `json:"historyDir"`
+	HistoryMax          int    `json:"historyMax"`
+	MaxRunning          int    `json:"maxRunning"`          // max number of commands running concurrently (0: no limit)
+	MaxRunningPerFolder int    `json:"maxRunningPerFolder"` // max number of commands running concurrently in a folder (0: no limit)
+	QueueOrder          string `json:"queueOrder"`          // order of queued commands: ExecQueueFIFO or ExecQueuePriority
+	MaxPriority         int    `json:"maxPriority"`         // priorities of commands are bounded to [-maxPriority, maxPriority] (unless exec.priority permission is granted, 0: default)
+	Timeout             int    `json:"timeout"`             // default command completion timeout in seconds
+	CgroupDir           string `json:"cgroupDir"`           // cgroup v2 directory used to limit resources (empty: auto-detect)
+
+	// Server resource limits: default and upper bounds of command limits
+	Limits xsapiv1.ExecLimits `json:"limits"`
+
+	Sandbox ExecSandboxConfig `json:"sandbox"`
+}
+
+// ExecSandboxConfig definition (isolation of commands in Linux namespaces)
+type ExecSandboxConfig struct {
+	Enable      bool     `json:"enable"`
+	BwrapPath   string   `json:"bwrapPath"`   // path of bubblewrap tool used to create namespaces
+	SystemPaths []string `json:"systemPaths"` // host paths visible (read-only) in sandbox
+}
+
 // FileConfig is the JSON structure of xds-server config file (server-config.json)
 type FileConfig struct {
-	WebAppDir     string         `json:"webAppDir"`
-	ShareRootDir  string         `json:"shareRootDir"`
-	SdkScriptsDir string         `json:"sdkScriptsDir"`
-	HTTPPort      string         `json:"httpPort"`
-	SThgConf      *SyncThingConf `json:"syncthing"`
-	LogsDir       string         `json:"logsDir"`
+	WebAppDir     string          `json:"webAppDir"`
+	ShareRootDir  string          `json:"shareRootDir"`
+	SdkScriptsDir string          `json:"sdkScriptsDir"`
+	HTTPPort      string          `json:"httpPort"`
+	SThgConf      *SyncThingConf  `json:"syncthing"`
+	LogsDir       string          `json:"logsDir"`
+	ExecConf      ExecConfig      `json:"exec"`
+	CifsConf      CifsConfig      `json:"cifs"`
+	EventsConf    EventsConfig    `json:"events"`
+	AuthConf      AuthConfig      `json:"auth"`
+	RateLimitConf RateLimitConfig `json:"rateLimit"`
+	SecurityConf  SecurityConfig  `json:"security"`
+	TLSConf       TLSConfig       `json:"tls"`
+
+	// Server directories under which serverPath of additional folder path
+	// mappings must be located (default: shareRootDir)
+	PathMappingRoots []string `json:"pathMappingRoots"`
+}
+
+// TLSConfig definition (HTTPS serving, certificates are reloaded on SIGHUP or
+// when files change)
+type TLSConfig struct {
+	Enable       bool   `json:"enable"`
+	CertFile     string `json:"certFile"`     // certificate (PEM, may include intermediate certificates)
+	KeyFile      string `json:"keyFile"`      // private key (PEM)
+	ClientCAFile string `json:"clientCAFile"` // CAs of client certificates (mutual TLS when set)
+	MinVersion   string `json:"minVersion"`   // minimum TLS version: 1.0, 1.1, 1.2 or 1.3
+	SelfSigned   bool   `json:"selfSigned"`   // generate a self-signed certificate when certFile doesn't exist
+}
+
+// SecurityConfig definition (protection of browser clients)
+type SecurityConfig struct {
+	CORSOrigins    []string `json:"corsOrigins"`    // origins allowed to send cross-origin requests ("*" for any, without credentials)
+	SecureCookie   bool     `json:"secureCookie"`   // set Secure attribute of cookies even without TLS (eg. behind a HTTPS proxy)
+	DisableCSRF    bool     `json:"disableCSRF"`    // disable CSRF protection of state-changing requests
+	TrustedProxies []string `json:"trustedProxies"` // reverse proxies (IPs or CIDRs) allowed to set client IP in X-Forwarded-For header
+}
+
+// RateLimitConfig definition (flood protection, requests are limited per
+// session and per remote IP using token buckets)
+type RateLimitConfig struct {
+	Disable     bool             `json:"disable"`
+	MaxSessions int              `json:"maxSessions"` // oldest sessions are evicted when reached
+	Classes     []RateLimitClass `json:"classes"`     // first class matching a request is used
+}
+
+// RateLimitClass definition of limits of a class of requests
+type RateLimitClass struct {
+	Name    string    `json:"name"`
+	Methods []string  `json:"methods"` // HTTP methods (all when empty)
+	Paths   []string  `json:"paths"`   // path prefixes (all when empty)
+	Session RateLimit `json:"session"` // limit per session
+	IP      RateLimit `json:"ip"`      // limit per remote IP
+}
+
+// RateLimit definition of a token bucket
+type RateLimit struct {
+	Rate  float64 `json:"rate"`  // requests per second (no limit when 0)
+	Burst int     `json:"burst"` // max number of requests in a burst
+}
+
+// AuthConfig definition (authentication of clients)
+type AuthConfig struct {
+	Enable       bool              `json:"enable"`
+	Tokens       []AuthTokenConfig `json:"tokens"`       // static API tokens (Authorization: Bearer <token>)
+	HtpasswdFile string            `json:"htpasswdFile"` // users file (bcrypt or SHA1 passwords, see htpasswd -B)
+	JWT          *AuthJWTConfig    `json:"jwt"`          // OIDC/JWT bearer tokens
+
+	// Authorization: permissions (folders.all, folders.create, exec,
+	// sdks.manage, config.manage, sessions.admin or * for all) granted by
+	// each role
+	Roles        map[string][]string `json:"roles"`
+	UserRoles    map[string][]string `json:"userRoles"`    // roles granted to users (eg. users of htpasswd file)
+	DefaultRoles []string            `json:"defaultRoles"` // roles of users without any role
+}
+
+// AuthTokenConfig definition of a static API token
+type AuthTokenConfig struct {
+	Token string   `json:"token"`
+	User  string   `json:"user"`
+	Roles []string `json:"roles"`
+}
+
+// AuthJWTConfig definition of JWT validation
+type AuthJWTConfig struct {
+	JWKSURL    string `json:"jwksURL"`    // URL (or local file) of JSON Web Key Set used to check signatures
+	Issuer     string `json:"issuer"`     // expected iss claim (not checked when empty)
+	Audience   string `json:"audience"`   // expected aud claim (not checked when empty)
+	UserClaim  string `json:"userClaim"`  // claim holding user name (default: sub)
+	RolesClaim string `json:"rolesClaim"` // claim holding user roles (default: roles)
+}
+
+// EventsConfig definition (settings of events sent to clients)
+type EventsConfig struct {
+	JournalSize       int             `json:"journalSize"`       // number of events kept to be replayed to clients
+	Webhooks          []WebhookConfig `json:"webhooks"`          // HTTP targets of events
+	WebhookRetries    int             `json:"webhookRetries"`    // max number of retries of a webhook delivery
+	WebhookDeadLetter string          `json:"webhookDeadLetter"` // file where failed webhook deliveries are logged
+}
+
+// WebhookConfig definition of a webhook (events are POSTed to URL)
+type WebhookConfig struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"` // event types sent (empty for all, exec:exit included)
+	Filter string   `json:"filter"` // only send events which data match filter (eg. "code!=0")
+	Secret string   `json:"secret"` // key used to sign payloads (HMAC-SHA256 in X-XDS-Signature header)
+}
+
+// CifsConfig definition (settings of CIFS/SMB folders)
+type CifsConfig struct {
+	MountHelper  string                    `json:"mountHelper"`  // command used to mount a share (called as: <helper> <share> <dir> -o <options>)
+	UmountHelper string                    `json:"umountHelper"` // command used to unmount a share (called as: <helper> <dir>)
+	MountOptions string                    `json:"mountOptions"` // additional mount options
+	Credentials  map[string]CifsCredential `json:"credentials"`  // credentials referenced by folders
+}
+
+// CifsCredential credential used to mount CIFS/SMB shares
+type CifsCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Domain   string `json:"domain"`
 }
 
 // readGlobalConfig reads configuration from a config file.
@@ -118,10 +260,21 @@ func readGlobalConfig(c *Config, confFile string) error {
 		&fCfg.WebAppDir,
 		&fCfg.ShareRootDir,
 		&fCfg.SdkScriptsDir,
-		&fCfg.LogsDir}
+		&fCfg.LogsDir,
+		&fCfg.ExecConf.HistoryDir,
+		&fCfg.ExecConf.CgroupDir,
+		&fCfg.ExecConf.Sandbox.BwrapPath,
+		&fCfg.EventsConf.WebhookDeadLetter,
+		&fCfg.AuthConf.HtpasswdFile,
+		&fCfg.TLSConf.CertFile,
+		&fCfg.TLSConf.KeyFile,
+		&fCfg.TLSConf.ClientCAFile}
 	if fCfg.SThgConf != nil {
 		vars = append(vars, &fCfg.SThgConf.Home, &fCfg.SThgConf.BinDir)
 	}
+	for idx := range fCfg.PathMappingRoots {
+		vars = append(vars, &fCfg.PathMappingRoots[idx])
+	}
 	for _, field := range vars {
 		var err error
 		if *field, err = common.ResolveEnvVar(*field); err != nil {
@@ -145,6 +298,71 @@ func readGlobalConfig(c *Config, confFile string) error {
 	if fCfg.LogsDir == "" {
 		fCfg.LogsDir = c.FileConf.LogsDir
 	}
+	if fCfg.ExecConf.HistoryDir == "" {
+		fCfg.ExecConf.HistoryDir = c.FileConf.ExecConf.HistoryDir
+	}
+	if fCfg.ExecConf.HistoryMax == 0 {
+		fCfg.ExecConf.HistoryMax = c.FileConf.ExecConf.HistoryMax
+	}
+	if fCfg.ExecConf.QueueOrder == "" {
+		fCfg.ExecConf.QueueOrder = c.FileConf.ExecConf.QueueOrder
+	}
+	if fCfg.ExecConf.Timeout == 0 {
+		fCfg.ExecConf.Timeout = c.FileConf.ExecConf.Timeout
+	}
+	if fCfg.ExecConf.MaxPriority == 0 {
+		fCfg.ExecConf.MaxPriority = c.FileConf.ExecConf.MaxPriority
+	}
+	if fCfg.ExecConf.Sandbox.BwrapPath == "" {
+		fCfg.ExecConf.Sandbox.BwrapPath = c.FileConf.ExecConf.Sandbox.BwrapPath
+	}
+	if fCfg.ExecConf.Sandbox.SystemPaths == nil {
+		fCfg.ExecConf.Sandbox.SystemPaths = c.FileConf.ExecConf.Sandbox.SystemPaths
+	}
+	if fCfg.CifsConf.MountHelper == "" {
+		fCfg.CifsConf.MountHelper = c.FileConf.CifsConf.MountHelper
+	}
+	if fCfg.CifsConf.UmountHelper == "" {
+		fCfg.CifsConf.UmountHelper = c.FileConf.CifsConf.UmountHelper
+	}
+	if fCfg.EventsConf.JournalSize == 0 {
+		fCfg.EventsConf.JournalSize = c.FileConf.EventsConf.JournalSize
+	}
+	if fCfg.EventsConf.WebhookRetries == 0 {
+		fCfg.EventsConf.WebhookRetries = c.FileConf.EventsConf.WebhookRetries
+	}
+	if fCfg.EventsConf.WebhookDeadLetter == "" {
+		fCfg.EventsConf.WebhookDeadLetter = c.FileConf.EventsConf.WebhookDeadLetter
+	}
+	if fCfg.AuthConf.Roles == nil {
+		fCfg.AuthConf.Roles = c.FileConf.AuthConf.Roles
+	}
+	if fCfg.AuthConf.DefaultRoles == nil {
+		fCfg.AuthConf.DefaultRoles = c.FileConf.AuthConf.DefaultRoles
+	}
+	if fCfg.TLSConf.CertFile == "" {
+		fCfg.TLSConf.CertFile = c.FileConf.TLSConf.CertFile
+	}
+	if fCfg.TLSConf.KeyFile == "" {
+		fCfg.TLSConf.KeyFile = c.FileConf.TLSConf.KeyFile
+	}
+	if fCfg.TLSConf.MinVersion == "" {
+		fCfg.TLSConf.MinVersion = c.FileConf.TLSConf.MinVersion
+	}
+	if fCfg.RateLimitConf.MaxSessions == 0 {
+		fCfg.RateLimitConf.MaxSessions = c.FileConf.RateLimitConf.MaxSessions
+	}
+	if fCfg.RateLimitConf.Classes == nil {
+		fCfg.RateLimitConf.Classes = c.FileConf.RateLimitConf.Classes
+	}
+	if jwt := fCfg.AuthConf.JWT; jwt != nil {
+		if jwt.UserClaim == "" {
+			jwt.UserClaim = DefaultJWTUserClaim
+		}
+		if jwt.RolesClaim == "" {
+			jwt.RolesClaim = DefaultJWTRolesClaim
+		}
+	}
 
 	// Resolve webapp dir (support relative or full path)
 	fCfg.WebAppDir = strings.Trim(fCfg.WebAppDir, " ")
@@ -178,6 +396,11 @@ func FoldersConfigFilenameGet() (string, error) {
 	return configFilenameGet(FoldersConfigFilename)
 }
 
+// SessionsFilenameGet
+func SessionsFilenameGet() (string, error) {
+	return configFilenameGet(SessionsFilename)
+}
+
 // ServerDataFilenameGet
 func ServerDataFilenameGet() (string, error) {
 	return configFilenameGet(ServerDataFilename)
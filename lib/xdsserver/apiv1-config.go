@@ -38,6 +38,10 @@ func (s *APIService) getConfig(c *gin.Context) {
 
 // SetConfig sets server configuration
 func (s *APIService) setConfig(c *gin.Context) {
+	if !s.checkPerm(c, PermConfigManage) {
+		return
+	}
+
 	// FIXME - must be tested
 	c.JSON(http.StatusNotImplemented, "Not implemented")
 
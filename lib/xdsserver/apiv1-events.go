@@ -19,6 +19,8 @@ package xdsserver
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	common "github.com/iotbzh/xds-common/golib"
@@ -39,21 +41,31 @@ func (s *APIService) eventsRegister(c *gin.Context) {
 		return
 	}
 
-	// TODO: add args.Filter support
-
 	sess := s.sessions.Get(c)
 	if sess == nil {
 		common.APIError(c, "Unknown sessions")
 		return
 	}
 
+	// Filter can also be a (partial) folder ID, for backward compatibility
+	filter := strings.TrimSpace(args.Filter)
+	if filter != "" && !strings.ContainsAny(filter, " =!()") {
+		fldID, err := s.mfolders.ResolveID(filter)
+		if err != nil {
+			common.APIError(c, err.Error())
+			return
+		}
+		filter = "id=" + strconv.Quote(fldID)
+	}
+
 	// Register to all or to a specific events
-	if err := s.events.Register(args.Name, sess.ID); err != nil {
+	reply, err := s.events.Register(args.Name, filter, sess.ID, args.Since, args.Epoch)
+	if err != nil {
 		common.APIError(c, err.Error())
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "OK"})
+	c.JSON(http.StatusOK, reply)
 }
 
 // eventsRegister Registering for events that will be send over a WS
@@ -72,7 +84,7 @@ func (s *APIService) eventsUnRegister(c *gin.Context) {
 	}
 
 	// Register to all or to a specific events
-	if err := s.events.UnRegister(args.Name, sess.ID); err != nil {
+	if err := s.events.UnRegister(args.Name, args.ID, sess.ID); err != nil {
 		common.APIError(c, err.Error())
 		return
 	}
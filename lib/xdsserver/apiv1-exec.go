@@ -18,9 +18,11 @@
 package xdsserver
 
 import (
-	"fmt"
+	"encoding/json"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -45,16 +47,21 @@ func (s *APIService) execCmd(c *gin.Context) {
 		return
 	}
 
-	// TODO: add permission ?
-
 	// Retrieve session info
 	sess := s.sessions.Get(c)
 	if sess == nil {
 		common.APIError(c, "Unknown sessions")
 		return
 	}
+	// Websocket is not needed when output is streamed in HTTP response
+	switch args.Stream {
+	case "", xsapiv1.ExecStreamSSE, xsapiv1.ExecStreamNDJSON:
+	default:
+		common.APIError(c, "Invalid stream mode")
+		return
+	}
 	sop := sess.IOSocket
-	if sop == nil {
+	if sop == nil && args.Stream == "" {
 		common.APIError(c, "Websocket not established")
 		return
 	}
@@ -78,6 +85,9 @@ func (s *APIService) execCmd(c *gin.Context) {
 		common.APIError(c, "Unknown id")
 		return
 	}
+	if !s.checkFolder(c, *f, folderAccessExec) {
+		return
+	}
 	fld := *f
 	prj := fld.GetConfig()
 
@@ -108,11 +118,7 @@ func (s *APIService) execCmd(c *gin.Context) {
 
 	// Copy and Translate path from client to server
 	for _, aa := range args.Args {
-		if strings.Contains(aa, prj.ClientPath) {
-			cmdArgs = append(cmdArgs, fld.ConvPathCli2Svr(aa))
-		} else {
-			cmdArgs = append(cmdArgs, aa)
-		}
+		cmdArgs = append(cmdArgs, fld.ConvPathCli2Svr(aa))
 	}
 
 	// Allocate pts if tty if used
@@ -133,6 +139,81 @@ func (s *APIService) execCmd(c *gin.Context) {
 		execCommandID++
 	}
 
+	// Set resource limits (server limits are upper bounds of command ones)
+	limits := mergeExecLimits(s.Config.FileConf.ExecConf.Limits, args.Limits)
+
+	// Set command execution timeout
+	cmdTimeout := args.CmdTimeout
+	if cmdTimeout == 0 {
+		// 0 : default timeout
+		cmdTimeout = s.Config.FileConf.ExecConf.Timeout
+	}
+	if limits.WallTime > 0 && (cmdTimeout <= 0 || limits.WallTime < cmdTimeout) {
+		cmdTimeout = limits.WallTime
+	}
+	limits.WallTime = cmdTimeout
+
+	// Priority is bounded, except for privileged clients
+	priority := args.Priority
+	if !s.auth.HasPerm(reqIdentity(c), PermExecPriority) {
+		priority = boundExecPriority(priority, s.Config.FileConf.ExecConf.MaxPriority)
+	}
+
+	// Record command in history
+	sdkID := args.SdkID
+	if sdkID == "" {
+		sdkID = prj.DefaultSdk
+	}
+	xcmd, err := s.execCmds.Add(xsapiv1.ExecCommandInfo{
+		CmdID:    args.CmdID,
+		Cmd:      args.Cmd,
+		Args:     args.Args,
+		CmdLine:  strings.TrimSpace(strings.Join(cmd, " ") + " " + strings.Join(cmdArgs, " ")),
+		RPath:    args.RPath,
+		FolderID: prj.ID,
+		SdkID:    sdkID,
+		Timeout:  cmdTimeout,
+		Priority: priority,
+		Limits:   limits,
+	}, sess.ID)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	// Isolate command: only folder (and its mapped paths), SDK and a private
+	// tmp are visible
+	if s.execCmds.SandboxEnabled() {
+		opts := ExecSandboxOpts{
+			RWPaths: []string{fld.GetFullPath("")},
+			Network: args.Network || prj.AllowNetwork,
+			TTY:     args.TTY,
+		}
+		for _, m := range prj.PathMappings {
+			// Mount resolved path, so that it's the checked one
+			rp, err := filepath.EvalSymlinks(m.ServerPath)
+			if err != nil {
+				continue
+			}
+			if !serverPathAllowed(rp, s.Config.FileConf.PathMappingRoots) {
+				s.Log.Warningf("Folder %s: path mapping %s not mounted in sandbox (not an allowed directory)", prj.ID, m.ServerPath)
+				continue
+			}
+			opts.RWPaths = append(opts.RWPaths, rp)
+		}
+		if iid, err := s.sdks.ResolveID(sdkID); err == nil {
+			if sdk := s.sdks.Get(iid); sdk != nil && sdk.Path != "" {
+				opts.ROPaths = append(opts.ROPaths, sdk.Path)
+			}
+		}
+		cmdLine := strings.Join(cmd, " ") + " " + strings.Join(cmdArgs, " ")
+		cmd = s.execCmds.SandboxCommand(cmdLine, opts)
+		cmdArgs = []string{}
+	}
+
+	// Save PID and read stdin from fifo managed by server (see InputCB below)
+	cmd = append(xcmd.ShellSetup(), cmd...)
+
 	// Create new execution over WS context
 	execWS := eows.New(strings.Join(cmd, " "), cmdArgs, sop, sess.ID, args.CmdID)
 	execWS.Log = s.Log
@@ -140,82 +221,112 @@ func (s *APIService) execCmd(c *gin.Context) {
 	// Append client project dir to environment
 	execWS.Env = append(args.Env, "CLIENT_PROJECT_DIR="+prj.ClientPath)
 
-	// Set command execution timeout
-	if args.CmdTimeout == 0 {
-		// 0 : default timeout
-		// TODO get default timeout from server-config.json file
-		execWS.CmdExecTimeout = 24 * 60 * 60 // 1 day
-	} else {
-		execWS.CmdExecTimeout = args.CmdTimeout
-	}
+	execWS.CmdExecTimeout = cmdTimeout
+
+	// Paths of input and output are translated by streams, because a path
+	// may be split between two chunks
+	pathConv := fld.PathConverter()
+	stdinConv := pathConv.Cli2SvrStream()
+	stdoutConv := pathConv.Svr2CliStream()
+	stderrConv := pathConv.Svr2CliStream()
 
 	// Define callback for input (stdin)
-	execWS.InputEvent = xsapiv1.ExecInEvent
-	execWS.InputCB = func(e *eows.ExecOverWS, stdin string) (string, error) {
+	// Input events are not handled by eows but directly forwarded into stdin
+	// fifo, so that they can be received from any WS attached to the command
+	xcmd.InputCB = func(stdin string) {
 		s.Log.Debugf("STDIN <<%v>>", strings.Replace(stdin, "\n", "\\n", -1))
 
 		// Handle Ctrl-D
 		if len(stdin) == 1 && stdin == "\x04" {
 			// Close stdin
-			errMsg := fmt.Errorf("close stdin: %v", stdin)
-			return "", errMsg
+			s.Log.Debugf("close stdin of command %s", args.CmdID)
+			if rest := stdinConv.Flush(); rest != "" {
+				xcmd.Input(rest)
+			}
+			xcmd.CloseStdin()
+			return
 		}
 
-		// Set correct path
-		data := e.UserData
-		prjID := (*data)["ID"].(string)
-		f := s.mfolders.Get(prjID)
-		if f == nil {
-			s.Log.Errorf("InputCB: Cannot get folder ID %s", prjID)
-		} else {
-			// Translate paths from client to server
-			stdin = (*f).ConvPathCli2Svr(stdin)
-		}
+		// Translate paths from client to server
+		stdin = stdinConv.Write(stdin)
 
-		return stdin, nil
+		if err := xcmd.Input(stdin); err != nil {
+			s.Log.Errorf("InputCB: Cannot write stdin of command %s: %v", args.CmdID, err)
+		}
 	}
-
-	// Define callback for output (stdout+stderr)
-	execWS.OutputCB = func(e *eows.ExecOverWS, stdout, stderr string) {
-		// IO socket can be nil when disconnected
-		so := s.sessions.IOSocketGet(e.Sid)
-		if so == nil {
-			s.Log.Infof("%s not emitted: WS closed (sid:%s, msgid:%s)", xsapiv1.ExecOutEvent, e.Sid, e.CmdID)
+	if sop != nil {
+		if err := xcmd.BindInput(sop); err != nil {
+			xcmd.Exit(-1, err)
+			common.APIError(c, err.Error())
 			return
 		}
+	}
 
+	// Extract diagnostics (compiler errors, warnings...) from output
+	diagParser := NewExecDiagParser(fld.GetFullPath(args.RPath), func(path string) string {
+		if f := s.mfolders.Get(prj.ID); f != nil {
+			return (*f).ConvPathSvr2Cli(path)
+		}
+		return path
+	})
+
+	// Define callback for output (stdout+stderr)
+	execWS.OutputCB = func(e *eows.ExecOverWS, stdout, stderr string) {
 		// Retrieve project ID and RootPath
 		data := e.UserData
 		prjID := (*data)["ID"].(string)
 		gdbServerTTY := (*data)["gdbServerTTY"].(string)
 
-		f := s.mfolders.Get(prjID)
-		if f == nil {
-			s.Log.Errorf("OutputCB: Cannot get folder ID %s", prjID)
-		} else {
-			// Translate paths from server to client
-			stdout = (*f).ConvPathSvr2Cli(stdout)
-			stderr = (*f).ConvPathSvr2Cli(stderr)
-		}
+		// Parse raw output (paths of diagnostics are converted by parser)
+		diags := append(diagParser.Parse("stdout", stdout), diagParser.Parse("stderr", stderr)...)
 
-		s.Log.Debugf("%s emitted - WS sid[4:] %s - id:%s - prjID:%s", xsapiv1.ExecOutEvent, e.Sid[4:], e.CmdID, prjID)
+		// Translate paths from server to client
 		if stdout != "" {
-			s.Log.Debugf("STDOUT <<%v>>", strings.Replace(stdout, "\n", "\\n", -1))
+			stdout = stdoutConv.Write(stdout)
 		}
 		if stderr != "" {
-			s.Log.Debugf("STDERR <<%v>>", strings.Replace(stderr, "\n", "\\n", -1))
+			stderr = stderrConv.Write(stderr)
+		}
+		if stdout == "" && stderr == "" {
+			// whole chunk kept by path converters
+			s.execEmitDiagnostics(xcmd, diags)
+			return
 		}
 
-		// FIXME replace by .BroadcastTo a room
-		err := (*so).Emit(xsapiv1.ExecOutEvent, xsapiv1.ExecOutMsg{
+		outMsg := xsapiv1.ExecOutMsg{
 			CmdID:     e.CmdID,
 			Timestamp: time.Now().String(),
 			Stdout:    stdout,
 			Stderr:    stderr,
-		})
-		if err != nil {
+		}
+
+		// Save output in history (even when WS is closed)
+		if err := xcmd.Output(outMsg); err == errOutputLimit {
+			s.execCmds.LimitReached(xcmd, xsapiv1.ExecLimitOutput)
+			return
+		} else if err != nil {
+			s.Log.Errorf("Cannot save output of command %s: %v", e.CmdID, err)
+		}
+
+		s.Log.Debugf("%s emitted - WS sid[4:] %s - id:%s - prjID:%s", xsapiv1.ExecOutEvent, e.Sid[4:], e.CmdID, prjID)
+		if stdout != "" {
+			s.Log.Debugf("STDOUT <<%v>>", strings.Replace(stdout, "\n", "\\n", -1))
+		}
+		if stderr != "" {
+			s.Log.Debugf("STDERR <<%v>>", strings.Replace(stderr, "\n", "\\n", -1))
+		}
+
+		// Emit to attached client (or buffer output till a client attaches)
+		if err := s.execCmds.EmitOutput(xcmd, outMsg); err != nil {
 			s.Log.Errorf("WS Emit : %v", err)
 		}
+		s.execEmitDiagnostics(xcmd, diags)
+
+		// IO socket can be nil when disconnected
+		so := s.sessions.IOSocketGet(e.Sid)
+		if so == nil {
+			return
+		}
 
 		// XXX - Workaround due to gdbserver bug that doesn't redirect
 		// inferior output (https://bugs.eclipse.org/bugs/show_bug.cgi?id=437532#c13)
@@ -264,21 +375,45 @@ func (s *APIService) execCmd(c *gin.Context) {
 			}
 		}()
 
-		// IO socket can be nil when disconnected
-		so := s.sessions.IOSocketGet(e.Sid)
-		if so == nil {
-			s.Log.Infof("%s not emitted - WS closed (id:%s)", xsapiv1.ExecExitEvent, e.CmdID)
-			return
+		// Emit output kept by path converters
+		if stdout, stderr := stdoutConv.Flush(), stderrConv.Flush(); stdout != "" || stderr != "" {
+			outMsg := xsapiv1.ExecOutMsg{
+				CmdID:     e.CmdID,
+				Timestamp: time.Now().String(),
+				Stdout:    stdout,
+				Stderr:    stderr,
+			}
+			if err := xcmd.Output(outMsg); err == nil {
+				s.execCmds.EmitOutput(xcmd, outMsg)
+			}
 		}
 
+		// Report limit hit by command (if any)
+		limitHit := s.execCmds.CheckLimits(xcmd)
+		if limitHit != "" {
+			s.Log.Infof("Command [Cmd ID %s] reached %s limit", e.CmdID, limitHit)
+		}
+
+		// Save exit status in history
+		if errH := xcmd.Exit(code, err); errH != nil {
+			s.Log.Errorf("Cannot save exit status of command %s: %v", e.CmdID, errH)
+		}
+
+		// Allow queued commands to start
+		s.execCmds.Done(xcmd)
+
 		// Retrieve project ID and RootPath
 		data := e.UserData
 		prjID := (*data)["ID"].(string)
 		exitImm := (*data)["ExitImmediate"].(bool)
 
 		// XXX - workaround to be sure that Syncthing detected all changes
-		if err := s.mfolders.ForceSync(prjID); err != nil {
-			s.Log.Errorf("Error while syncing folder %s: %v", prjID, err)
+		// (Git folders are only updated on request, so that all commands of
+		// a job are executed on the same commit)
+		if prj.Type != xsapiv1.TypeGit {
+			if err := s.mfolders.ForceSync(prjID); err != nil {
+				s.Log.Errorf("Error while syncing folder %s: %v", prjID, err)
+			}
 		}
 		if !exitImm {
 			// Wait end of file sync
@@ -297,12 +432,16 @@ func (s *APIService) execCmd(c *gin.Context) {
 			s.Log.Debugf("OK file are synchronized.")
 		}
 
-		// FIXME replace by .BroadcastTo a room
-		errSoEmit := (*so).Emit(xsapiv1.ExecExitEvent, xsapiv1.ExecExitMsg{
-			CmdID:     e.CmdID,
-			Timestamp: time.Now().String(),
-			Code:      code,
-			Error:     err,
+		s.execEmitDiagnostics(xcmd, diagParser.Flush())
+
+		// Emit to attached client (or keep it till a client attaches)
+		errSoEmit := s.execCmds.EmitExit(xcmd, xsapiv1.ExecExitMsg{
+			CmdID:       e.CmdID,
+			Timestamp:   time.Now().String(),
+			Code:        code,
+			Error:       err,
+			Limit:       limitHit,
+			Diagnostics: diagParser.Summary(),
 		})
 		if errSoEmit != nil {
 			s.Log.Errorf("WS Emit : %v", errSoEmit)
@@ -323,15 +462,70 @@ func (s *APIService) execCmd(c *gin.Context) {
 	// Start command execution
 	s.Log.Infof("Execute [Cmd ID %s]: %v %v", execWS.CmdID, execWS.Cmd, execWS.Args)
 
-	err = execWS.Start()
+	// Listen output before starting to not miss anything
+	var lst *ExecListener
+	if args.Stream != "" {
+		lst = xcmd.AddListener()
+		defer xcmd.RemoveListener(lst)
+	}
+
+	// Start now or queue command when concurrency limits are reached
+	err = s.execCmds.Start(xcmd, execWS)
 	if err != nil {
+		xcmd.Exit(-1, err)
 		common.APIError(c, err.Error())
 		return
 	}
 
+	if lst != nil {
+		s.execStream(c, lst, args.Stream)
+		return
+	}
+
 	c.JSON(http.StatusOK, xsapiv1.ExecResult{Status: "OK", CmdID: execWS.CmdID})
 }
 
+// execEmitDiagnostics emits diagnostics found in output of a command
+func (s *APIService) execEmitDiagnostics(xcmd *ExecCommand, diags []xsapiv1.ExecDiagnostic) {
+	for _, d := range diags {
+		err := s.execCmds.Emit(xcmd, xsapiv1.ExecDiagnosticEvent, xsapiv1.ExecDiagnosticMsg{
+			CmdID:          xcmd.GetInfo().CmdID,
+			Timestamp:      time.Now().String(),
+			ExecDiagnostic: d,
+		})
+		if err != nil {
+			s.Log.Errorf("WS Emit : %v", err)
+		}
+	}
+}
+
+// execStream sends command output and exit messages in HTTP response
+// till command exits or client closes connection
+func (s *APIService) execStream(c *gin.Context, lst *ExecListener, mode string) {
+	if mode == xsapiv1.ExecStreamNDJSON {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	clientGone := c.Request.Context().Done()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-clientGone:
+			return false
+		case msg := <-lst.C:
+			if exit, ok := msg.Data.(xsapiv1.ExecExitMsg); ok {
+				msg.Data = newExecExitJSONMsg(exit)
+			}
+			if mode == xsapiv1.ExecStreamSSE {
+				c.SSEvent(msg.Event, msg.Data)
+			} else if err := json.NewEncoder(w).Encode(msg); err != nil {
+				s.Log.Errorf("Stream encoding error: %v", err)
+				return false
+			}
+			return msg.Event != xsapiv1.ExecExitEvent
+		}
+	})
+}
+
 // ExecCmd executes remotely a command
 func (s *APIService) execSignalCmd(c *gin.Context) {
 	var args xsapiv1.ExecSignalArgs
@@ -343,6 +537,16 @@ func (s *APIService) execSignalCmd(c *gin.Context) {
 
 	s.Log.Debugf("Signal %s for command ID %s", args.Signal, args.CmdID)
 
+	// Commands not known by history (eg. SDK installations) can only be
+	// signaled by admins
+	if xcmd := s.execCmds.Get(args.CmdID); xcmd != nil {
+		if !s.checkCmd(c, xcmd, folderAccessExec) {
+			return
+		}
+	} else if !s.checkPerm(c, PermFoldersAll) {
+		return
+	}
+
 	e := eows.GetEows(args.CmdID)
 	if e == nil {
 		common.APIError(c, "unknown cmdID")
@@ -357,3 +561,86 @@ func (s *APIService) execSignalCmd(c *gin.Context) {
 
 	c.JSON(http.StatusOK, xsapiv1.ExecSigResult{Status: "OK", CmdID: args.CmdID})
 }
+
+// execAttachCmd attaches a running command to the session of the caller
+func (s *APIService) execAttachCmd(c *gin.Context) {
+	var args xsapiv1.ExecAttachArgs
+
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	// Retrieve session info
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		common.APIError(c, "Unknown sessions")
+		return
+	}
+
+	s.Log.Debugf("Attach command ID %s to session %s", args.CmdID, sess.ID)
+
+	xcmd := s.execCmds.Get(args.CmdID)
+	if xcmd == nil {
+		common.APIError(c, "unknown cmdID")
+		return
+	}
+	if !s.checkCmd(c, xcmd, folderAccessExec) {
+		return
+	}
+
+	if err := s.execCmds.Attach(xcmd, sess); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, xsapiv1.ExecAttachResult{Status: "OK", CmdID: args.CmdID})
+}
+
+// getExecCmds returns all running commands
+func (s *APIService) getExecCmds(c *gin.Context) {
+	c.JSON(http.StatusOK, s.filterCmds(c, s.execCmds.GetRunningInfoArr()))
+}
+
+// getExecCmd returns info of a specific command
+func (s *APIService) getExecCmd(c *gin.Context) {
+	xcmd := s.execCmds.Get(c.Param("cmdid"))
+	if xcmd == nil {
+		common.APIError(c, "unknown cmdID")
+		return
+	}
+	if !s.checkCmd(c, xcmd, folderAccessRead) {
+		return
+	}
+
+	c.JSON(http.StatusOK, xcmd.GetInfo())
+}
+
+// killExecCmd terminates a running command (SIGTERM then SIGKILL after a
+// grace period that can be set in seconds with grace query parameter)
+func (s *APIService) killExecCmd(c *gin.Context) {
+	xcmd := s.execCmds.Get(c.Param("cmdid"))
+	if xcmd == nil {
+		common.APIError(c, "unknown cmdID")
+		return
+	}
+	if !s.checkCmd(c, xcmd, folderAccessExec) {
+		return
+	}
+
+	grace := 0
+	if gArg := c.Query("grace"); gArg != "" {
+		var err error
+		if grace, err = strconv.Atoi(gArg); err != nil {
+			common.APIError(c, "Invalid grace")
+			return
+		}
+	}
+
+	if err := s.execCmds.Kill(xcmd, grace); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, xcmd.GetInfo())
+}
@@ -27,7 +27,14 @@ import (
 
 // getFolders returns all folders configuration
 func (s *APIService) getFolders(c *gin.Context) {
-	c.JSON(http.StatusOK, s.mfolders.GetConfigArr())
+	id := reqIdentity(c)
+	res := []xsapiv1.FolderConfig{}
+	for _, cfg := range s.mfolders.GetConfigArr() {
+		if s.auth.FolderAllowed(id, &cfg, folderAccessRead) {
+			res = append(res, cfg)
+		}
+	}
+	c.JSON(http.StatusOK, res)
 }
 
 // getFolder returns a specific folder configuration
@@ -42,21 +49,38 @@ func (s *APIService) getFolder(c *gin.Context) {
 		common.APIError(c, "Invalid id")
 		return
 	}
+	if !s.checkFolder(c, *f, folderAccessRead) {
+		return
+	}
 
 	c.JSON(http.StatusOK, (*f).GetConfig())
 }
 
 // addFolder adds a new folder to server config
 func (s *APIService) addFolder(c *gin.Context) {
+	if !s.checkPerm(c, PermFoldersCreate) {
+		return
+	}
+
 	var cfgArg xsapiv1.FolderConfig
 	if c.BindJSON(&cfgArg) != nil {
 		common.APIError(c, "Invalid arguments")
 		return
 	}
 
+	// Folder is owned by its creator (only admins can set another owner)
+	if id := reqIdentity(c); id != nil && (cfgArg.Owner == "" || !s.auth.HasPerm(id, PermFoldersAll)) {
+		cfgArg.Owner = id.User
+	}
+
+	// Local repositories on server are not protected by folders ACL
+	if cfgArg.Type == xsapiv1.TypeGit && !gitRemoteURL(cfgArg.DataGit.URL) && !s.checkPerm(c, PermFoldersAll) {
+		return
+	}
+
 	s.Log.Debugln("Add folder config: ", cfgArg)
 
-	newFld, err := s.mfolders.Add(cfgArg)
+	newFld, err := s.mfolders.Add(cfgArg, s.sessions.GetID(c))
 	if err != nil {
 		common.APIError(c, err.Error())
 		return
@@ -72,6 +96,14 @@ func (s *APIService) syncFolder(c *gin.Context) {
 		common.APIError(c, err.Error())
 		return
 	}
+	f := s.mfolders.Get(id)
+	if f == nil {
+		common.APIError(c, "Invalid id")
+		return
+	}
+	if !s.checkFolder(c, *f, folderAccessExec) {
+		return
+	}
 	s.Log.Debugln("Sync folder id: ", id)
 
 	err = s.mfolders.ForceSync(id)
@@ -91,9 +123,18 @@ func (s *APIService) delFolder(c *gin.Context) {
 		return
 	}
 
+	f := s.mfolders.Get(id)
+	if f == nil {
+		common.APIError(c, "Invalid id")
+		return
+	}
+	if !s.checkFolder(c, *f, folderAccessOwner) {
+		return
+	}
+
 	s.Log.Debugln("Delete folder id ", id)
 
-	delEntry, err := s.mfolders.Delete(id)
+	delEntry, err := s.mfolders.Delete(id, s.sessions.GetID(c))
 	if err != nil {
 		common.APIError(c, err.Error())
 		return
@@ -109,6 +150,15 @@ func (s *APIService) updateFolder(c *gin.Context) {
 		return
 	}
 
+	f := s.mfolders.Get(id)
+	if f == nil {
+		common.APIError(c, "Invalid id")
+		return
+	}
+	if !s.checkFolder(c, *f, folderAccessOwner) {
+		return
+	}
+
 	s.Log.Debugln("Update folder id ", id)
 
 	var cfgArg xsapiv1.FolderConfig
@@ -117,7 +167,25 @@ func (s *APIService) updateFolder(c *gin.Context) {
 		return
 	}
 
-	upFld, err := s.mfolders.Update(id, cfgArg)
+	// Owner and ACL are unchanged when not set, only admins can change owner
+	cur := (*f).GetConfig()
+	if cfgArg.Owner == "" {
+		cfgArg.Owner = cur.Owner
+	} else if cfgArg.Owner != cur.Owner && !s.checkPerm(c, PermFoldersAll) {
+		return
+	}
+	if cfgArg.ACL == nil {
+		cfgArg.ACL = cur.ACL
+	}
+
+	// Only ref of a Git folder can be changed (unchanged when not set)
+	ref := cfgArg.DataGit.Ref
+	cfgArg.DataGit = cur.DataGit
+	if cur.Type == xsapiv1.TypeGit && ref != "" {
+		cfgArg.DataGit.Ref = ref
+	}
+
+	upFld, err := s.mfolders.Update(id, cfgArg, s.sessions.GetID(c))
 	if err != nil {
 		common.APIError(c, err.Error())
 		return
@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+)
+
+// getHistory returns all commands saved in history
+func (s *APIService) getHistory(c *gin.Context) {
+	c.JSON(http.StatusOK, s.filterCmds(c, s.execCmds.GetInfoArr()))
+}
+
+// getHistoryCmd returns history info of a specific command
+func (s *APIService) getHistoryCmd(c *gin.Context) {
+	cmd := s.execCmds.Get(c.Param("cmdid"))
+	if cmd == nil {
+		common.APIError(c, "unknown cmdID")
+		return
+	}
+	if !s.checkCmd(c, cmd, folderAccessRead) {
+		return
+	}
+
+	c.JSON(http.StatusOK, cmd.GetInfo())
+}
+
+// getHistoryCmdOutput replays output of a specific command
+// (use offset query parameter to skip messages already received)
+func (s *APIService) getHistoryCmdOutput(c *gin.Context) {
+	cmd := s.execCmds.Get(c.Param("cmdid"))
+	if cmd == nil {
+		common.APIError(c, "unknown cmdID")
+		return
+	}
+	if !s.checkCmd(c, cmd, folderAccessRead) {
+		return
+	}
+
+	offset := 0
+	if offArg := c.Query("offset"); offArg != "" {
+		var err error
+		if offset, err = strconv.Atoi(offArg); err != nil || offset < 0 {
+			common.APIError(c, "Invalid offset")
+			return
+		}
+	}
+
+	out, err := cmd.GetOutput(offset)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, out)
+}
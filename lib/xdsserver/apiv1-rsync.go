@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// getRsyncFolder returns the RsyncHTTP folder referenced by id parameter
+// (an error is replied when folder is not found or access is not allowed)
+func (s *APIService) getRsyncFolder(c *gin.Context, access int) *RsyncFolder {
+	id, err := s.mfolders.ResolveID(c.Param("id"))
+	if err != nil {
+		common.APIError(c, err.Error())
+		return nil
+	}
+	f := s.mfolders.Get(id)
+	if f == nil {
+		common.APIError(c, "Invalid id")
+		return nil
+	}
+	if !s.checkFolder(c, *f, access) {
+		return nil
+	}
+	fld, ok := (*f).(*RsyncFolder)
+	if !ok {
+		common.APIError(c, "Not a "+xsapiv1.TypeRsyncHTTP+" folder")
+		return nil
+	}
+	return fld
+}
+
+// getRsyncManifest returns files on server and differences with manifest
+func (s *APIService) getRsyncManifest(c *gin.Context) {
+	fld := s.getRsyncFolder(c, folderAccessRead)
+	if fld == nil {
+		return
+	}
+
+	st, err := fld.GetStatus()
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, st)
+}
+
+// setRsyncManifest sets the manifest of a folder
+func (s *APIService) setRsyncManifest(c *gin.Context) {
+	fld := s.getRsyncFolder(c, folderAccessExec)
+	if fld == nil {
+		return
+	}
+
+	var args xsapiv1.RsyncManifest
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	st, err := fld.SetManifest(args)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, st)
+}
+
+// getRsyncSignature returns blocks checksums of a file
+// (use path and blockSize query parameters)
+func (s *APIService) getRsyncSignature(c *gin.Context) {
+	fld := s.getRsyncFolder(c, folderAccessRead)
+	if fld == nil {
+		return
+	}
+
+	blockSize := 0
+	if bsArg := c.Query("blockSize"); bsArg != "" {
+		var err error
+		if blockSize, err = strconv.Atoi(bsArg); err != nil {
+			common.APIError(c, "Invalid blockSize")
+			return
+		}
+	}
+
+	sig, err := fld.Signature(c.Query("path"), blockSize)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, sig)
+}
+
+// applyRsyncDelta uploads a file as a delta of its version on server
+func (s *APIService) applyRsyncDelta(c *gin.Context) {
+	fld := s.getRsyncFolder(c, folderAccessExec)
+	if fld == nil {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, rsyncMaxDeltaRequest)
+	var args xsapiv1.RsyncDeltaArgs
+	if c.BindJSON(&args) != nil {
+		common.APIError(c, "Invalid arguments")
+		return
+	}
+
+	st, err := fld.ApplyDelta(args)
+	if err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, st)
+}
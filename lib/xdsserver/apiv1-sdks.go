@@ -48,6 +48,10 @@ func (s *APIService) getSdk(c *gin.Context) {
 
 // installSdk Install a new Sdk
 func (s *APIService) installSdk(c *gin.Context) {
+	if !s.checkPerm(c, PermSdksManage) {
+		return
+	}
+
 	var args xsapiv1.SDKInstallArgs
 
 	if err := c.BindJSON(&args); err != nil {
@@ -85,6 +89,10 @@ func (s *APIService) installSdk(c *gin.Context) {
 
 // abortInstallSdk Abort a SDK installation
 func (s *APIService) abortInstallSdk(c *gin.Context) {
+	if !s.checkPerm(c, PermSdksManage) {
+		return
+	}
+
 	var args xsapiv1.SDKInstallArgs
 
 	if err := c.BindJSON(&args); err != nil {
@@ -108,6 +116,10 @@ func (s *APIService) abortInstallSdk(c *gin.Context) {
 
 // removeSdk Uninstall a Sdk
 func (s *APIService) removeSdk(c *gin.Context) {
+	if !s.checkPerm(c, PermSdksManage) {
+		return
+	}
+
 	id, err := s.sdks.ResolveID(c.Param("id"))
 	if err != nil {
 		common.APIError(c, err.Error())
@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// getSessions returns all client sessions with their running commands
+func (s *APIService) getSessions(c *gin.Context) {
+	if !s.checkPerm(c, PermSessionsAdmin) {
+		return
+	}
+
+	cmds := make(map[string][]string)
+	for _, info := range s.execCmds.GetRunningInfoArr() {
+		cmds[info.SessionID] = append(cmds[info.SessionID], info.CmdID)
+	}
+
+	res := []xsapiv1.SessionInfo{}
+	for _, sess := range s.sessions.GetAll() {
+		info := sess.GetInfo()
+		if ids, ok := cmds[sessionPublicID(sess.ID)]; ok {
+			info.Commands = ids
+		}
+		res = append(res, info)
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// delSession force-disconnects a client session (identified by its public
+// ID) and kills its running commands
+func (s *APIService) delSession(c *gin.Context) {
+	if !s.checkPerm(c, PermSessionsAdmin) {
+		return
+	}
+
+	pubID := c.Param("id")
+	var sess *ClientSession
+	for _, ss := range s.sessions.GetAll() {
+		if pubID != "" && sessionPublicID(ss.ID) == pubID {
+			sess = &ss
+			break
+		}
+	}
+	if sess == nil {
+		common.APIError(c, "Unknown session id")
+		return
+	}
+	sid := sess.ID
+	info := sess.GetInfo()
+
+	// Kill running commands of session (SIGTERM, then SIGKILL after grace period)
+	for _, cmdInfo := range s.execCmds.GetRunningInfoArr() {
+		if cmdInfo.SessionID != pubID {
+			continue
+		}
+		if xcmd := s.execCmds.Get(cmdInfo.CmdID); xcmd != nil {
+			if err := s.execCmds.Kill(xcmd, 0); err != nil {
+				s.Log.Warningf("Cannot kill command %s of session %s: %v", cmdInfo.CmdID, pubID, err)
+				continue
+			}
+			info.Commands = append(info.Commands, cmdInfo.CmdID)
+		}
+	}
+
+	if err := s.sessions.Delete(sid); err != nil {
+		common.APIError(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
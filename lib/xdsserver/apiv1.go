@@ -46,6 +46,11 @@ func NewAPIV1(ctx *Context) *APIService {
 	s.apiRouter.POST("/folders/sync/:id", s.syncFolder)
 	s.apiRouter.DELETE("/folders/:id", s.delFolder)
 
+	s.apiRouter.GET("/rsync/:id/manifest", s.getRsyncManifest)
+	s.apiRouter.PUT("/rsync/:id/manifest", s.setRsyncManifest)
+	s.apiRouter.GET("/rsync/:id/signature", s.getRsyncSignature)
+	s.apiRouter.POST("/rsync/:id/delta", s.applyRsyncDelta)
+
 	s.apiRouter.GET("/sdks", s.getSdks)
 	s.apiRouter.GET("/sdks/:id", s.getSdk)
 	s.apiRouter.POST("/sdks", s.installSdk)
@@ -55,9 +60,20 @@ func NewAPIV1(ctx *Context) *APIService {
 	s.apiRouter.POST("/make", s.buildMake)
 	s.apiRouter.POST("/make/:id", s.buildMake)
 
+	s.apiRouter.GET("/exec", s.getExecCmds)
+	s.apiRouter.GET("/exec/:cmdid", s.getExecCmd)
 	s.apiRouter.POST("/exec", s.execCmd)
 	s.apiRouter.POST("/exec/:id", s.execCmd)
+	s.apiRouter.DELETE("/exec/:cmdid", s.killExecCmd)
 	s.apiRouter.POST("/signal", s.execSignalCmd)
+	s.apiRouter.POST("/attach", s.execAttachCmd)
+
+	s.apiRouter.GET("/history", s.getHistory)
+	s.apiRouter.GET("/history/:cmdid", s.getHistoryCmd)
+	s.apiRouter.GET("/history/:cmdid/output", s.getHistoryCmdOutput)
+
+	s.apiRouter.GET("/sessions", s.getSessions)
+	s.apiRouter.DELETE("/sessions/:id", s.delSession)
 
 	s.apiRouter.GET("/events", s.eventsList)
 	s.apiRouter.POST("/events/register", s.eventsRegister)
@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/syncthing/syncthing/lib/sync"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authHtpasswd Authentication using HTTP basic auth and a users file with
+// htpasswd format (user:hash), supported hashes are bcrypt ($2y$, as
+// generated by htpasswd -B) and SHA1 ({SHA}). File is reloaded when changed.
+type authHtpasswd struct {
+	*Context
+	file    string
+	users   map[string]string
+	mtime   time.Time
+	checked map[string][32]byte // users which password has been checked (bcrypt is slow)
+	mutex   sync.Mutex
+}
+
+func newAuthHtpasswd(ctx *Context, file string) (*authHtpasswd, error) {
+	a := &authHtpasswd{
+		Context: ctx,
+		file:    file,
+		mutex:   sync.NewMutex(),
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Name returns the name of authentication method
+func (a *authHtpasswd) Name() string {
+	return "htpasswd"
+}
+
+// Authenticate checks user and password of HTTP basic auth
+func (a *authHtpasswd) Authenticate(c *gin.Context) (*AuthIdentity, error) {
+	user, passwd, ok := c.Request.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	a.mutex.Lock()
+	if err := a.load(); err != nil {
+		a.Log.Errorf("Cannot reload users file: %v", err)
+	}
+	hash, exist := a.users[user]
+	prev, cached := a.checked[user]
+	a.mutex.Unlock()
+
+	if !exist {
+		return nil, fmt.Errorf("Invalid user or password")
+	}
+
+	// Cache of successful checks, invalidated when users file changes
+	sum := sha256.Sum256([]byte(hash + "\x00" + passwd))
+	if cached && subtle.ConstantTimeCompare(prev[:], sum[:]) == 1 {
+		return &AuthIdentity{User: user}, nil
+	}
+
+	// Slow check is done unlocked to not serialize all requests
+
+	valid := false
+	switch {
+	case strings.HasPrefix(hash, "$2y$") || strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$"):
+		valid = bcrypt.CompareHashAndPassword([]byte(hash), []byte(passwd)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		s := sha1.Sum([]byte(passwd))
+		valid = subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(s[:]))) == 1
+	}
+	if !valid {
+		return nil, fmt.Errorf("Invalid user or password")
+	}
+
+	a.mutex.Lock()
+	if a.users[user] == hash {
+		a.checked[user] = sum
+	}
+	a.mutex.Unlock()
+	return &AuthIdentity{User: user}, nil
+}
+
+// load (re)loads users file when modified
+func (a *authHtpasswd) load() error {
+	st, err := os.Stat(a.file)
+	if err != nil {
+		return err
+	}
+	if a.users != nil && st.ModTime().Equal(a.mtime) {
+		return nil
+	}
+
+	fd, err := os.Open(a.file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(fd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.Index(line, ":")
+		if idx <= 0 {
+			a.Log.Warningf("Invalid line %d of users file %s", n, a.file)
+			continue
+		}
+		user, hash := line[:idx], line[idx+1:]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			a.Log.Warningf("Unsupported password hash of user %s in %s (use htpasswd -B)", user, a.file)
+			continue
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.users = users
+	a.mtime = st.ModTime()
+	a.checked = make(map[string][32]byte)
+	a.Log.Infof("Users file %s loaded (%d users)", a.file, len(users))
+	return nil
+}
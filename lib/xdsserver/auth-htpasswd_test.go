@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// htpasswdTestBcrypt bcrypt hash of "allmine"
+const htpasswdTestBcrypt = "$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga"
+
+// htpasswdTestAuth authenticates a user using HTTP basic auth
+func htpasswdTestAuth(a *authHtpasswd, user, passwd string) (*AuthIdentity, error) {
+	req, _ := http.NewRequest("GET", "/api/v1/version", nil)
+	if user != "" {
+		req.SetBasicAuth(user, passwd)
+	}
+	return a.Authenticate(&gin.Context{Request: req})
+}
+
+func TestAuthHtpasswd(t *testing.T) {
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+
+	sha := sha1.Sum([]byte("secret"))
+	file := filepath.Join(ctx.Config.FileConf.ShareRootDir, "users")
+	content := "# comment\n" +
+		"bob:" + htpasswdTestBcrypt + "\n" +
+		"bill:$2y$" + htpasswdTestBcrypt[4:] + "\n" +
+		"alice:{SHA}" + base64.StdEncoding.EncodeToString(sha[:]) + "\n" +
+		"eve:plaintext\n" +
+		"invalid line\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAuthHtpasswd(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		user   string
+		passwd string
+		ok     bool
+	}{
+		{"bcrypt", "bob", "allmine", true},
+		{"bcrypt cached", "bob", "allmine", true},
+		{"bcrypt invalid password", "bob", "allmine2", false},
+		{"bcrypt $2y$", "bill", "allmine", true},
+		{"sha", "alice", "secret", true},
+		{"sha invalid password", "alice", "Secret", false},
+		{"unsupported hash", "eve", "plaintext", false},
+		{"unknown user", "mallory", "allmine", false},
+		{"empty password", "bob", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := htpasswdTestAuth(a, tt.user, tt.passwd)
+			if tt.ok && (err != nil || id == nil || id.User != tt.user) {
+				t.Errorf("Authenticate() = %v, %v, want user %s", id, err, tt.user)
+			}
+			if !tt.ok && (err == nil || id != nil) {
+				t.Errorf("Authenticate() = %v, %v, want an error", id, err)
+			}
+		})
+	}
+
+	// No basic auth: other methods may authenticate client
+	if id, err := htpasswdTestAuth(a, "", ""); id != nil || err != nil {
+		t.Errorf("Authenticate() without credentials = %v, %v", id, err)
+	}
+
+	// File is reloaded when changed (and cached checks are dropped)
+	if err := ioutil.WriteFile(file, []byte("alice:{SHA}"+base64.StdEncoding.EncodeToString(sha[:])+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Minute)
+	os.Chtimes(file, mtime, mtime)
+	if id, err := htpasswdTestAuth(a, "bob", "allmine"); err == nil || id != nil {
+		t.Errorf("removed user authenticated")
+	}
+	if id, err := htpasswdTestAuth(a, "alice", "secret"); err != nil || id == nil {
+		t.Errorf("Authenticate() after reload = %v, %v", id, err)
+	}
+}
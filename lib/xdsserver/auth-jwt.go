@@ -0,0 +1,377 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // register SHA-256/384/512 hashes
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+const (
+	jwtClockSkew     = 60 * time.Second // tolerance on exp and nbf claims
+	jwksRefreshDelay = 30 * time.Second // min delay between 2 fetches of keys set
+	jwksMaxAge       = time.Hour        // keys set is fetched again after this delay
+)
+
+// authJWT Authentication using JWT bearer tokens (as delivered by an OIDC
+// provider) which signature is checked using keys of a JWKS (RSA or ECDSA)
+type authJWT struct {
+	*Context
+	cfg       xdsconfig.AuthJWTConfig
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	client    *http.Client
+	mutex     sync.Mutex
+}
+
+// jwk JSON Web Key (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newAuthJWT(ctx *Context, cfg xdsconfig.AuthJWTConfig) (*authJWT, error) {
+	if cfg.JWKSURL == "" {
+		return nil, fmt.Errorf("JWT authentication: jwksURL must be set")
+	}
+	a := &authJWT{
+		Context: ctx,
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		mutex:   sync.NewMutex(),
+	}
+	// Keys set may not be reachable yet, so it's only a warning
+	if err := a.fetchKeys(); err != nil {
+		ctx.Log.Warningf("Cannot get JWT keys set: %v", err)
+	}
+	return a, nil
+}
+
+// Name returns the name of authentication method
+func (a *authJWT) Name() string {
+	return "jwt"
+}
+
+// Authenticate checks JWT bearer token
+func (a *authJWT) Authenticate(c *gin.Context) (*AuthIdentity, error) {
+	tok := bearerToken(c)
+	if strings.Count(tok, ".") != 2 {
+		return nil, nil
+	}
+
+	claims, err := a.verify(tok)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token: %v", err)
+	}
+
+	user, _ := claims[a.cfg.UserClaim].(string)
+	if user == "" {
+		return nil, fmt.Errorf("Invalid token: no %s claim", a.cfg.UserClaim)
+	}
+	id := &AuthIdentity{User: user, Roles: []string{}}
+	switch r := claims[a.cfg.RolesClaim].(type) {
+	case string:
+		id.Roles = strings.Fields(r)
+	case []interface{}:
+		for _, v := range r {
+			if s, ok := v.(string); ok {
+				id.Roles = append(id.Roles, s)
+			}
+		}
+	}
+	return id, nil
+}
+
+// verify checks signature and claims of a token and returns its claims
+func (a *authJWT) verify(tok string) (map[string]interface{}, error) {
+	parts := strings.Split(tok, ".")
+
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := jwtDecodeSegment(parts[0], &hdr); err != nil {
+		return nil, err
+	}
+	claims := make(map[string]interface{})
+	if err := jwtDecodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding")
+	}
+
+	key, err := a.getKey(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := jwtVerifySignature(hdr.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("missing expiration time")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtClockSkew)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	if a.cfg.Issuer != "" && claims["iss"] != a.cfg.Issuer {
+		return nil, fmt.Errorf("invalid issuer")
+	}
+	if a.cfg.Audience != "" {
+		valid := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			valid = aud == a.cfg.Audience
+		case []interface{}:
+			for _, v := range aud {
+				valid = valid || v == a.cfg.Audience
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid audience")
+		}
+	}
+	return claims, nil
+}
+
+// getKey returns the key used to sign a token (keys set is fetched again
+// when key is unknown, for example after a keys rotation)
+func (a *authJWT) getKey(kid string) (crypto.PublicKey, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	lookup := func() crypto.PublicKey {
+		if k, ok := a.keys[kid]; ok {
+			return k
+		}
+		// No key ID: only possible when keys set holds one key
+		if kid == "" && len(a.keys) == 1 {
+			for _, k := range a.keys {
+				return k
+			}
+		}
+		return nil
+	}
+
+	key := lookup()
+	if (key == nil && time.Since(a.fetchedAt) > jwksRefreshDelay) || time.Since(a.fetchedAt) > jwksMaxAge {
+		if err := a.fetchKeys(); err != nil {
+			a.Log.Warningf("Cannot get JWT keys set: %v", err)
+		}
+		key = lookup()
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown key '%s'", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys fetches the keys set (from an URL or a local file)
+func (a *authJWT) fetchKeys() error {
+	var data []byte
+	var err error
+	a.fetchedAt = time.Now()
+
+	if strings.HasPrefix(a.cfg.JWKSURL, "http://") || strings.HasPrefix(a.cfg.JWKSURL, "https://") {
+		resp, errG := a.client.Get(a.cfg.JWKSURL)
+		if errG != nil {
+			return errG
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("HTTP status %s", resp.Status)
+		}
+		data, err = ioutil.ReadAll(resp.Body)
+	} else {
+		data, err = ioutil.ReadFile(strings.TrimPrefix(a.cfg.JWKSURL, "file://"))
+	}
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("invalid keys set: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			a.Log.Warningf("Ignore JWT key '%s': %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	a.keys = keys
+	a.Log.Debugf("JWT keys set fetched: %d keys", len(keys))
+	return nil
+}
+
+// publicKey decodes a RSA or EC public key
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := jwtDecodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := jwtDecodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := jwtDecodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := jwtDecodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// jwtVerifySignature checks signature of a token (RS* and ES* algorithms)
+func jwtVerifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	if len(alg) != len("RS256") {
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	var hash crypto.Hash
+	switch alg[len(alg)-3:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type mismatch")
+		}
+		if rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+
+	case strings.HasPrefix(alg, "ES"):
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type mismatch")
+		}
+		// ES256, ES384 and ES512 use P-256, P-384 and P-521 curves
+		curveBits := map[crypto.Hash]int{crypto.SHA256: 256, crypto.SHA384: 384, crypto.SHA512: 521}
+		if k.Curve.Params().BitSize != curveBits[hash] {
+			return fmt.Errorf("key curve mismatch")
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	// Note that "none" and HMAC algorithms are refused on purpose
+	return fmt.Errorf("unsupported algorithm %s", alg)
+}
+
+// jwtDecodeSegment decodes a base64url JSON segment of a token
+func jwtDecodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return fmt.Errorf("invalid token encoding")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid token encoding")
+	}
+	return nil
+}
+
+// jwtDecodeInt decodes a base64url big integer
+func jwtDecodeInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid key encoding")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
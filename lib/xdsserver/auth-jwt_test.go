@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+)
+
+// jwtTestKeys Keys used to sign test tokens
+type jwtTestKeys struct {
+	rsa   *rsa.PrivateKey
+	ec    *ecdsa.PrivateKey
+	ec384 *ecdsa.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &jwtTestKeys{rsa: rk, ec: ek, ec384: ek384}
+}
+
+// jwks returns the keys set (JSON) of test keys
+func (k *jwtTestKeys) jwks() []byte {
+	enc := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	size := (k.ec.Curve.Params().BitSize + 7) / 8
+	set := map[string][]jwk{"keys": {
+		{Kty: "RSA", Kid: "rsa1", Use: "sig", N: enc(k.rsa.N.Bytes()), E: enc(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{Kty: "EC", Kid: "ec1", Crv: "P-256", X: enc(padBytes(k.ec.X.Bytes(), size)), Y: enc(padBytes(k.ec.Y.Bytes(), size))},
+		{Kty: "EC", Kid: "ec384", Crv: "P-384", X: enc(padBytes(k.ec384.X.Bytes(), 48)), Y: enc(padBytes(k.ec384.Y.Bytes(), 48))},
+		{Kty: "RSA", Kid: "enc1", Use: "enc", N: enc(k.rsa.N.Bytes()), E: "AQAB"},
+	}}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+// sign returns a token signed with alg (only RS256 and ES256 are
+// supported, other algorithms produce an invalid signature)
+func (k *jwtTestKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch alg {
+	case "RS256":
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(padBytes(r.Bytes(), 32), padBytes(s.Bytes(), 32)...)
+	default:
+		sig = []byte("signature")
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// padBytes left pads a big-endian integer to size bytes
+func padBytes(b []byte, size int) []byte {
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func TestAuthJWTVerify(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(keys.jwks())
+	}))
+	defer srv.Close()
+
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+	a, err := newAuthJWT(ctx, xdsconfig.AuthJWTConfig{
+		JWKSURL:    srv.URL,
+		Issuer:     "https://issuer",
+		Audience:   "xds",
+		UserClaim:  "sub",
+		RolesClaim: "roles",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.keys) != 3 {
+		t.Fatalf("%d keys loaded, want 3 (encryption key ignored)", len(a.keys))
+	}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "me", "iss": "https://issuer", "aud": "xds", "exp": now + 60, "nbf": now - 60}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	tests := []struct {
+		name string
+		tok  string
+		err  string
+	}{
+		{"RS256", keys.sign(t, "RS256", "rsa1", claims(nil)), ""},
+		{"ES256", keys.sign(t, "ES256", "ec1", claims(nil)), ""},
+		{"no nbf", keys.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"nbf": nil})), ""},
+		{"no exp", keys.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"exp": nil})), "missing expiration time"},
+		{"exp not a number", keys.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"exp": "2100-01-01"})), "missing expiration time"},
+		{"audience list", keys.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"aud": []string{"other", "xds"}})), ""},
+		{"expired in clock skew", keys.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"exp": now - 30})), ""},
+		{"expired", keys.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"exp": now - 120})), "token expired"},
+		{"not yet valid in clock skew", keys.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"nbf": now + 30})), ""},
+		{"not yet valid", keys.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"nbf": now + 120})), "token not yet valid"},
+		{"invalid audience", keys.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"aud": "other"})), "invalid audience"},
+		{"invalid audience list", keys.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"aud": []string{"other"}})), "invalid audience"},
+		{"no audience", keys.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"aud": nil})), "invalid audience"},
+		{"invalid issuer", keys.sign(t, "RS256", "rsa1", claims(map[string]interface{}{"iss": "https://other"})), "invalid issuer"},
+		{"unknown key", keys.sign(t, "RS256", "rsa2", claims(nil)), "unknown key 'rsa2'"},
+		{"encryption key", keys.sign(t, "RS256", "enc1", claims(nil)), "unknown key 'enc1'"},
+		{"key type mismatch", keys.sign(t, "RS256", "ec1", claims(nil)), "key type mismatch"},
+		{"key curve mismatch", keys.sign(t, "ES256", "ec384", claims(nil)), "key curve mismatch"},
+		{"alg none", keys.sign(t, "none", "rsa1", claims(nil)), "unsupported algorithm none"},
+		{"alg HS256", keys.sign(t, "HS256", "rsa1", claims(nil)), "unsupported algorithm HS256"},
+		{"empty alg", keys.sign(t, "", "rsa1", claims(nil)), "unsupported algorithm "},
+		{"invalid signature", keys.sign(t, "RS384", "rsa1", claims(nil)), "invalid signature"},
+		{"invalid encoding", "a.b.c", "invalid token encoding"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := a.verify(tt.tok)
+			if tt.err == "" && err != nil {
+				t.Errorf("verify() error = %v", err)
+			} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Errorf("verify() error = %v, want %s", err, tt.err)
+			}
+		})
+	}
+
+	// Tampered payload
+	tok := keys.sign(t, "ES256", "ec1", claims(nil))
+	parts := strings.Split(tok, ".")
+	payload, _ := json.Marshal(claims(map[string]interface{}{"sub": "admin"}))
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	if _, err := a.verify(strings.Join(parts, ".")); err == nil || err.Error() != "invalid signature" {
+		t.Errorf("verify() of tampered token error = %v", err)
+	}
+
+	// Keys set is not fetched again before refresh delay
+	if fetches != 1 {
+		t.Errorf("keys set fetched %d times, want 1", fetches)
+	}
+}
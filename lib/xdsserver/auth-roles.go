@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// Authorization of authenticated clients: roles (see auth.roles in server
+// config) grant permissions, and access to a folder is granted to its
+// owner and to users or roles listed in its ACL. Folders without owner
+// (eg. created while authentication was disabled) are shared by all users.
+// Everything is allowed when authentication is disabled.
+
+// Permissions granted by roles
+const (
+	PermAll           = "*"
+	PermFoldersAll    = "folders.all"    // owner access to all folders
+	PermFoldersCreate = "folders.create" // create folders (owned by creator)
+	PermExec          = "exec"           // execute commands in folders with exec access
+	PermExecPriority  = "exec.priority"  // queue commands with any priority (see exec.maxPriority)
+	PermSdksManage    = "sdks.manage"    // install or remove SDKs
+	PermConfigManage  = "config.manage"  // change server config
+	PermSessionsAdmin = "sessions.admin" // list and delete sessions of all clients
+)
+
+// Access levels to a folder
+const (
+	folderAccessNone  = iota
+	folderAccessRead  // browse folder
+	folderAccessExec  // synchronize folder and execute commands
+	folderAccessOwner // update or delete folder
+)
+
+// setRoles completes roles of an identity with roles granted by server config
+func (a *Auth) setRoles(id *AuthIdentity) {
+	cfg := a.Config.FileConf.AuthConf
+	roles := append([]string{}, id.Roles...)
+	roles = append(roles, cfg.UserRoles[id.User]...)
+	if len(roles) == 0 {
+		roles = append(roles, cfg.DefaultRoles...)
+	}
+	id.Roles = roles
+}
+
+// HasPerm returns true when an identity is granted a permission
+func (a *Auth) HasPerm(id *AuthIdentity, perm string) bool {
+	if !a.Enabled() {
+		return true
+	}
+	if id == nil {
+		return false
+	}
+	for _, r := range id.Roles {
+		for _, p := range a.Config.FileConf.AuthConf.Roles[r] {
+			if p == PermAll || p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FolderAllowed returns true when an identity has (at least) an access
+// level to a folder, executing commands also requires exec permission
+func (a *Auth) FolderAllowed(id *AuthIdentity, fld *xsapiv1.FolderConfig, access int) bool {
+	if a.folderAccess(id, fld) < access {
+		return false
+	}
+	return access != folderAccessExec || a.HasPerm(id, PermExec)
+}
+
+// folderAccess returns the access level of an identity to a folder
+func (a *Auth) folderAccess(id *AuthIdentity, fld *xsapiv1.FolderConfig) int {
+	if a.HasPerm(id, PermFoldersAll) {
+		return folderAccessOwner
+	}
+	if id == nil {
+		return folderAccessNone
+	}
+	if fld.Owner == "" {
+		return folderAccessExec
+	}
+	if fld.Owner == id.User {
+		return folderAccessOwner
+	}
+
+	level := folderAccessNone
+	for _, e := range fld.ACL {
+		if (e.User != "" && e.User == id.User) || (e.Role != "" && id.hasRole(e.Role)) {
+			l := folderAccessRead
+			if e.Access == xsapiv1.FolderAccessExec {
+				l = folderAccessExec
+			}
+			if l > level {
+				level = l
+			}
+		}
+	}
+	return level
+}
+
+// hasRole returns true when identity has a role
+func (id *AuthIdentity) hasRole(role string) bool {
+	for _, r := range id.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// reqIdentity returns the identity of the client of a request (nil when
+// authentication is disabled)
+func reqIdentity(c *gin.Context) *AuthIdentity {
+	if v, exist := c.Get(sessionIdentityKey); exist {
+		if id, ok := v.(*AuthIdentity); ok {
+			return id
+		}
+	}
+	return nil
+}
+
+// forbid replies that request is not allowed
+func (s *APIService) forbid(c *gin.Context, msg string) {
+	user := ""
+	if id := reqIdentity(c); id != nil {
+		user = id.User
+	}
+	s.Log.Infof("Access denied to user '%s': %s %s", user, c.Request.Method, c.Request.URL.Path)
+	apiErrorCode(c, http.StatusForbidden, msg)
+}
+
+// checkPerm returns true when client is granted a permission, otherwise a
+// 403 error is replied
+func (s *APIService) checkPerm(c *gin.Context, perm string) bool {
+	if s.auth.HasPerm(reqIdentity(c), perm) {
+		return true
+	}
+	s.forbid(c, "Permission denied")
+	return false
+}
+
+// checkFolder returns true when client has an access level to a folder,
+// otherwise a 403 error is replied
+func (s *APIService) checkFolder(c *gin.Context, fld IFOLDER, access int) bool {
+	cfg := fld.GetConfig()
+	if s.auth.FolderAllowed(reqIdentity(c), &cfg, access) {
+		return true
+	}
+	s.forbid(c, "Access to folder denied")
+	return false
+}
+
+// cmdAllowed returns true when client has an access level to the folder of
+// a command (commands of deleted folders are only visible by admins)
+func (s *APIService) cmdAllowed(c *gin.Context, info xsapiv1.ExecCommandInfo, access int) bool {
+	id := reqIdentity(c)
+	if f := s.mfolders.Get(info.FolderID); f != nil {
+		cfg := (*f).GetConfig()
+		return s.auth.FolderAllowed(id, &cfg, access)
+	}
+	if access == folderAccessExec && !s.auth.HasPerm(id, PermExec) {
+		return false
+	}
+	return s.auth.HasPerm(id, PermFoldersAll)
+}
+
+// checkCmd returns true when client has an access level to the folder of a
+// command, otherwise a 403 error is replied
+func (s *APIService) checkCmd(c *gin.Context, xcmd *ExecCommand, access int) bool {
+	if s.cmdAllowed(c, xcmd.GetInfo(), access) {
+		return true
+	}
+	s.forbid(c, "Access to command denied")
+	return false
+}
+
+// filterCmds returns commands which folder is accessible by client
+func (s *APIService) filterCmds(c *gin.Context, cmds []xsapiv1.ExecCommandInfo) []xsapiv1.ExecCommandInfo {
+	res := []xsapiv1.ExecCommandInfo{}
+	for _, info := range cmds {
+		if s.cmdAllowed(c, info, folderAccessRead) {
+			res = append(res, info)
+		}
+	}
+	return res
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// newTestAuth returns an API service with authentication enabled and
+// folders "owned" (by alice, shared by ACL) and "shared" (no owner)
+func newTestAuth(t *testing.T) (*APIService, func()) {
+	ctx, cleanup := newTestContext(t)
+	ctx.Config.FileConf.AuthConf.Roles = map[string][]string{
+		"admin": {PermAll},
+		"dev":   {PermExec},
+		"audit": {PermFoldersAll},
+		"guest": {},
+	}
+	ctx.auth = &Auth{Context: ctx, enable: true}
+	ctx.mfolders = &Folders{Context: ctx, folders: make(map[string]*IFOLDER)}
+	for _, cfg := range []xsapiv1.FolderConfig{
+		{ID: "owned", Owner: "alice", ACL: []xsapiv1.FolderACLEntry{
+			{User: "bob", Access: xsapiv1.FolderAccessRead},
+			{Role: "dev", Access: xsapiv1.FolderAccessExec},
+		}},
+		{ID: "shared"},
+	} {
+		f := NewFolderRsync(ctx)
+		f.fConfig = cfg
+		var fld IFOLDER = f
+		ctx.mfolders.folders[cfg.ID] = &fld
+	}
+	return &APIService{Context: ctx}, cleanup
+}
+
+func TestFolderAccess(t *testing.T) {
+	s, cleanup := newTestAuth(t)
+	defer cleanup()
+	owned := (*s.mfolders.Get("owned")).GetConfig()
+	shared := (*s.mfolders.Get("shared")).GetConfig()
+
+	tests := []struct {
+		name   string
+		id     *AuthIdentity
+		fld    *xsapiv1.FolderConfig
+		access int
+		exec   bool
+	}{
+		{"owner", &AuthIdentity{User: "alice", Roles: []string{"dev"}}, &owned, folderAccessOwner, true},
+		{"owner without exec permission", &AuthIdentity{User: "alice"}, &owned, folderAccessOwner, false},
+		{"ACL user read", &AuthIdentity{User: "bob", Roles: []string{"dev2"}}, &owned, folderAccessRead, false},
+		{"ACL role exec", &AuthIdentity{User: "carol", Roles: []string{"dev"}}, &owned, folderAccessExec, true},
+		{"ACL user and role", &AuthIdentity{User: "bob", Roles: []string{"dev"}}, &owned, folderAccessExec, true},
+		{"not in ACL", &AuthIdentity{User: "dave", Roles: []string{"guest"}}, &owned, folderAccessNone, false},
+		{"folders.all", &AuthIdentity{User: "eve", Roles: []string{"audit"}}, &owned, folderAccessOwner, false},
+		{"admin", &AuthIdentity{User: "root", Roles: []string{"admin"}}, &owned, folderAccessOwner, true},
+		{"ownerless folder", &AuthIdentity{User: "dave", Roles: []string{"dev"}}, &shared, folderAccessExec, true},
+		{"ownerless folder without exec permission", &AuthIdentity{User: "dave"}, &shared, folderAccessExec, false},
+		{"no identity", nil, &shared, folderAccessNone, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if l := s.auth.folderAccess(tt.id, tt.fld); l != tt.access {
+				t.Errorf("folderAccess() = %d, want %d", l, tt.access)
+			}
+			if ok := s.auth.FolderAllowed(tt.id, tt.fld, folderAccessRead); ok != (tt.access >= folderAccessRead) {
+				t.Errorf("FolderAllowed(read) = %v", ok)
+			}
+			if ok := s.auth.FolderAllowed(tt.id, tt.fld, folderAccessExec); ok != tt.exec {
+				t.Errorf("FolderAllowed(exec) = %v, want %v", ok, tt.exec)
+			}
+			if ok := s.auth.FolderAllowed(tt.id, tt.fld, folderAccessOwner); ok != (tt.access == folderAccessOwner) {
+				t.Errorf("FolderAllowed(owner) = %v", ok)
+			}
+		})
+	}
+
+	// Everything is allowed when authentication is disabled
+	s.auth.enable = false
+	if !s.auth.FolderAllowed(nil, &owned, folderAccessOwner) || !s.auth.FolderAllowed(nil, &owned, folderAccessExec) {
+		t.Errorf("access must be granted when authentication is disabled")
+	}
+}
+
+func TestCheckCmd(t *testing.T) {
+	s, cleanup := newTestAuth(t)
+	defer cleanup()
+
+	newReq := func(id *AuthIdentity) (*gin.Context, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/api/v1/exec", nil)
+		c.Set(sessionIdentityKey, id)
+		return c, w
+	}
+	cmds := []xsapiv1.ExecCommandInfo{
+		{CmdID: "c1", FolderID: "owned"},
+		{CmdID: "c2", FolderID: "shared"},
+		{CmdID: "c3", FolderID: "deleted"},
+	}
+	cmdIDs := func(infos []xsapiv1.ExecCommandInfo) string {
+		ids := ""
+		for _, info := range infos {
+			ids += info.CmdID
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name string
+		id   *AuthIdentity
+		read string // commands listed
+		exec string // commands that can be signaled
+	}{
+		{"owner", &AuthIdentity{User: "alice", Roles: []string{"dev"}}, "c1c2", "c1c2"},
+		{"ACL user read", &AuthIdentity{User: "bob"}, "c1c2", ""},
+		{"ACL role", &AuthIdentity{User: "dave", Roles: []string{"dev"}}, "c1c2", "c1c2"},
+		{"guest", &AuthIdentity{User: "dave", Roles: []string{"guest"}}, "c2", ""},
+		{"folders.all", &AuthIdentity{User: "eve", Roles: []string{"audit"}}, "c1c2c3", ""},
+		{"admin", &AuthIdentity{User: "root", Roles: []string{"admin"}}, "c1c2c3", "c1c2c3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newReq(tt.id)
+			if ids := cmdIDs(s.filterCmds(c, cmds)); ids != tt.read {
+				t.Errorf("filterCmds() = %s, want %s", ids, tt.read)
+			}
+
+			exec := ""
+			for _, info := range cmds {
+				c, w := newReq(tt.id)
+				xcmd := &ExecCommand{info: info}
+				if s.checkCmd(c, xcmd, folderAccessExec) {
+					exec += info.CmdID
+				} else if w.Code != http.StatusForbidden || !c.IsAborted() {
+					t.Errorf("checkCmd(%s) denied with status %d", info.CmdID, w.Code)
+				}
+			}
+			if exec != tt.exec {
+				t.Errorf("checkCmd() allowed %s, want %s", exec, tt.exec)
+			}
+		})
+	}
+}
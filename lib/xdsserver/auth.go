@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// Clients are authenticated (when enabled in server config) by one of the
+// following methods: static API tokens, users file (htpasswd) or JWT
+// bearer tokens. Identity is then kept in client session, so that next
+// requests (and websocket) of this session are authenticated.
+
+// AuthIdentity Identity of an authenticated client
+type AuthIdentity struct {
+	User   string
+	Roles  []string
+	Method string
+}
+
+// Authenticator Interface of an authentication method
+type Authenticator interface {
+	// Name returns the name of authentication method
+	Name() string
+
+	// Authenticate returns the identity of client when request holds
+	// credentials handled by this method (nil otherwise), an error is
+	// returned when credentials are invalid
+	Authenticate(c *gin.Context) (*AuthIdentity, error)
+}
+
+// Auth Hold authentication methods
+type Auth struct {
+	*Context
+	enable  bool
+	methods []Authenticator
+}
+
+// NewAuth creates authentication methods defined in server config
+func NewAuth(ctx *Context) (*Auth, error) {
+	cfg := ctx.Config.FileConf.AuthConf
+	a := &Auth{
+		Context: ctx,
+		enable:  cfg.Enable,
+		methods: []Authenticator{},
+	}
+	if !cfg.Enable {
+		ctx.Log.Warningf("Authentication disabled: anyone can access REST API")
+		return a, nil
+	}
+
+	if len(cfg.Tokens) > 0 {
+		a.methods = append(a.methods, newAuthTokens(cfg.Tokens))
+	}
+	if cfg.HtpasswdFile != "" {
+		m, err := newAuthHtpasswd(ctx, cfg.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		a.methods = append(a.methods, m)
+	}
+	if cfg.JWT != nil {
+		m, err := newAuthJWT(ctx, *cfg.JWT)
+		if err != nil {
+			return nil, err
+		}
+		a.methods = append(a.methods, m)
+	}
+	if len(a.methods) == 0 {
+		return nil, fmt.Errorf("Authentication enabled but no method defined")
+	}
+
+	names := []string{}
+	for _, m := range a.methods {
+		names = append(names, m.Name())
+	}
+	ctx.Log.Infof("Authentication methods: %s", strings.Join(names, ", "))
+	return a, nil
+}
+
+// Enabled returns true when clients must be authenticated
+func (a *Auth) Enabled() bool {
+	return a != nil && a.enable
+}
+
+// Authenticate returns the identity of client when request holds valid
+// credentials, nil when request holds no credentials
+func (a *Auth) Authenticate(c *gin.Context) (*AuthIdentity, error) {
+	for _, m := range a.methods {
+		id, err := m.Authenticate(c)
+		if err != nil {
+			return nil, err
+		}
+		if id != nil {
+			id.Method = m.Name()
+			a.setRoles(id)
+			return id, nil
+		}
+	}
+	if c.Request.Header.Get("Authorization") != "" || bearerToken(c) != "" {
+		return nil, fmt.Errorf("Invalid credentials")
+	}
+	return nil, nil
+}
+
+// Challenge sets header indicating how to authenticate
+func (a *Auth) Challenge(c *gin.Context) {
+	for _, m := range a.methods {
+		if _, ok := m.(*authHtpasswd); ok {
+			c.Header("WWW-Authenticate", `Basic realm="XDS server"`)
+			return
+		}
+	}
+	c.Header("WWW-Authenticate", `Bearer realm="XDS server"`)
+}
+
+// reject replies that request is not authenticated
+func (a *Auth) reject(c *gin.Context, msg string) {
+	a.Challenge(c)
+	apiErrorCode(c, http.StatusUnauthorized, msg)
+}
+
+// authRequired returns true when a request must be authenticated: REST
+// API and websockets (web application files are public)
+func authRequired(c *gin.Context) bool {
+	if c.Request.Method == "OPTIONS" {
+		return false
+	}
+	p := c.Request.URL.Path
+	return strings.HasPrefix(p, "/api/") || strings.HasPrefix(p, "/socket.io/") ||
+		p == xsapiv1.WSRoute
+}
+
+// bearerToken returns the bearer token of a request, also accepted as
+// access_token query parameter for websockets (no header can be set by
+// browsers)
+func bearerToken(c *gin.Context) string {
+	h := c.Request.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	if !strings.HasPrefix(c.Request.URL.Path, "/api/") {
+		return c.Query("access_token")
+	}
+	return ""
+}
+
+// apiErrorCode replies an error using a specific HTTP status code and
+// aborts request
+func apiErrorCode(c *gin.Context, code int, msg string) {
+	c.JSON(code, gin.H{"status": "error", "error": msg})
+	c.Abort()
+}
+
+// authTokens Authentication using static API tokens
+type authTokens struct {
+	tokens []xdsconfig.AuthTokenConfig
+}
+
+func newAuthTokens(tokens []xdsconfig.AuthTokenConfig) *authTokens {
+	return &authTokens{tokens: tokens}
+}
+
+// Name returns the name of authentication method
+func (a *authTokens) Name() string {
+	return "token"
+}
+
+// Authenticate checks static API tokens
+func (a *authTokens) Authenticate(c *gin.Context) (*AuthIdentity, error) {
+	tok := bearerToken(c)
+	if tok == "" {
+		return nil, nil
+	}
+	for _, t := range a.tokens {
+		if t.Token != "" && subtle.ConstantTimeCompare([]byte(t.Token), []byte(tok)) == 1 {
+			return &AuthIdentity{User: t.User, Roles: t.Roles}, nil
+		}
+	}
+	// Token may be handled by another method (JWT)
+	return nil, nil
+}
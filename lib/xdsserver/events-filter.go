@@ -0,0 +1,324 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Filters of events are expressions over fields of event data (JSON names,
+// nested fields separated by dots), for example:
+//   id=1234
+//   status!=Syncing
+//   type in (PathMap, CloudSync) and not (label = "my project")
+// Supported operators: = (or ==), !=, in, not in, and (&&), or (||),
+// not (!) and parenthesis. Values are compared as strings, a missing field
+// is equal to an empty string.
+
+// EventFilter A parsed filter expression
+type EventFilter struct {
+	expr string
+	root filterNode
+}
+
+type filterNode interface {
+	match(fields map[string]interface{}) bool
+}
+
+type filterAnd struct{ left, right filterNode }
+type filterOr struct{ left, right filterNode }
+type filterNot struct{ node filterNode }
+
+type filterCond struct {
+	field  string
+	negate bool
+	values []string
+}
+
+func (n *filterAnd) match(f map[string]interface{}) bool { return n.left.match(f) && n.right.match(f) }
+func (n *filterOr) match(f map[string]interface{}) bool  { return n.left.match(f) || n.right.match(f) }
+func (n *filterNot) match(f map[string]interface{}) bool { return !n.node.match(f) }
+
+func (n *filterCond) match(f map[string]interface{}) bool {
+	val := filterFieldValue(f, n.field)
+	for _, v := range n.values {
+		if v == val {
+			return !n.negate
+		}
+	}
+	return n.negate
+}
+
+// NewEventFilter parses a filter expression
+func NewEventFilter(expr string) (*EventFilter, error) {
+	var root filterNode
+	toks, err := filterTokenize(expr)
+	if err == nil {
+		p := filterParser{toks: toks}
+		root, err = p.parseOr()
+		if err == nil && p.pos < len(p.toks) {
+			err = fmt.Errorf("unexpected '%s'", p.toks[p.pos].val)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter: %v", err)
+	}
+	return &EventFilter{expr: expr, root: root}, nil
+}
+
+// String returns the filter expression
+func (ef *EventFilter) String() string {
+	return ef.expr
+}
+
+// Match returns true when fields of event data match filter
+func (ef *EventFilter) Match(fields map[string]interface{}) bool {
+	return ef.root.match(fields)
+}
+
+// eventFields returns fields of event data, IOW data decoded as a JSON object
+func eventFields(data interface{}) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if b, err := json.Marshal(data); err == nil {
+		json.Unmarshal(b, &fields)
+	}
+	return fields
+}
+
+// filterFieldValue returns the value of a field as a string
+func filterFieldValue(fields map[string]interface{}, name string) string {
+	var val interface{} = fields
+	for _, n := range strings.Split(name, ".") {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		val = m[n]
+	}
+
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	b, _ := json.Marshal(val)
+	return string(b)
+}
+
+// Filter tokens
+const (
+	tokWord = iota
+	tokString
+	tokOp
+)
+
+type filterToken struct {
+	kind int
+	val  string
+}
+
+// filterTokenize splits a filter expression in tokens
+func filterTokenize(expr string) ([]filterToken, error) {
+	toks := []filterToken{}
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '"' || c == '\'':
+			// quoted string (backslash escapes next character)
+			val := []byte{}
+			j := i + 1
+			for ; j < len(expr) && expr[j] != c; j++ {
+				if expr[j] == '\\' && j+1 < len(expr) {
+					j++
+				}
+				val = append(val, expr[j])
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			toks = append(toks, filterToken{tokString, string(val)})
+			i = j + 1
+
+		case strings.HasPrefix(expr[i:], "==") || strings.HasPrefix(expr[i:], "!=") ||
+			strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			op := expr[i : i+2]
+			if op == "==" {
+				op = "="
+			}
+			toks = append(toks, filterToken{tokOp, op})
+			i += 2
+
+		case strings.IndexByte("=!(),", c) >= 0:
+			toks = append(toks, filterToken{tokOp, string(c)})
+			i++
+
+		default:
+			j := i
+			for j < len(expr) && strings.IndexByte(" \t\n\r\"'=!(),&|", expr[j]) < 0 {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected '%c'", c)
+			}
+			toks = append(toks, filterToken{tokWord, expr[i:j]})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// filterParser recursive descent parser of filter expressions
+type filterParser struct {
+	toks []filterToken
+	pos  int
+}
+
+// peek returns true when next token is the given operator or keyword
+func (p *filterParser) peek(val string) bool {
+	if p.pos >= len(p.toks) {
+		return false
+	}
+	t := p.toks[p.pos]
+	return (t.kind == tokOp && t.val == val) || (t.kind == tokWord && strings.EqualFold(t.val, val))
+}
+
+// accept consumes next token when it is one of the given operators or keywords
+func (p *filterParser) accept(vals ...string) bool {
+	for _, v := range vals {
+		if p.peek(v) {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||", "or") {
+		var right filterNode
+		if right, err = p.parseAnd(); err == nil {
+			left = &filterOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.accept("&&", "and") {
+		var right filterNode
+		if right, err = p.parseUnary(); err == nil {
+			left = &filterAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.accept("!", "not") {
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{n}, nil
+	}
+	if p.accept("(") {
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		return n, nil
+	}
+	return p.parseCond()
+}
+
+// parseCond parses: field (=|!=) value or field [not] in (value, ...)
+func (p *filterParser) parseCond() (filterNode, error) {
+	if p.pos >= len(p.toks) || p.toks[p.pos].kind != tokWord {
+		return nil, fmt.Errorf("field name expected")
+	}
+	cond := &filterCond{field: p.toks[p.pos].val}
+	p.pos++
+
+	switch {
+	case p.accept("="):
+	case p.accept("!="):
+		cond.negate = true
+	case p.accept("not"):
+		if !p.accept("in") {
+			return nil, fmt.Errorf("'in' expected after 'not'")
+		}
+		cond.negate = true
+		return p.parseList(cond)
+	case p.accept("in"):
+		return p.parseList(cond)
+	default:
+		return nil, fmt.Errorf("operator expected after '%s'", cond.field)
+	}
+
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	cond.values = []string{v}
+	return cond, nil
+}
+
+// parseList parses the list of values of a in condition
+func (p *filterParser) parseList(cond *filterCond) (filterNode, error) {
+	if !p.accept("(") {
+		return nil, fmt.Errorf("'(' expected after 'in'")
+	}
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		cond.values = append(cond.values, v)
+		if p.accept(")") {
+			return cond, nil
+		}
+		if !p.accept(",") {
+			return nil, fmt.Errorf("',' or ')' expected")
+		}
+	}
+}
+
+func (p *filterParser) parseValue() (string, error) {
+	if p.pos >= len(p.toks) || p.toks[p.pos].kind == tokOp {
+		return "", fmt.Errorf("value expected")
+	}
+	v := p.toks[p.pos].val
+	p.pos++
+	return v, nil
+}
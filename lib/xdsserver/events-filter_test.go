@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"testing"
+)
+
+func TestEventFilterMatch(t *testing.T) {
+	fields := eventFields(map[string]interface{}{
+		"id":       "1234",
+		"label":    "my project",
+		"type":     "PathMap",
+		"status":   "Enable",
+		"isInSync": true,
+		"code":     0,
+		"dataGit":  map[string]interface{}{"ref": "master"},
+	})
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"id=1234", true},
+		{"id==1234", true},
+		{"id=\"1234\"", true},
+		{"id=4321", false},
+		{"id!=4321", true},
+		{"status != Enable", false},
+		{"type in (PathMap, CloudSync)", true},
+		{"type not in (PathMap, CloudSync)", false},
+		{"TYPE IN ('CloudSync')", false},
+		{"label = 'my project'", true},
+		{`label = "my \"project\""`, false},
+		{"not (label = \"my project\")", false},
+		{"!(id=1)", true},
+		{"id=1234 and status=Enable", true},
+		{"id=1234 && status=Error", false},
+		{"id=1 or status=Enable", true},
+		{"id=1 || status=Error", false},
+		{"id=1 or id=1234 and status=Error", false},
+		{"(id=1 or id=1234) and status=Enable", true},
+		{"isInSync=true", true},
+		{"code=0", true},
+		{"dataGit.ref=master", true},
+		{"dataGit.url=''", true},
+		{"missing=''", true},
+		{"id.sub=''", true},
+	}
+	for _, tt := range tests {
+		ef, err := NewEventFilter(tt.expr)
+		if err != nil {
+			t.Errorf("NewEventFilter(%q) error = %v", tt.expr, err)
+			continue
+		}
+		if got := ef.Match(fields); got != tt.want {
+			t.Errorf("%q: Match() = %v, want %v", tt.expr, got, tt.want)
+		}
+		if ef.String() != tt.expr {
+			t.Errorf("String() = %q, want %q", ef.String(), tt.expr)
+		}
+	}
+}
+
+func TestEventFilterInvalid(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"", "field name expected"},
+		{"id", "operator expected after 'id'"},
+		{"id=", "value expected"},
+		{"id='1234", "unterminated string"},
+		{"id=1 &", "unexpected '&'"},
+		{"id=1 id=2", "unexpected 'id'"},
+		{"(id=1", "missing ')'"},
+		{"id not (1)", "'in' expected after 'not'"},
+		{"id in 1", "'(' expected after 'in'"},
+		{"id in (1 2)", "',' or ')' expected"},
+		{"=1", "field name expected"},
+	}
+	for _, tt := range tests {
+		_, err := NewEventFilter(tt.expr)
+		if err == nil {
+			t.Errorf("NewEventFilter(%q) succeeded", tt.expr)
+			continue
+		}
+		if want := "Invalid filter: " + tt.err; err.Error() != want {
+			t.Errorf("NewEventFilter(%q) error = %q, want %q", tt.expr, err, want)
+		}
+	}
+}
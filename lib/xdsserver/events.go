@@ -18,21 +18,53 @@
 package xdsserver
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
 )
 
 // EventDef Definition on one event
 type EventDef struct {
-	sids map[string]int
+	subs map[int]*eventSub // subscriptions to this event
+}
+
+// eventSub A subscription of a session to one or several events
+type eventSub struct {
+	id        int
+	sessionID string
+	filter    *EventFilter // nil when all events are sent
+}
+
+// eventSubSaved A subscription as saved with client sessions (one entry per
+// event name, entries of a subscription share the same ID)
+type eventSubSaved struct {
+	ID     int    `xml:"id,attr"`
+	Event  string `xml:"event,attr"`
+	Filter string `xml:"filter,omitempty"`
+}
+
+// eventJournalEntry An emitted event kept to be replayed
+type eventJournalEntry struct {
+	msg    xsapiv1.EventMsg
+	fields map[string]interface{} // decoded data (used by filters)
+	folder *xsapiv1.FolderConfig  // data of folder events (used to check access)
 }
 
 // Events Hold registered events per context
 type Events struct {
 	*Context
 	eventsMap map[string]*EventDef
+	lastSubID int
+	epoch     string              // changed on each start (seq restarts from 1)
+	seq       uint64              // sequence number of last event
+	journal   []eventJournalEntry // ring buffer of last events
+	jStart    int                 // index of oldest event in journal
+	jCount    int                 // number of events in journal
+	mutex     sync.Mutex          // also held while emitting to keep events order
 }
 
 // NewEvents creates an instance of Events
@@ -40,12 +72,19 @@ func NewEvents(ctx *Context) *Events {
 	evMap := make(map[string]*EventDef)
 	for _, ev := range xsapiv1.EVTAllList {
 		evMap[ev] = &EventDef{
-			sids: make(map[string]int),
+			subs: make(map[int]*eventSub),
 		}
 	}
+	jSize := ctx.Config.FileConf.EventsConf.JournalSize
+	if jSize < 0 {
+		jSize = 0
+	}
 	return &Events{
 		Context:   ctx,
 		eventsMap: evMap,
+		epoch:     strconv.FormatInt(time.Now().UnixNano(), 36),
+		journal:   make([]eventJournalEntry, jSize),
+		mutex:     sync.NewMutex(),
 	}
 }
 
@@ -55,38 +94,128 @@ func (e *Events) GetList() []string {
 }
 
 // Register Used by a client/session to register to a specific (or all) event(s)
-func (e *Events) Register(evName, sessionID string) error {
-	evs := xsapiv1.EVTAllList
-	if evName != xsapiv1.EVTAll {
-		if _, ok := e.eventsMap[evName]; !ok {
-			return fmt.Errorf("Unsupported event type name")
+// (only events which data match filter are sent, see events-filter.go), a
+// session can register several times, each subscription has its own ID.
+// When since is set, events of journal emitted after this sequence number
+// are sent again (epoch is the one of since, all events of journal are sent
+// when it does not match current one).
+func (e *Events) Register(evName, filter, sessionID string, since uint64, epoch string) (*xsapiv1.EventRegisterReply, error) {
+	evs, err := e.eventNames(evName)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &eventSub{sessionID: sessionID}
+	if filter != "" {
+		if sub.filter, err = NewEventFilter(filter); err != nil {
+			return nil, err
 		}
-		evs = []string{evName}
 	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.lastSubID++
+	sub.id = e.lastSubID
+	for _, ev := range evs {
+		e.eventsMap[ev].subs[sub.id] = sub
+	}
+	e.sessions.changed()
+
+	reply := xsapiv1.EventRegisterReply{Status: "OK", ID: sub.id, Seq: e.seq, Epoch: e.epoch, SessionID: sessionPublicID(sessionID)}
+	if since > 0 {
+		reply.Truncated = e.replay(sub, evs, since, epoch)
+	}
+	return &reply, nil
+}
+
+// UnRegister Used by a client/session to un-register event(s) of one
+// subscription (or of all subscriptions of session when id is 0)
+func (e *Events) UnRegister(evName string, id int, sessionID string) error {
+	evs, err := e.eventNames(evName)
+	if err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	found := false
 	for _, ev := range evs {
-		e.eventsMap[ev].sids[sessionID]++
+		for subID, sub := range e.eventsMap[ev].subs {
+			if sub.sessionID == sessionID && (id == 0 || id == subID) {
+				delete(e.eventsMap[ev].subs, subID)
+				found = true
+			}
+		}
+	}
+	if id != 0 && !found {
+		return fmt.Errorf("Unknown subscription id")
+	}
+	if found {
+		e.sessions.changed()
 	}
 	return nil
 }
 
-// UnRegister Used by a client/session to un-register event(s)
-func (e *Events) UnRegister(evName, sessionID string) error {
-	evs := xsapiv1.EVTAllList
-	if evName != xsapiv1.EVTAll {
-		if _, ok := e.eventsMap[evName]; !ok {
-			return fmt.Errorf("Unsupported event type name")
+// getSubs returns subscriptions of a session (used to save sessions)
+func (e *Events) getSubs(sessionID string) []eventSubSaved {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	subs := []eventSubSaved{}
+	for _, ev := range xsapiv1.EVTAllList {
+		for _, sub := range e.eventsMap[ev].subs {
+			if sub.sessionID != sessionID {
+				continue
+			}
+			saved := eventSubSaved{ID: sub.id, Event: ev}
+			if sub.filter != nil {
+				saved.Filter = sub.filter.String()
+			}
+			subs = append(subs, saved)
 		}
-		evs = []string{evName}
 	}
-	for _, ev := range evs {
-		if _, exist := e.eventsMap[ev].sids[sessionID]; exist {
-			delete(e.eventsMap[ev].sids, sessionID)
-			break
+	return subs
+}
+
+// restoreSubs restores subscriptions of a session saved on disk
+func (e *Events) restoreSubs(sessionID string, saved []eventSubSaved) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	subs := make(map[int]*eventSub)
+	for _, ss := range saved {
+		evDef, ok := e.eventsMap[ss.Event]
+		if !ok {
+			return fmt.Errorf("Unsupported event type name %s", ss.Event)
+		}
+		sub, exist := subs[ss.ID]
+		if !exist {
+			sub = &eventSub{id: ss.ID, sessionID: sessionID}
+			if ss.Filter != "" {
+				var err error
+				if sub.filter, err = NewEventFilter(ss.Filter); err != nil {
+					return err
+				}
+			}
+			subs[ss.ID] = sub
+		}
+		evDef.subs[sub.id] = sub
+		if sub.id > e.lastSubID {
+			e.lastSubID = sub.id
 		}
 	}
 	return nil
 }
 
+// eventNames returns names of events referenced by evName (that may be all)
+func (e *Events) eventNames(evName string) ([]string, error) {
+	if evName == xsapiv1.EVTAll {
+		return xsapiv1.EVTAllList, nil
+	}
+	if _, ok := e.eventsMap[evName]; !ok {
+		return nil, fmt.Errorf("Unsupported event type name")
+	}
+	return []string{evName}, nil
+}
+
 // Emit Used to manually emit an event
 func (e *Events) Emit(evName string, data interface{}, fromSid string) error {
 	var firstErr error
@@ -95,31 +224,139 @@ func (e *Events) Emit(evName string, data interface{}, fromSid string) error {
 		return fmt.Errorf("Unsupported event type")
 	}
 
-	firstErr = nil
-	evm := e.eventsMap[evName]
-	e.LogSillyf("Emit Event %s: len(sids)=%d, data=%v", evName, len(evm.sids), data)
-	for sid := range evm.sids {
-		so := e.sessions.IOSocketGet(sid)
-		if so == nil {
-			if firstErr == nil {
-				firstErr = fmt.Errorf("IOSocketGet return nil (SID=%v)", sid)
-			}
-			continue
-		}
-		msg := xsapiv1.EventMsg{
+	// Data is encoded now, so that journal keeps its current value
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	entry := eventJournalEntry{
+		msg: xsapiv1.EventMsg{
 			Time:          time.Now().String(),
-			FromSessionID: fromSid,
+			FromSessionID: sessionPublicID(fromSid),
 			Type:          evName,
-			Data:          data,
+			Data:          json.RawMessage(raw),
+		},
+		fields: make(map[string]interface{}),
+	}
+	json.Unmarshal(raw, &entry.fields)
+	if evName == xsapiv1.EVTFolderChange || evName == xsapiv1.EVTFolderStateChange {
+		entry.folder = &xsapiv1.FolderConfig{}
+		json.Unmarshal(raw, entry.folder)
+	}
+
+	e.mutex.Lock()
+	e.seq++
+	entry.msg.Seq = e.seq
+	if len(e.journal) > 0 {
+		if e.jCount < len(e.journal) {
+			e.journal[(e.jStart+e.jCount)%len(e.journal)] = entry
+			e.jCount++
+		} else {
+			e.journal[e.jStart] = entry
+			e.jStart = (e.jStart + 1) % len(e.journal)
 		}
-		e.Log.Debugf("Emit Event %s: %v", evName, sid)
-		if err := (*so).Emit(evName, msg); err != nil {
-			e.Log.Errorf("WS Emit %v error : %v", evName, err)
-			if firstErr == nil {
-				firstErr = err
-			}
+	}
+
+	// Get sessions to notify, a session with several matching subscriptions
+	// is notified once
+	sids := []string{}
+	sidsSet := make(map[string]bool)
+	for _, sub := range e.eventsMap[evName].subs {
+		if sidsSet[sub.sessionID] {
+			continue
 		}
+		if sub.filter != nil && !sub.filter.Match(entry.fields) {
+			continue
+		}
+		if !e.allowed(sub.sessionID, &entry) {
+			continue
+		}
+		sidsSet[sub.sessionID] = true
+		sids = append(sids, sub.sessionID)
 	}
 
+	firstErr = nil
+	e.LogSillyf("Emit Event %s: len(sids)=%d, seq=%d, data=%v", evName, len(sids), e.seq, data)
+	for _, sid := range sids {
+		if err := e.emitTo(sid, entry.msg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	e.mutex.Unlock()
+
+	// Webhooks may write dead letters, so they are not called locked
+	e.webhooks.Send(entry.msg)
+
 	return firstErr
 }
+
+// replay sends events of journal emitted after since to a subscription,
+// returns true when some events are not available anymore (must be called
+// with mutex locked)
+func (e *Events) replay(sub *eventSub, evs []string, since uint64, epoch string) bool {
+	// Sequence numbers restart from 1 when server restarts, so events emitted
+	// before are lost (epoch may be unknown with old clients)
+	if (epoch != "" && epoch != e.epoch) || since > e.seq {
+		e.replayFrom(sub, evs, 0)
+		return true
+	}
+
+	truncated := since < e.seq
+	if e.jCount > 0 {
+		truncated = since+1 < e.journal[e.jStart].msg.Seq
+	}
+	e.replayFrom(sub, evs, since)
+	return truncated
+}
+
+// replayFrom sends events of journal emitted after since to a subscription
+// (must be called with mutex locked)
+func (e *Events) replayFrom(sub *eventSub, evs []string, since uint64) {
+
+	names := make(map[string]bool)
+	for _, ev := range evs {
+		names[ev] = true
+	}
+	nb := 0
+	for i := 0; i < e.jCount; i++ {
+		entry := e.journal[(e.jStart+i)%len(e.journal)]
+		if entry.msg.Seq <= since || !names[entry.msg.Type] {
+			continue
+		}
+		if sub.filter != nil && !sub.filter.Match(entry.fields) {
+			continue
+		}
+		if !e.allowed(sub.sessionID, &entry) {
+			continue
+		}
+		if err := e.emitTo(sub.sessionID, entry.msg); err != nil {
+			e.Log.Warningf("Cannot replay events: %v", err)
+			break
+		}
+		nb++
+	}
+	e.Log.Debugf("Replay %d events since %d to %s", nb, since, sub.sessionID)
+}
+
+// allowed returns true when the client of a session can receive an event
+// (folder events are only sent to clients having access to the folder)
+func (e *Events) allowed(sid string, entry *eventJournalEntry) bool {
+	if entry.folder == nil || !e.auth.Enabled() {
+		return true
+	}
+	return e.auth.FolderAllowed(e.sessions.getIdentity(sid), entry.folder, folderAccessRead)
+}
+
+// emitTo emits an event message on the socket of a session
+func (e *Events) emitTo(sid string, msg xsapiv1.EventMsg) error {
+	so := e.sessions.IOSocketGet(sid)
+	if so == nil {
+		return fmt.Errorf("IOSocketGet return nil (SID=%v)", sid)
+	}
+	e.Log.Debugf("Emit Event %s: %v", msg.Type, sid)
+	if err := (*so).Emit(msg.Type, msg); err != nil {
+		e.Log.Errorf("WS Emit %v error : %v", msg.Type, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,836 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/googollee/go-socket.io"
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-common/golib/eows"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// Files saved in history directory of each command
+const (
+	execInfoFilename   = "command.json"
+	execOutputFilename = "output.log"
+	execStdinFilename  = "stdin"
+	execPidFilename    = "pid"
+)
+
+// Default time (in seconds) given to a command to terminate before being killed
+const execKillGracePeriod = 10
+
+// Maximum size of output buffered while no client is attached to a command
+// (full output is anyway available in history)
+const execPendingMaxSize = 4 * 1024 * 1024
+
+// ExecCommand Hold a command executed by /exec and its history on disk
+type ExecCommand struct {
+	info    xsapiv1.ExecCommandInfo
+	sid     string // session of client attached (info only holds its public ID)
+	dir     string
+	outFd   *os.File
+	stdinFd *os.File
+	done    chan struct{} // closed when command exited
+	mutex   sync.Mutex
+
+	// InputCB handles input events (stdin) sent by attached client
+	InputCB func(stdin string)
+
+	// Sockets on which an input handler was registered (handlers cannot be
+	// removed, so only the one of the attached socket forwards input)
+	inputSocks map[string]bool
+	inputSoID  string
+
+	// Resource limits (see exec-limits.go)
+	cgroup     string
+	limitSetup []string
+	outSize    int64
+
+	// Output and exit messages not emitted while no client is attached
+	pendingOut  []xsapiv1.ExecOutMsg
+	pendingSize int
+	pendingExit *xsapiv1.ExecExitMsg
+
+	// Listeners of output and exit messages (used by stream mode)
+	listeners []*ExecListener
+}
+
+// ExecListener receives output and exit messages of a command
+type ExecListener struct {
+	C    chan xsapiv1.ExecStreamMsg
+	quit chan struct{}
+}
+
+// ExecCommands Hold running and past commands
+type ExecCommands struct {
+	*Context
+	historyDir string
+	historyMax int
+	cmds       map[string]*ExecCommand
+	sched      *ExecScheduler
+	mutex      sync.Mutex
+
+	cgroupDir   string          // empty when cgroup v2 cannot be used
+	cgroupCtrls map[string]bool // cgroup controllers available
+	bwrapPath   string          // empty when sandbox is disabled
+}
+
+// NewExecCommands creates a new instance of ExecCommands
+func NewExecCommands(ctx *Context) (*ExecCommands, error) {
+	ec := ExecCommands{
+		Context:    ctx,
+		historyDir: ctx.Config.FileConf.ExecConf.HistoryDir,
+		historyMax: ctx.Config.FileConf.ExecConf.HistoryMax,
+		cmds:       make(map[string]*ExecCommand),
+	}
+
+	if !common.Exists(ec.historyDir) {
+		if err := os.MkdirAll(ec.historyDir, 0755); err != nil {
+			return &ec, fmt.Errorf("Cannot create exec history directory: %s", ec.historyDir)
+		}
+	}
+	ec.Log.Infof("Exec history dir: %s", ec.historyDir)
+
+	if err := ec.loadHistory(); err != nil {
+		return &ec, err
+	}
+
+	ec.initCgroup()
+
+	if err := ec.initSandbox(); err != nil {
+		return &ec, err
+	}
+
+	var err error
+	if ec.sched, err = NewExecScheduler(ctx, &ec); err != nil {
+		return &ec, err
+	}
+
+	return &ec, nil
+}
+
+// Add registers a new command (executed by session sid) and creates its
+// history on disk
+func (ec *ExecCommands) Add(info xsapiv1.ExecCommandInfo, sid string) (*ExecCommand, error) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	// Command ID may be set by client: a command not exited yet must not be
+	// overwritten, history of an exited one is replaced
+	if prev, exist := ec.cmds[info.CmdID]; exist {
+		if prev.GetInfo().State != xsapiv1.ExecStateExited {
+			return nil, fmt.Errorf("Command ID %s already used", info.CmdID)
+		}
+		ec.LogSillyf("Replace history of command %s", info.CmdID)
+		delete(ec.cmds, info.CmdID)
+		if err := os.RemoveAll(prev.dir); err != nil {
+			return nil, fmt.Errorf("Cannot remove command history: %v", err)
+		}
+	}
+
+	cmd := &ExecCommand{
+		info: info,
+		sid:  sid,
+		dir:  filepath.Join(ec.historyDir, cmdIDToDirname(info.CmdID)),
+		done: make(chan struct{}),
+	}
+	cmd.info.SessionID = sessionPublicID(sid)
+	cmd.info.State = xsapiv1.ExecStateRunning
+	cmd.info.StartTime = time.Now()
+
+	os.RemoveAll(cmd.dir)
+	if err := os.MkdirAll(cmd.dir, 0755); err != nil {
+		return nil, fmt.Errorf("Cannot create command history directory: %v", err)
+	}
+
+	fd, err := os.OpenFile(filepath.Join(cmd.dir, execOutputFilename), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	cmd.outFd = fd
+
+	// Command stdin is redirected from a fifo, so that input can be forwarded
+	// by any client (re)attached to this command
+	stdinFile := filepath.Join(cmd.dir, execStdinFilename)
+	if err := syscall.Mkfifo(stdinFile, 0600); err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("Cannot create stdin fifo: %v", err)
+	}
+	// open read-write to not block until command opens it
+	if cmd.stdinFd, err = os.OpenFile(stdinFile, os.O_RDWR, 0600); err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("Cannot open stdin fifo: %v", err)
+	}
+
+	if cmd.limitSetup, err = ec.setupLimits(cmd); err != nil {
+		fd.Close()
+		cmd.stdinFd.Close()
+		return nil, err
+	}
+
+	if err := cmd.saveInfo(); err != nil {
+		fd.Close()
+		cmd.stdinFd.Close()
+		cmd.releaseCgroup()
+		return nil, err
+	}
+
+	ec.cmds[info.CmdID] = cmd
+
+	ec.pruneHistory()
+
+	return cmd, nil
+}
+
+// Get returns a command from its ID or nil if not existing
+func (ec *ExecCommands) Get(cmdID string) *ExecCommand {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	cmd, exist := ec.cmds[cmdID]
+	if !exist {
+		return nil
+	}
+	return cmd
+}
+
+// GetInfoArr returns the info of all commands (most recent first)
+func (ec *ExecCommands) GetInfoArr() []xsapiv1.ExecCommandInfo {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	res := []xsapiv1.ExecCommandInfo{}
+	for _, cmd := range ec.cmds {
+		res = append(res, cmd.GetInfo())
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].StartTime.After(res[j].StartTime)
+	})
+	return res
+}
+
+// GetRunningInfoArr returns the info of commands not exited
+func (ec *ExecCommands) GetRunningInfoArr() []xsapiv1.ExecCommandInfo {
+	res := []xsapiv1.ExecCommandInfo{}
+	for _, info := range ec.GetInfoArr() {
+		if info.State != xsapiv1.ExecStateExited {
+			res = append(res, info)
+		}
+	}
+	return res
+}
+
+// GetInfo returns the public info of a command
+func (c *ExecCommand) GetInfo() xsapiv1.ExecCommandInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.getPid()
+	return c.info
+}
+
+// ShellSetup returns shell commands that must be executed first by a command
+// to apply its resource limits, to write its PID and to read stdin from
+// the fifo managed by server
+func (c *ExecCommand) ShellSetup() []string {
+	return append(append([]string{}, c.limitSetup...),
+		"echo", "$$", ">\""+filepath.Join(c.dir, execPidFilename)+"\"", "&&",
+		"exec", "0<\""+c.StdinPath()+"\"", "&&",
+	)
+}
+
+// StdinPath returns the path of fifo used as command stdin
+func (c *ExecCommand) StdinPath() string {
+	return filepath.Join(c.dir, execStdinFilename)
+}
+
+// getPid returns command PID (read from file written by command itself,
+// see ShellSetup) or 0 when unknown
+func (c *ExecCommand) getPid() int {
+	if c.info.PID == 0 && c.info.State != xsapiv1.ExecStateExited {
+		if data, err := ioutil.ReadFile(filepath.Join(c.dir, execPidFilename)); err == nil {
+			c.info.PID, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		}
+	}
+	return c.info.PID
+}
+
+// Input writes data on command stdin
+func (c *ExecCommand) Input(stdin string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stdinFd == nil {
+		return fmt.Errorf("stdin closed")
+	}
+	_, err := c.stdinFd.WriteString(stdin)
+	return err
+}
+
+// CloseStdin closes command stdin (IOW command will read EOF)
+func (c *ExecCommand) CloseStdin() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closeStdin()
+}
+
+// closeStdin same as CloseStdin without mutex protection
+func (c *ExecCommand) closeStdin() {
+	if c.stdinFd != nil {
+		c.stdinFd.Close()
+		c.stdinFd = nil
+		os.Remove(c.StdinPath())
+	}
+}
+
+// Output appends a chunk of output (already translated for client) into
+// history, errOutputLimit is returned (and chunk dropped) when max output
+// size of command is reached
+func (c *ExecCommand) Output(msg xsapiv1.ExecOutMsg) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.outFd == nil {
+		return fmt.Errorf("command history closed")
+	}
+	size := int64(len(msg.Stdout) + len(msg.Stderr))
+	if c.info.Limits.OutputSize > 0 && c.outSize+size > c.info.Limits.OutputSize {
+		return errOutputLimit
+	}
+	c.outSize += size
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = c.outFd.Write(append(data, '\n'))
+	return err
+}
+
+// Exit records command exit status and closes its history
+func (c *ExecCommand) Exit(code int, exitErr error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.getPid()
+	c.info.State = xsapiv1.ExecStateExited
+	c.info.EndTime = time.Now()
+	c.info.Code = code
+	if exitErr != nil {
+		c.info.Error = exitErr.Error()
+	}
+
+	if c.outFd != nil {
+		c.outFd.Close()
+		c.outFd = nil
+	}
+	c.closeStdin()
+	c.releaseCgroup()
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+	return c.saveInfo()
+}
+
+// Start starts a command or queues it when concurrency limits are reached
+func (ec *ExecCommands) Start(cmd *ExecCommand, execWS *eows.ExecOverWS) error {
+	return ec.sched.Submit(cmd, execWS)
+}
+
+// Done must be called when a started command exited (allows to start
+// queued commands)
+func (ec *ExecCommands) Done(cmd *ExecCommand) {
+	ec.sched.Done(cmd)
+}
+
+// Kill terminates gracefully a running command: SIGTERM is sent first and
+// then SIGKILL when command is still running after grace period (in seconds)
+// Queued commands are simply removed from queue.
+func (ec *ExecCommands) Kill(cmd *ExecCommand, grace int) error {
+	if cmd.GetInfo().State == xsapiv1.ExecStateQueued {
+		if err := ec.sched.Cancel(cmd); err != errNotQueued {
+			return err
+		}
+		// command started in the meantime
+	}
+
+	cmd.mutex.Lock()
+	defer cmd.mutex.Unlock()
+
+	if cmd.info.State == xsapiv1.ExecStateExited {
+		return fmt.Errorf("command already exited")
+	}
+	if grace <= 0 {
+		grace = execKillGracePeriod
+	}
+
+	ec.Log.Infof("Terminate command %s (PID %d, grace period %ds)", cmd.info.CmdID, cmd.getPid(), grace)
+	if err := cmd.signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	cmd.info.State = xsapiv1.ExecStateStopping
+
+	go func(done chan struct{}) {
+		select {
+		case <-done:
+		case <-time.After(time.Duration(grace) * time.Second):
+			cmd.mutex.Lock()
+			defer cmd.mutex.Unlock()
+			if cmd.info.State != xsapiv1.ExecStateExited {
+				ec.Log.Infof("Kill command %s (still running after %ds)", cmd.info.CmdID, grace)
+				if err := cmd.signal(syscall.SIGKILL); err != nil {
+					ec.Log.Errorf("Cannot kill command %s: %v", cmd.info.CmdID, err)
+				}
+			}
+		}
+	}(cmd.done)
+
+	return nil
+}
+
+// signal sends a signal to command and all its children
+// (must be called with mutex locked)
+func (c *ExecCommand) signal(sig syscall.Signal) error {
+	if pid := c.getPid(); pid > 0 {
+		return signalProcessTree(pid, sig)
+	}
+
+	// Fallback when PID is not known: only signal shell process
+	e := eows.GetEows(c.info.CmdID)
+	if e == nil {
+		return fmt.Errorf("unknown cmdID")
+	}
+	if sig == syscall.SIGKILL {
+		return e.Signal("SIGKILL")
+	}
+	return e.Signal("SIGTERM")
+}
+
+// AddListener registers a new listener of command output and exit messages
+func (c *ExecCommand) AddListener() *ExecListener {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	l := &ExecListener{
+		C:    make(chan xsapiv1.ExecStreamMsg, 64),
+		quit: make(chan struct{}),
+	}
+	c.listeners = append(c.listeners, l)
+	return l
+}
+
+// RemoveListener un-registers a listener
+func (c *ExecCommand) RemoveListener(l *ExecListener) {
+	// unblock notify first (mutex may be hold by a notify)
+	close(l.quit)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, ll := range c.listeners {
+		if ll == l {
+			c.listeners = append(c.listeners[:i], c.listeners[i+1:]...)
+			break
+		}
+	}
+}
+
+// notifyListeners sends a message to listeners (must be called with mutex
+// unlocked as sending blocks until listeners read it)
+func notifyListeners(listeners []*ExecListener, event string, data interface{}) {
+	for _, l := range listeners {
+		select {
+		case l.C <- xsapiv1.ExecStreamMsg{Event: event, Data: data}:
+		case <-l.quit:
+		}
+	}
+}
+
+// attachedUnsafe returns listeners and socket of client attached to a
+// command (must be called with mutex locked)
+func (ec *ExecCommands) attachedUnsafe(cmd *ExecCommand) ([]*ExecListener, *socketio.Socket) {
+	listeners := append([]*ExecListener{}, cmd.listeners...)
+	// IO socket can be nil when disconnected
+	return listeners, ec.sessions.IOSocketGet(cmd.sid)
+}
+
+// EmitOutput emits output to the client attached to a command, output is
+// buffered when no client is attached (IOW WS closed)
+func (ec *ExecCommands) EmitOutput(cmd *ExecCommand, msg xsapiv1.ExecOutMsg) error {
+	cmd.mutex.Lock()
+	listeners, so := ec.attachedUnsafe(cmd)
+	if so == nil && len(listeners) == 0 {
+		ec.LogSillyf("%s buffered: WS closed (sid:%s, msgid:%s)", xsapiv1.ExecOutEvent, cmd.sid, msg.CmdID)
+		cmd.pendingOut = append(cmd.pendingOut, msg)
+		cmd.pendingSize += len(msg.Stdout) + len(msg.Stderr)
+		for cmd.pendingSize > execPendingMaxSize && len(cmd.pendingOut) > 1 {
+			cmd.pendingSize -= len(cmd.pendingOut[0].Stdout) + len(cmd.pendingOut[0].Stderr)
+			cmd.pendingOut = cmd.pendingOut[1:]
+		}
+	}
+	cmd.mutex.Unlock()
+
+	notifyListeners(listeners, xsapiv1.ExecOutEvent, msg)
+	if so == nil {
+		return nil
+	}
+
+	// FIXME replace by .BroadcastTo a room
+	return (*so).Emit(xsapiv1.ExecOutEvent, msg)
+}
+
+// Emit emits an event to the client attached to a command (message is
+// dropped when no client is attached)
+func (ec *ExecCommands) Emit(cmd *ExecCommand, event string, data interface{}) error {
+	cmd.mutex.Lock()
+	listeners, so := ec.attachedUnsafe(cmd)
+	sid, cmdID := cmd.sid, cmd.info.CmdID
+	cmd.mutex.Unlock()
+
+	notifyListeners(listeners, event, data)
+	if so == nil {
+		ec.LogSillyf("%s not emitted: WS closed (sid:%s, cmdid:%s)", event, sid, cmdID)
+		return nil
+	}
+
+	// FIXME replace by .BroadcastTo a room
+	return (*so).Emit(event, data)
+}
+
+// EmitExit emits exit message to the client attached to a command, message
+// is kept until a client attaches when WS is closed
+func (ec *ExecCommands) EmitExit(cmd *ExecCommand, msg xsapiv1.ExecExitMsg) error {
+	cmd.mutex.Lock()
+	listeners, so := ec.attachedUnsafe(cmd)
+	if so == nil && len(listeners) == 0 {
+		ec.Log.Infof("%s not emitted - WS closed (id:%s)", xsapiv1.ExecExitEvent, msg.CmdID)
+		cmd.pendingExit = &msg
+	}
+	cmd.mutex.Unlock()
+
+	notifyListeners(listeners, xsapiv1.ExecExitEvent, msg)
+
+	ec.webhooks.Send(xsapiv1.EventMsg{
+		Time: time.Now().String(),
+		Type: xsapiv1.ExecExitEvent,
+		Data: newExecExitJSONMsg(msg),
+	})
+
+	if so == nil {
+		return nil
+	}
+
+	// FIXME replace by .BroadcastTo a room
+	return (*so).Emit(xsapiv1.ExecExitEvent, msg)
+}
+
+// BindInput registers the input handler of a command on the socket of
+// attached client
+func (c *ExecCommand) BindInput(so *socketio.Socket) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.bindInputUnsafe(so)
+}
+
+// bindInputUnsafe registers the input handler on a socket once, input of
+// other sockets is then ignored (must be called with mutex locked)
+func (c *ExecCommand) bindInputUnsafe(so *socketio.Socket) error {
+	if c.InputCB == nil {
+		return nil
+	}
+	soID := (*so).Id()
+	if !c.inputSocks[soID] {
+		err := (*so).On(xsapiv1.ExecInEvent, func(stdin string) {
+			c.mutex.Lock()
+			attached := c.inputSoID == soID
+			c.mutex.Unlock()
+			if attached {
+				c.InputCB(stdin)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if c.inputSocks == nil {
+			c.inputSocks = make(map[string]bool)
+		}
+		c.inputSocks[soID] = true
+	}
+	c.inputSoID = soID
+	return nil
+}
+
+// execExitJSONMsg Exit message sent to webhooks and HTTP streams (error
+// interface is encoded as an empty object, so its message is sent instead)
+type execExitJSONMsg struct {
+	xsapiv1.ExecExitMsg
+	Error string `json:"error"`
+}
+
+// newExecExitJSONMsg returns the JSON payload of an exit message
+func newExecExitJSONMsg(msg xsapiv1.ExecExitMsg) execExitJSONMsg {
+	hm := execExitJSONMsg{ExecExitMsg: msg}
+	if msg.Error != nil {
+		hm.Error = msg.Error.Error()
+	}
+	return hm
+}
+
+// Attach binds a command to a client session: output, input and exit events
+// are then redirected to the WS of this session. Output buffered while
+// no client was attached is sent first.
+func (ec *ExecCommands) Attach(cmd *ExecCommand, sess *ClientSession) error {
+	if sess.IOSocket == nil {
+		return fmt.Errorf("Websocket not established")
+	}
+
+	cmd.mutex.Lock()
+	defer cmd.mutex.Unlock()
+
+	if cmd.info.State == xsapiv1.ExecStateExited && cmd.pendingExit == nil {
+		return fmt.Errorf("command already exited")
+	}
+
+	ec.Log.Debugf("Attach command %s to session %s (previous %s)", cmd.info.CmdID, sess.ID, cmd.sid)
+	cmd.sid = sess.ID
+	cmd.info.SessionID = sessionPublicID(sess.ID)
+	if e := eows.GetEows(cmd.info.CmdID); e != nil {
+		e.Sid = sess.ID
+		e.SocketIO = sess.IOSocket
+	}
+
+	so := sess.IOSocket
+	if err := cmd.bindInputUnsafe(so); err != nil {
+		return err
+	}
+
+	for _, msg := range cmd.pendingOut {
+		if err := (*so).Emit(xsapiv1.ExecOutEvent, msg); err != nil {
+			return err
+		}
+	}
+	cmd.pendingOut = nil
+	cmd.pendingSize = 0
+
+	if cmd.pendingExit != nil {
+		if err := (*so).Emit(xsapiv1.ExecExitEvent, *cmd.pendingExit); err != nil {
+			return err
+		}
+		cmd.pendingExit = nil
+	}
+
+	return nil
+}
+
+// GetOutput returns the recorded output of a command starting at offset
+// (IOW number of messages already received by client)
+func (c *ExecCommand) GetOutput(offset int) ([]xsapiv1.ExecOutMsg, error) {
+	res := []xsapiv1.ExecOutMsg{}
+
+	fd, err := os.Open(filepath.Join(c.dir, execOutputFilename))
+	if err != nil {
+		return res, err
+	}
+	defer fd.Close()
+
+	idx := 0
+	rd := bufio.NewReader(fd)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			if idx >= offset {
+				msg := xsapiv1.ExecOutMsg{}
+				if errD := json.Unmarshal(line, &msg); errD != nil {
+					return res, errD
+				}
+				res = append(res, msg)
+			}
+			idx++
+		}
+		if err != nil {
+			// Partial last line means that command is still writing it
+			break
+		}
+	}
+	return res, nil
+}
+
+// saveInfo writes command info on disk (must be called with mutex locked)
+func (c *ExecCommand) saveInfo() error {
+	fd, err := os.OpenFile(filepath.Join(c.dir, execInfoFilename), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	enc := json.NewEncoder(fd)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c.info)
+}
+
+// loadHistory loads commands history saved on disk
+func (ec *ExecCommands) loadHistory() error {
+	files, err := filepath.Glob(filepath.Join(ec.historyDir, "*", execInfoFilename))
+	if err != nil {
+		return err
+	}
+
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	idPrefix := ec.Config.ServerUID[:18] + "_"
+	for _, file := range files {
+		cmd := &ExecCommand{dir: filepath.Dir(file)}
+
+		fd, err := os.Open(file)
+		if err != nil {
+			ec.Log.Warningf("Cannot read command history %s: %v", file, err)
+			continue
+		}
+		err = json.NewDecoder(fd).Decode(&cmd.info)
+		fd.Close()
+		if err != nil || cmd.info.CmdID == "" {
+			ec.Log.Warningf("Invalid command history %s: %v", file, err)
+			continue
+		}
+
+		// Previous versions saved session ID (a credential) in history
+		if !sessionPublicIDRegexp.MatchString(cmd.info.SessionID) {
+			cmd.info.SessionID = sessionPublicID(cmd.info.SessionID)
+			cmd.saveInfo()
+		}
+
+		// Commands still running when server stopped will never complete
+		if cmd.info.State != xsapiv1.ExecStateExited {
+			cmd.info.State = xsapiv1.ExecStateExited
+			cmd.info.Code = -1
+			cmd.info.Error = "interrupted by server stop"
+			cmd.saveInfo()
+		}
+
+		// Don't reuse IDs of commands already in history
+		if strings.HasPrefix(cmd.info.CmdID, idPrefix) {
+			if n, err := strconv.Atoi(strings.TrimPrefix(cmd.info.CmdID, idPrefix)); err == nil && n >= execCommandID {
+				execCommandID = n + 1
+			}
+		}
+
+		ec.cmds[cmd.info.CmdID] = cmd
+	}
+
+	ec.Log.Infof("Loading commands history: %d commands found", len(ec.cmds))
+	ec.pruneHistory()
+
+	return nil
+}
+
+// pruneHistory removes oldest exited commands (must be called with mutex locked)
+func (ec *ExecCommands) pruneHistory() {
+	exited := []*ExecCommand{}
+	for _, cmd := range ec.cmds {
+		if cmd.GetInfo().State == xsapiv1.ExecStateExited {
+			exited = append(exited, cmd)
+		}
+	}
+	if len(exited) <= ec.historyMax {
+		return
+	}
+
+	sort.Slice(exited, func(i, j int) bool {
+		return exited[i].info.StartTime.Before(exited[j].info.StartTime)
+	})
+	for _, cmd := range exited[:len(exited)-ec.historyMax] {
+		ec.LogSillyf("Remove command %s from history", cmd.info.CmdID)
+		delete(ec.cmds, cmd.info.CmdID)
+		if err := os.RemoveAll(cmd.dir); err != nil {
+			ec.Log.Errorf("Cannot remove command history %s: %v", cmd.dir, err)
+		}
+	}
+}
+
+// signalProcessTree sends a signal to a process and all its descendants
+func signalProcessTree(pid int, sig syscall.Signal) error {
+	// Build children list of each process from /proc/<pid>/stat
+	children := make(map[int][]int)
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, st := range stats {
+		data, err := ioutil.ReadFile(st)
+		if err != nil {
+			continue
+		}
+		// format is: pid (comm) state ppid ... and comm may contain spaces
+		idx := strings.LastIndex(string(data), ")")
+		if idx < 0 {
+			continue
+		}
+		fields := strings.Fields(string(data[idx+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		p, err1 := strconv.Atoi(filepath.Base(filepath.Dir(st)))
+		pp, err2 := strconv.Atoi(fields[1])
+		if err1 == nil && err2 == nil {
+			children[pp] = append(children[pp], p)
+		}
+	}
+
+	// Signal descendants first, so that they don't get re-parented
+	var signalTree func(p int)
+	signalTree = func(p int) {
+		for _, child := range children[p] {
+			signalTree(child)
+		}
+		if p != pid {
+			syscall.Kill(p, sig)
+		}
+	}
+	signalTree(pid)
+
+	return syscall.Kill(pid, sig)
+}
+
+var cmdIDInvalidChars = regexp.MustCompile("[^a-zA-Z0-9_.-]")
+
+var sessionPublicIDRegexp = regexp.MustCompile("^([0-9a-f]{32})?$")
+
+// cmdIDToDirname returns a valid and unique directory name from a command
+// ID (command ID may be set by client, so it's suffixed by its hash because
+// invalid characters are replaced)
+func cmdIDToDirname(cmdID string) string {
+	dir := cmdIDInvalidChars.ReplaceAllString(cmdID, "_")
+	if len(dir) > 64 {
+		dir = dir[:64]
+	}
+	h := sha256.Sum256([]byte(cmdID))
+	return dir + "-" + hex.EncodeToString(h[:8])
+}
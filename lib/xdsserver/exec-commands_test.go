@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/googollee/go-socket.io"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+func newTestExecCommands(t *testing.T) (*ExecCommands, func()) {
+	ctx, cleanup := newTestContext(t)
+	ec := &ExecCommands{
+		Context:    ctx,
+		historyDir: filepath.Join(ctx.Config.FileConf.ShareRootDir, "history"),
+		historyMax: 10,
+		cmds:       make(map[string]*ExecCommand),
+	}
+	return ec, cleanup
+}
+
+func TestCmdIDToDirname(t *testing.T) {
+	ids := []string{"a/b", "a_b", "a:b", "..", ".", "", "../../etc", "cmd-1", "cmd_1"}
+	dirs := map[string]string{}
+	for _, id := range ids {
+		dir := cmdIDToDirname(id)
+		if dir == "" || dir == "." || dir == ".." || filepath.Base(dir) != dir {
+			t.Errorf("cmdIDToDirname(%q) = %q: invalid directory name", id, dir)
+		}
+		if other, exist := dirs[dir]; exist {
+			t.Errorf("cmdIDToDirname(%q) = cmdIDToDirname(%q) = %q", id, other, dir)
+		}
+		dirs[dir] = id
+	}
+}
+
+func TestExecCommandsAddDuplicate(t *testing.T) {
+	ec, cleanup := newTestExecCommands(t)
+	defer cleanup()
+
+	cmd, err := ec.Add(xsapiv1.ExecCommandInfo{CmdID: "a/b", Cmd: "make"}, "sid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Exit(0, nil)
+
+	if _, err := ec.Add(xsapiv1.ExecCommandInfo{CmdID: "a/b", Cmd: "rm"}, "sid2"); err == nil {
+		t.Errorf("Add of an already used command ID must fail")
+	}
+	if ec.Get("a/b") != cmd {
+		t.Errorf("running command replaced")
+	}
+	other, err := ec.Add(xsapiv1.ExecCommandInfo{CmdID: "a_b", Cmd: "make"}, "sid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Exit(0, nil)
+	if other.dir == cmd.dir {
+		t.Errorf("commands a/b and a_b share history directory %s", cmd.dir)
+	}
+	if info := cmd.GetInfo(); info.SessionID != sessionPublicID("sid1") {
+		t.Errorf("session ID of command must be public ID, got %q", info.SessionID)
+	}
+}
+
+// testSocket A socket.io socket recording handlers and emitted events
+type testSocket struct {
+	id       string
+	handlers map[string][]interface{}
+	emitted  []string
+}
+
+func newTestSocket(id string) *socketio.Socket {
+	var so socketio.Socket = &testSocket{id: id, handlers: make(map[string][]interface{})}
+	return &so
+}
+
+func (s *testSocket) Id() string             { return s.id }
+func (s *testSocket) Rooms() []string        { return nil }
+func (s *testSocket) Request() *http.Request { return nil }
+func (s *testSocket) On(event string, f interface{}) error {
+	s.handlers[event] = append(s.handlers[event], f)
+	return nil
+}
+func (s *testSocket) Emit(event string, args ...interface{}) error {
+	s.emitted = append(s.emitted, event)
+	return nil
+}
+func (s *testSocket) Join(room string) error                                    { return nil }
+func (s *testSocket) Leave(room string) error                                   { return nil }
+func (s *testSocket) Disconnect()                                               {}
+func (s *testSocket) BroadcastTo(room, event string, args ...interface{}) error { return nil }
+
+// input calls input handlers registered on a test socket
+func (s *testSocket) input(stdin string) {
+	for _, h := range s.handlers[xsapiv1.ExecInEvent] {
+		h.(func(string))(stdin)
+	}
+}
+
+func TestExecCommandAttachInput(t *testing.T) {
+	ec, cleanup := newTestExecCommands(t)
+	defer cleanup()
+
+	cmd, err := ec.Add(xsapiv1.ExecCommandInfo{CmdID: "cmd1", Cmd: "cat"}, "sid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Exit(0, nil)
+	inputs := []string{}
+	cmd.InputCB = func(stdin string) { inputs = append(inputs, stdin) }
+
+	so1, so2 := newTestSocket("so1"), newTestSocket("so2")
+	if err := cmd.BindInput(so1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ec.Attach(cmd, &ClientSession{ID: "sid2", IOSocket: so2}); err != nil {
+		t.Fatal(err)
+	}
+	(*so1).(*testSocket).input("old")
+	(*so2).(*testSocket).input("new")
+
+	// Attach again to first socket: handler is not registered twice
+	if err := ec.Attach(cmd, &ClientSession{ID: "sid1", IOSocket: so1}); err != nil {
+		t.Fatal(err)
+	}
+	(*so1).(*testSocket).input("again")
+	(*so2).(*testSocket).input("detached")
+
+	if len(inputs) != 2 || inputs[0] != "new" || inputs[1] != "again" {
+		t.Errorf("inputs = %v, want [new again]", inputs)
+	}
+}
+
+func TestExecCommandsAddExitedID(t *testing.T) {
+	ec, cleanup := newTestExecCommands(t)
+	defer cleanup()
+
+	cmd, err := ec.Add(xsapiv1.ExecCommandInfo{CmdID: "cmd-1", Cmd: "make"}, "sid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Exit(2, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// ID of an exited command can be reused, its history is replaced
+	other, err := ec.Add(xsapiv1.ExecCommandInfo{CmdID: "cmd-1", Cmd: "make clean"}, "sid1")
+	if err != nil {
+		t.Fatalf("Add of an exited command ID error = %v", err)
+	}
+	defer other.Exit(0, nil)
+	if ec.Get("cmd-1") != other {
+		t.Errorf("exited command not replaced")
+	}
+	if info := other.GetInfo(); info.State == xsapiv1.ExecStateExited || info.Cmd != "make clean" {
+		t.Errorf("invalid info of new command: %+v", info)
+	}
+	if out, err := other.GetOutput(0); err != nil || len(out) != 0 {
+		t.Errorf("output of new command = %v, %v", out, err)
+	}
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// Max number of diagnostics kept in summary sent in exit message
+const execDiagMaxSummary = 500
+
+// Max size of an incomplete line kept till next chunk (only the end of
+// longer lines, eg. progress bars using \r, is parsed)
+const execDiagMaxLine = 64 * 1024
+
+var (
+	diagAnsiRe = regexp.MustCompile("\x1b\\[[0-9;]*[mK]")
+
+	// file.c:12:5: error: message (column is optional)
+	diagGccRe = regexp.MustCompile(`^(.+?):(\d+):(?:(\d+):)?\s+(fatal error|error|warning|note):\s+(.*)$`)
+
+	// file.o:(.text+0x1a): undefined reference to `foo' or
+	// file.c:12: undefined reference to `foo'
+	diagLdRefRe = regexp.MustCompile(`^(.+?):(?:\(\S+\)|(\d+)):\s+((?:undefined reference|multiple definition|relocation) .*)$`)
+	// /usr/bin/ld: cannot find -lfoo
+	diagLdRe = regexp.MustCompile(`^(?:\S*/)?(?:[\w.-]+-)?ld(?:\.bfd|\.gold|\.lld)?: (.*)$`)
+
+	// CMake Error at CMakeLists.txt:12 (add_executable):
+	diagCMakeAtRe = regexp.MustCompile(`^CMake (Error|Warning|Deprecation Warning|Deprecation Error|Warning \(dev\)) at (.+?):(\d+)(?: \(.*\))?:\s*$`)
+	// CMake Error: message
+	diagCMakeRe = regexp.MustCompile(`^CMake (Error|Warning)(?: \(dev\))?: (.*)$`)
+
+	// Makefile:12: *** missing separator.  Stop.
+	diagMakeFileRe = regexp.MustCompile(`^(.+?):(\d+): \*\*\* (.*)$`)
+	// make[1]: *** [target] Error 2
+	diagMakeRe = regexp.MustCompile(`^(?:\S*/)?g?make(?:\[\d+\])?: \*\*\* (.*)$`)
+	// make[1]: Entering directory '/path'
+	diagMakeDirRe = regexp.MustCompile("^(?:\\S*/)?g?make(?:\\[\\d+\\])?: (Entering|Leaving) directory [`'\"](.*)['\"]$")
+)
+
+// ExecDiagParser Extract diagnostics of GCC/Clang, GNU ld, CMake and Make
+// from output of a command
+type ExecDiagParser struct {
+	convPath func(string) string // convert path from server to client
+	dirs     []string            // current directory (stack of make directories)
+	partial  map[string]string   // last incomplete line of each stream
+	cmake    *xsapiv1.ExecDiagnostic
+	cmakeMsg []string
+	summary  xsapiv1.ExecDiagSummary
+	mutex    sync.Mutex
+}
+
+// NewExecDiagParser creates a new diagnostics parser, relative paths are
+// resolved from dir and then converted using convPath
+func NewExecDiagParser(dir string, convPath func(string) string) *ExecDiagParser {
+	return &ExecDiagParser{
+		convPath: convPath,
+		dirs:     []string{dir},
+		partial:  make(map[string]string),
+		summary:  xsapiv1.ExecDiagSummary{Items: []xsapiv1.ExecDiagnostic{}},
+		mutex:    sync.NewMutex(),
+	}
+}
+
+// Parse parses a chunk of output (stream is the output name, IOW stdout or
+// stderr) and returns the diagnostics found. Lines split between chunks
+// are parsed when complete.
+func (p *ExecDiagParser) Parse(stream, data string) []xsapiv1.ExecDiagnostic {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	res := []xsapiv1.ExecDiagnostic{}
+	if data == "" {
+		return res
+	}
+	lines := strings.Split(p.partial[stream]+data, "\n")
+	last := lines[len(lines)-1]
+	if len(last) > execDiagMaxLine {
+		last = last[len(last)-execDiagMaxLine:]
+	}
+	p.partial[stream] = last
+	for _, l := range lines[:len(lines)-1] {
+		res = append(res, p.parseLine(l)...)
+	}
+	return res
+}
+
+// Flush parses remaining incomplete lines (to be called when command exited)
+func (p *ExecDiagParser) Flush() []xsapiv1.ExecDiagnostic {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	res := []xsapiv1.ExecDiagnostic{}
+	for stream, l := range p.partial {
+		if l != "" {
+			res = append(res, p.parseLine(l)...)
+		}
+		delete(p.partial, stream)
+	}
+	if d := p.endCMake(); d != nil {
+		res = append(res, *d)
+	}
+	return res
+}
+
+// Summary returns the summary of all diagnostics found
+func (p *ExecDiagParser) Summary() *xsapiv1.ExecDiagSummary {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	sum := p.summary
+	return &sum
+}
+
+// parseLine parses a complete line (must be called with mutex locked)
+func (p *ExecDiagParser) parseLine(line string) []xsapiv1.ExecDiagnostic {
+	res := []xsapiv1.ExecDiagnostic{}
+	line = strings.TrimRight(diagAnsiRe.ReplaceAllString(line, ""), "\r")
+
+	// CMake messages are spread over several indented lines (that may be
+	// separated by empty lines)
+	if p.cmake != nil {
+		if strings.HasPrefix(line, " ") || line == "" {
+			if l := strings.TrimSpace(line); l != "" {
+				p.cmakeMsg = append(p.cmakeMsg, l)
+			}
+			return res
+		}
+		if d := p.endCMake(); d != nil {
+			res = append(res, *d)
+		}
+	}
+
+	if d := p.parseDiag(line); d != nil {
+		if d.Tool == xsapiv1.ExecDiagToolCMake && d.Message == "" {
+			p.cmake = d
+			p.cmakeMsg = []string{}
+		} else {
+			res = append(res, *p.add(d))
+		}
+	}
+	return res
+}
+
+// parseDiag returns the diagnostic described by a line or nil
+func (p *ExecDiagParser) parseDiag(line string) *xsapiv1.ExecDiagnostic {
+	if m := diagMakeDirRe.FindStringSubmatch(line); m != nil {
+		if m[1] == "Entering" {
+			p.dirs = append(p.dirs, m[2])
+		} else if len(p.dirs) > 1 {
+			p.dirs = p.dirs[:len(p.dirs)-1]
+		}
+		return nil
+	}
+
+	if m := diagCMakeAtRe.FindStringSubmatch(line); m != nil {
+		return &xsapiv1.ExecDiagnostic{
+			Tool:     xsapiv1.ExecDiagToolCMake,
+			File:     m[2],
+			Line:     atoi(m[3]),
+			Severity: diagSeverity(m[1]),
+		}
+	}
+	if m := diagCMakeRe.FindStringSubmatch(line); m != nil {
+		return &xsapiv1.ExecDiagnostic{
+			Tool:     xsapiv1.ExecDiagToolCMake,
+			Severity: diagSeverity(m[1]),
+			Message:  m[2],
+		}
+	}
+
+	if m := diagMakeRe.FindStringSubmatch(line); m != nil {
+		return &xsapiv1.ExecDiagnostic{
+			Tool:     xsapiv1.ExecDiagToolMake,
+			Severity: xsapiv1.ExecDiagError,
+			Message:  m[1],
+		}
+	}
+	if m := diagMakeFileRe.FindStringSubmatch(line); m != nil {
+		return &xsapiv1.ExecDiagnostic{
+			Tool:     xsapiv1.ExecDiagToolMake,
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Severity: xsapiv1.ExecDiagError,
+			Message:  m[3],
+		}
+	}
+
+	if m := diagGccRe.FindStringSubmatch(line); m != nil {
+		d := &xsapiv1.ExecDiagnostic{
+			Tool:     xsapiv1.ExecDiagToolGcc,
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Column:   atoi(m[3]),
+			Severity: diagSeverity(m[4]),
+			Message:  m[5],
+		}
+		// make also reports warnings using this format
+		base := strings.ToLower(filepath.Base(d.File))
+		if base == "makefile" || base == "gnumakefile" || strings.HasSuffix(base, ".mk") {
+			d.Tool = xsapiv1.ExecDiagToolMake
+		}
+		return d
+	}
+
+	if m := diagLdRefRe.FindStringSubmatch(line); m != nil {
+		return &xsapiv1.ExecDiagnostic{
+			Tool:     xsapiv1.ExecDiagToolLd,
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Severity: xsapiv1.ExecDiagError,
+			Message:  m[3],
+		}
+	}
+	if m := diagLdRe.FindStringSubmatch(line); m != nil {
+		// skip context lines such as "/usr/bin/ld: main.o: in function `main':"
+		if strings.HasSuffix(m[1], ":") {
+			return nil
+		}
+		d := &xsapiv1.ExecDiagnostic{
+			Tool:     xsapiv1.ExecDiagToolLd,
+			Severity: xsapiv1.ExecDiagError,
+			Message:  m[1],
+		}
+		if strings.HasPrefix(m[1], "warning: ") {
+			d.Severity = xsapiv1.ExecDiagWarning
+			d.Message = strings.TrimPrefix(m[1], "warning: ")
+		}
+		return d
+	}
+
+	return nil
+}
+
+// endCMake completes the pending multi-lines CMake diagnostic
+func (p *ExecDiagParser) endCMake() *xsapiv1.ExecDiagnostic {
+	if p.cmake == nil {
+		return nil
+	}
+	d := p.cmake
+	d.Message = strings.Join(p.cmakeMsg, " ")
+	p.cmake = nil
+	p.cmakeMsg = nil
+	return p.add(d)
+}
+
+// add resolves path of a diagnostic and adds it in summary
+func (p *ExecDiagParser) add(d *xsapiv1.ExecDiagnostic) *xsapiv1.ExecDiagnostic {
+	if d.File != "" {
+		if !filepath.IsAbs(d.File) {
+			d.File = filepath.Join(p.dirs[len(p.dirs)-1], d.File)
+		}
+		d.File = p.convPath(d.File)
+	}
+	d.Message = p.convPath(d.Message)
+
+	switch d.Severity {
+	case xsapiv1.ExecDiagError:
+		p.summary.Errors++
+	case xsapiv1.ExecDiagWarning:
+		p.summary.Warnings++
+	}
+	if len(p.summary.Items) < execDiagMaxSummary {
+		p.summary.Items = append(p.summary.Items, *d)
+	} else {
+		p.summary.Truncated = true
+	}
+	return d
+}
+
+// diagSeverity normalizes severity reported by tools
+func diagSeverity(s string) string {
+	s = strings.ToLower(s)
+	switch {
+	case strings.Contains(s, "error"):
+		return xsapiv1.ExecDiagError
+	case strings.Contains(s, "warning"):
+		return xsapiv1.ExecDiagWarning
+	}
+	return xsapiv1.ExecDiagNote
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
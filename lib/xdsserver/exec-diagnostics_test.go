@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+func TestExecDiagParser(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []xsapiv1.ExecDiagnostic
+	}{
+		{
+			"gcc error",
+			"main.c:12:5: error: 'x' undeclared\n",
+			[]xsapiv1.ExecDiagnostic{{Tool: "gcc", File: "/srv/prj/main.c", Line: 12, Column: 5, Severity: "error", Message: "'x' undeclared"}},
+		},
+		{
+			"gcc warning without column and colors",
+			"\x1b[01m\x1b[Kinc/a.h:3:\x1b[m\x1b[K \x1b[01;35m\x1b[Kwarning: \x1b[m\x1b[Kunused\r\n",
+			[]xsapiv1.ExecDiagnostic{{Tool: "gcc", File: "/srv/prj/inc/a.h", Line: 3, Severity: "warning", Message: "unused"}},
+		},
+		{
+			"fatal error and note",
+			"/usr/include/b.h:1:10: fatal error: c.h: No such file\nmain.c:2:1: note: in expansion\n",
+			[]xsapiv1.ExecDiagnostic{
+				{Tool: "gcc", File: "/usr/include/b.h", Line: 1, Column: 10, Severity: "error", Message: "c.h: No such file"},
+				{Tool: "gcc", File: "/srv/prj/main.c", Line: 2, Column: 1, Severity: "note", Message: "in expansion"},
+			},
+		},
+		{
+			"make directories",
+			"make[1]: Entering directory '/srv/prj/lib'\nutil.c:7:1: error: oops\nmake[1]: Leaving directory '/srv/prj/lib'\nmain.c:1:1: warning: hmm\n",
+			[]xsapiv1.ExecDiagnostic{
+				{Tool: "gcc", File: "/srv/prj/lib/util.c", Line: 7, Column: 1, Severity: "error", Message: "oops"},
+				{Tool: "gcc", File: "/srv/prj/main.c", Line: 1, Column: 1, Severity: "warning", Message: "hmm"},
+			},
+		},
+		{
+			"make errors",
+			"Makefile:12: *** missing separator.  Stop.\nmake[2]: *** [all] Error 2\nrules.mk:3: warning: overriding recipe\n",
+			[]xsapiv1.ExecDiagnostic{
+				{Tool: "make", File: "/srv/prj/Makefile", Line: 12, Severity: "error", Message: "missing separator.  Stop."},
+				{Tool: "make", Severity: "error", Message: "[all] Error 2"},
+				{Tool: "make", File: "/srv/prj/rules.mk", Line: 3, Severity: "warning", Message: "overriding recipe"},
+			},
+		},
+		{
+			"ld",
+			"/usr/bin/ld: main.o: in function `main':\nmain.c:(.text+0x1a): undefined reference to `foo'\n/usr/bin/ld: cannot find -lbar\naarch64-linux-gnu-ld.bfd: warning: x\n",
+			[]xsapiv1.ExecDiagnostic{
+				{Tool: "ld", File: "/srv/prj/main.c", Severity: "error", Message: "undefined reference to `foo'"},
+				{Tool: "ld", Severity: "error", Message: "cannot find -lbar"},
+				{Tool: "ld", Severity: "warning", Message: "x"},
+			},
+		},
+		{
+			"cmake",
+			"CMake Error at CMakeLists.txt:12 (add_executable):\n  Cannot find source file:\n\n    foo.c\n\n-- Configuring incomplete\nCMake Warning: manually-specified variables\n",
+			[]xsapiv1.ExecDiagnostic{
+				{Tool: "cmake", File: "/srv/prj/CMakeLists.txt", Line: 12, Severity: "error", Message: "Cannot find source file: foo.c"},
+				{Tool: "cmake", Severity: "warning", Message: "manually-specified variables"},
+			},
+		},
+		{
+			"cmake at end of output",
+			"CMake Deprecation Warning at CMakeLists.txt:1 (cmake_minimum_required):\n  old version",
+			[]xsapiv1.ExecDiagnostic{{Tool: "cmake", File: "/srv/prj/CMakeLists.txt", Line: 1, Severity: "warning", Message: "old version"}},
+		},
+		{
+			"no diagnostic",
+			"gcc -c main.c -o main.o\nerror: this is not a diagnostic\n",
+			[]xsapiv1.ExecDiagnostic{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewExecDiagParser("/srv/prj", func(s string) string { return s })
+			got := append(p.Parse("stdout", tt.output), p.Flush()...)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diagnostics = %+v, want %+v", got, tt.want)
+			}
+
+			sum := p.Summary()
+			errors, warnings := 0, 0
+			for _, d := range tt.want {
+				switch d.Severity {
+				case xsapiv1.ExecDiagError:
+					errors++
+				case xsapiv1.ExecDiagWarning:
+					warnings++
+				}
+			}
+			if sum.Errors != errors || sum.Warnings != warnings || len(sum.Items) != len(tt.want) {
+				t.Errorf("summary = %+v, want %d errors and %d warnings", sum, errors, warnings)
+			}
+		})
+	}
+}
+
+func TestExecDiagParserChunks(t *testing.T) {
+	p := NewExecDiagParser("/srv/prj", func(s string) string {
+		return strings.Replace(s, "/srv/prj", "C:/prj", -1)
+	})
+	res := p.Parse("stderr", "main.c:1")
+	res = append(res, p.Parse("stdout", "util.c:2:3: warning: in /srv/prj/util.c\n")...)
+	res = append(res, p.Parse("stderr", ":2: error: split\n")...)
+
+	want := []xsapiv1.ExecDiagnostic{
+		{Tool: "gcc", File: "C:/prj/util.c", Line: 2, Column: 3, Severity: "warning", Message: "in C:/prj/util.c"},
+		{Tool: "gcc", File: "C:/prj/main.c", Line: 1, Column: 2, Severity: "error", Message: "split"},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("diagnostics = %+v, want %+v", res, want)
+	}
+}
+
+func TestExecDiagParserTruncated(t *testing.T) {
+	p := NewExecDiagParser("/srv/prj", func(s string) string { return s })
+	p.Parse("stdout", strings.Repeat("a.c:1:1: warning: w\n", execDiagMaxSummary+10))
+	sum := p.Summary()
+	if sum.Warnings != execDiagMaxSummary+10 || len(sum.Items) != execDiagMaxSummary || !sum.Truncated {
+		t.Errorf("summary: %d warnings, %d items, truncated %v", sum.Warnings, len(sum.Items), sum.Truncated)
+	}
+}
+
+func TestExecDiagParserLongLine(t *testing.T) {
+	p := NewExecDiagParser("/srv/prj", func(s string) string { return s })
+	chunk := strings.Repeat("[=====>    ] 50%\r", 1000)
+	for i := 0; i < 100; i++ {
+		p.Parse("stdout", chunk)
+		if l := len(p.partial["stdout"]); l > execDiagMaxLine {
+			t.Fatalf("partial line of %d bytes kept", l)
+		}
+	}
+
+	res := p.Parse("stdout", chunk+"\nmain.c:1:2: error: next line\n")
+	if len(res) != 1 || res[0].Message != "next line" {
+		t.Errorf("diagnostics = %+v, want 1 error", res)
+	}
+}
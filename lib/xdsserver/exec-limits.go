@@ -0,0 +1,275 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// Resources of commands are limited using cgroup v2 when available (each
+// command runs in its own cgroup created under a cgroup dedicated to
+// xds-server), otherwise using rlimits (ulimit)
+
+const (
+	cgroupMountDir = "/sys/fs/cgroup"
+	execCgroupName = "xds-exec"
+)
+
+// cgroup v2 controllers used to limit command resources
+var cgroupControllers = []string{"memory", "pids", "cpu"}
+
+// errOutputLimit returned when max output size of a command is reached
+var errOutputLimit = fmt.Errorf("output size limit reached")
+
+// mergeExecLimits returns limits requested for a command bounded by
+// server limits (server limits are used when not set for command)
+func mergeExecLimits(srv, cmd xsapiv1.ExecLimits) xsapiv1.ExecLimits {
+	minI64 := func(s, c int64) int64 {
+		if c <= 0 || (s > 0 && s < c) {
+			return s
+		}
+		return c
+	}
+	return xsapiv1.ExecLimits{
+		Memory:     minI64(srv.Memory, cmd.Memory),
+		CPUShare:   int(minI64(int64(srv.CPUShare), int64(cmd.CPUShare))),
+		Pids:       int(minI64(int64(srv.Pids), int64(cmd.Pids))),
+		OutputSize: minI64(srv.OutputSize, cmd.OutputSize),
+		WallTime:   int(minI64(int64(srv.WallTime), int64(cmd.WallTime))),
+	}
+}
+
+// initCgroup setups the cgroup under which commands cgroups will be created
+func (ec *ExecCommands) initCgroup() {
+	ec.cgroupCtrls = make(map[string]bool)
+
+	if !common.Exists(filepath.Join(cgroupMountDir, "cgroup.controllers")) {
+		ec.Log.Infof("cgroup v2 not available, resources limited using rlimits")
+		return
+	}
+
+	dir := ec.Config.FileConf.ExecConf.CgroupDir
+	if dir == "" {
+		// Auto-detect: use a sub-cgroup of the one of xds-server
+		own, err := getOwnCgroup()
+		if err != nil {
+			ec.Log.Warningf("Cannot get xds-server cgroup: %v", err)
+			return
+		}
+		dir = filepath.Join(own, execCgroupName)
+	}
+
+	if !common.Exists(dir) {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			ec.Log.Warningf("Cannot create cgroup %s (resources limited using rlimits): %v", dir, err)
+			return
+		}
+	}
+
+	// Controllers must be enabled in parent to be available in this cgroup
+	// (may fail when parent already contains processes or is not delegated)
+	for _, ctrl := range cgroupControllers {
+		ioutil.WriteFile(filepath.Join(filepath.Dir(dir), "cgroup.subtree_control"), []byte("+"+ctrl), 0644)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		ec.Log.Warningf("Cannot read cgroup controllers of %s: %v", dir, err)
+		return
+	}
+	available := strings.Fields(string(data))
+	for _, ctrl := range cgroupControllers {
+		for _, a := range available {
+			if a == ctrl {
+				err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+ctrl), 0644)
+				if err == nil {
+					ec.cgroupCtrls[ctrl] = true
+				}
+				break
+			}
+		}
+	}
+	if len(ec.cgroupCtrls) == 0 {
+		ec.Log.Warningf("No cgroup controller available in %s, resources limited using rlimits", dir)
+		return
+	}
+
+	ec.cgroupDir = dir
+	ec.Log.Infof("Exec cgroup: %s (controllers %v)", dir, ec.cgroupCtrls)
+}
+
+// setupLimits creates cgroup of a command and returns the shell commands
+// used to apply its limits
+func (ec *ExecCommands) setupLimits(cmd *ExecCommand) ([]string, error) {
+	lim := cmd.info.Limits
+	setup := []string{}
+	useCgroup := func(ctrl string) bool {
+		return ec.cgroupDir != "" && ec.cgroupCtrls[ctrl]
+	}
+
+	if (lim.Memory > 0 && useCgroup("memory")) ||
+		(lim.Pids > 0 && useCgroup("pids")) ||
+		(lim.CPUShare > 0 && useCgroup("cpu")) {
+
+		cg := filepath.Join(ec.cgroupDir, cmdIDToDirname(cmd.info.CmdID))
+		if common.Exists(cg) {
+			syscall.Rmdir(cg)
+		}
+		if err := os.Mkdir(cg, 0755); err != nil {
+			return setup, fmt.Errorf("Cannot create command cgroup: %v", err)
+		}
+		cmd.cgroup = cg
+
+		settings := map[string]string{}
+		if lim.Memory > 0 && useCgroup("memory") {
+			settings["memory.max"] = strconv.FormatInt(lim.Memory, 10)
+			// prevent to bypass memory limit by swapping
+			if common.Exists(filepath.Join(cg, "memory.swap.max")) {
+				settings["memory.swap.max"] = "0"
+			}
+		}
+		if lim.Pids > 0 && useCgroup("pids") {
+			settings["pids.max"] = strconv.Itoa(lim.Pids)
+		}
+		if lim.CPUShare > 0 && useCgroup("cpu") {
+			// quota in microseconds per period of 100ms
+			settings["cpu.max"] = strconv.Itoa(lim.CPUShare*1000) + " 100000"
+		}
+		for file, value := range settings {
+			if err := ioutil.WriteFile(filepath.Join(cg, file), []byte(value), 0644); err != nil {
+				cmd.releaseCgroup()
+				return setup, fmt.Errorf("Cannot set %s of command cgroup: %v", file, err)
+			}
+		}
+
+		// Shell moves itself into cgroup, so all its children inherit limits
+		setup = append(setup, "echo", "$$", ">\""+filepath.Join(cg, "cgroup.procs")+"\"", "&&")
+	}
+
+	// Fallback on rlimits
+	if lim.Memory > 0 && !useCgroup("memory") {
+		setup = append(setup, "ulimit", "-v", strconv.FormatInt(lim.Memory/1024, 10), "&&")
+	}
+	if lim.Pids > 0 && !useCgroup("pids") {
+		// note that RLIMIT_NPROC counts all processes of user
+		setup = append(setup, "ulimit", "-u", strconv.Itoa(lim.Pids), "&&")
+	}
+	if lim.CPUShare > 0 && !useCgroup("cpu") {
+		ec.Log.Warningf("CPU share limit of command %s ignored (requires cgroup v2)", cmd.info.CmdID)
+	}
+
+	return setup, nil
+}
+
+// LimitReached terminates a command that reached one of its limits
+func (ec *ExecCommands) LimitReached(cmd *ExecCommand, limit string) {
+	cmd.mutex.Lock()
+	defer cmd.mutex.Unlock()
+
+	if cmd.info.LimitHit != "" || cmd.info.State == xsapiv1.ExecStateExited {
+		return
+	}
+	cmd.info.LimitHit = limit
+
+	ec.Log.Infof("Kill command %s: %s limit reached", cmd.info.CmdID, limit)
+	if err := cmd.signal(syscall.SIGKILL); err != nil {
+		ec.Log.Errorf("Cannot kill command %s: %v", cmd.info.CmdID, err)
+	}
+}
+
+// CheckLimits must be called when a command exited, it returns the limit
+// hit by the command (if any) and releases its cgroup
+func (ec *ExecCommands) CheckLimits(cmd *ExecCommand) string {
+	cmd.mutex.Lock()
+	defer cmd.mutex.Unlock()
+
+	if cmd.info.LimitHit == "" && cmd.cgroup != "" {
+		if cgroupEventCount(cmd.cgroup, "memory.events", "oom_kill") > 0 {
+			cmd.info.LimitHit = xsapiv1.ExecLimitMemory
+		} else if cgroupEventCount(cmd.cgroup, "pids.events", "max") > 0 {
+			cmd.info.LimitHit = xsapiv1.ExecLimitPids
+		}
+	}
+	if cmd.info.LimitHit == "" && cmd.info.Timeout > 0 &&
+		time.Since(cmd.info.StartTime) >= time.Duration(cmd.info.Timeout)*time.Second {
+		cmd.info.LimitHit = xsapiv1.ExecLimitWallTime
+	}
+
+	if err := cmd.releaseCgroup(); err != nil {
+		ec.Log.Warningf("Cannot remove cgroup of command %s: %v", cmd.info.CmdID, err)
+	}
+
+	return cmd.info.LimitHit
+}
+
+// releaseCgroup removes cgroup of a command (processes still alive, for
+// example detached ones, are killed) - must be called with mutex locked
+func (c *ExecCommand) releaseCgroup() error {
+	if c.cgroup == "" {
+		return nil
+	}
+	err := syscall.Rmdir(c.cgroup)
+	if err != nil {
+		ioutil.WriteFile(filepath.Join(c.cgroup, "cgroup.kill"), []byte("1"), 0644)
+		time.Sleep(100 * time.Millisecond)
+		err = syscall.Rmdir(c.cgroup)
+	}
+	c.cgroup = ""
+	return err
+}
+
+// getOwnCgroup returns the cgroup v2 directory of current process
+func getOwnCgroup() (string, error) {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	// cgroup v2 entry has format "0::/path"
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join(cgroupMountDir, strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 entry")
+}
+
+// cgroupEventCount returns the value of a key in a cgroup events file
+func cgroupEventCount(cgroup, file, key string) int {
+	data, err := ioutil.ReadFile(filepath.Join(cgroup, file))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Commands can be executed in a sandbox: new mount, PID, IPC and network
+// namespaces (created by bubblewrap tool) where only system paths (read-only),
+// folder and SDK directories and a private tmp are visible
+
+// ExecSandboxOpts Options of sandbox in which a command is executed
+type ExecSandboxOpts struct {
+	RWPaths []string // paths visible read-write (eg. folder path)
+	ROPaths []string // paths visible read-only (eg. SDK path)
+	Network bool     // keep access to host network
+	TTY     bool     // command uses a pts (eg. gdb --tty)
+}
+
+// initSandbox checks sandbox settings
+func (ec *ExecCommands) initSandbox() error {
+	cfg := ec.Config.FileConf.ExecConf.Sandbox
+	if !cfg.Enable {
+		return nil
+	}
+
+	bwrap, err := exec.LookPath(cfg.BwrapPath)
+	if err != nil {
+		return fmt.Errorf("Exec sandbox enabled but bubblewrap not found (%s): %v", cfg.BwrapPath, err)
+	}
+	ec.bwrapPath = bwrap
+	ec.Log.Infof("Exec sandbox enabled (%s)", bwrap)
+	return nil
+}
+
+// SandboxEnabled returns true when commands must be executed in a sandbox
+func (ec *ExecCommands) SandboxEnabled() bool {
+	return ec.bwrapPath != ""
+}
+
+// SandboxCommand returns the shell command that executes a command line
+// inside a sandbox
+func (ec *ExecCommands) SandboxCommand(cmdLine string, opts ExecSandboxOpts) []string {
+	cmd := []string{"exec", shellQuote(ec.bwrapPath),
+		"--die-with-parent",
+		"--unshare-pid",
+		"--unshare-ipc",
+	}
+	if !opts.Network {
+		cmd = append(cmd, "--unshare-net")
+	}
+
+	cmd = append(cmd, "--proc", "/proc", "--dev", "/dev")
+	if opts.TTY {
+		cmd = append(cmd, "--dev-bind", "/dev/pts", "/dev/pts")
+	}
+	for _, p := range ec.Config.FileConf.ExecConf.Sandbox.SystemPaths {
+		cmd = append(cmd, "--ro-bind-try", shellQuote(p), shellQuote(p))
+	}
+	for _, p := range opts.ROPaths {
+		cmd = append(cmd, "--ro-bind", shellQuote(p), shellQuote(p))
+	}
+	for _, p := range opts.RWPaths {
+		cmd = append(cmd, "--bind", shellQuote(p), shellQuote(p))
+	}
+
+	// Private tmp, also used as HOME (user HOME is not visible)
+	cmd = append(cmd, "--tmpfs", "/tmp",
+		"--setenv", "TMPDIR", "/tmp",
+		"--setenv", "HOME", "/tmp")
+
+	return append(cmd, "--", "/bin/bash", "-c", shellQuote(cmdLine))
+}
+
+// shellQuote quotes a string to be used as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "'\\''", -1) + "'"
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/iotbzh/xds-common/golib/eows"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// ExecScheduler Start commands while concurrency limits (global and per
+// folder) are not reached, otherwise queue them till a command exits
+type ExecScheduler struct {
+	*Context
+	ec           *ExecCommands
+	maxRunning   int
+	maxPerFolder int
+	priority     bool
+	queue        []*execJob
+	running      map[string]int // number of running commands per folder ID
+	nbRunning    int
+	seq          uint64
+	mutex        sync.Mutex
+}
+
+// execJob a command waiting in queue
+type execJob struct {
+	cmd    *ExecCommand
+	execWS *eows.ExecOverWS
+	seq    uint64
+}
+
+// errNotQueued returned when trying to cancel a command no more in queue
+var errNotQueued = fmt.Errorf("command not queued")
+
+// NewExecScheduler creates a new instance of ExecScheduler
+func NewExecScheduler(ctx *Context, ec *ExecCommands) (*ExecScheduler, error) {
+	cfg := ctx.Config.FileConf.ExecConf
+
+	sc := ExecScheduler{
+		Context:      ctx,
+		ec:           ec,
+		maxRunning:   cfg.MaxRunning,
+		maxPerFolder: cfg.MaxRunningPerFolder,
+		queue:        []*execJob{},
+		running:      make(map[string]int),
+		mutex:        sync.NewMutex(),
+	}
+
+	switch cfg.QueueOrder {
+	case "", xdsconfig.ExecQueueFIFO:
+	case xdsconfig.ExecQueuePriority:
+		sc.priority = true
+	default:
+		return &sc, fmt.Errorf("Invalid exec queue order: %s", cfg.QueueOrder)
+	}
+
+	ctx.Log.Infof("Exec concurrency limits: global %d, per folder %d (0: no limit), queue order %s",
+		sc.maxRunning, sc.maxPerFolder, cfg.QueueOrder)
+
+	return &sc, nil
+}
+
+// Submit starts a command immediately when limits allow it, otherwise the
+// command is queued and will be started later (Done must be called when a
+// started command exits)
+func (sc *ExecScheduler) Submit(cmd *ExecCommand, execWS *eows.ExecOverWS) error {
+	folderID := cmd.GetInfo().FolderID
+
+	sc.mutex.Lock()
+	// Queued commands are only waiting for their own limits, so a command
+	// that can run doesn't overtake a command that could have run
+	if sc.canRun(folderID) {
+		sc.reserve(folderID)
+		sc.mutex.Unlock()
+
+		if err := execWS.Start(); err != nil {
+			sc.Done(cmd)
+			return err
+		}
+		return nil
+	}
+
+	sc.seq++
+	sc.queue = append(sc.queue, &execJob{cmd: cmd, execWS: execWS, seq: sc.seq})
+	sc.sortQueue()
+	positions := sc.getPositions()
+	nbRunning := sc.nbRunning
+	cmd.mutex.Lock()
+	cmd.info.State = xsapiv1.ExecStateQueued
+	cmd.mutex.Unlock()
+	sc.mutex.Unlock()
+
+	sc.Log.Infof("Command %s queued (%d commands running)", cmd.info.CmdID, nbRunning)
+	sc.emitPositions(positions)
+	return nil
+}
+
+// Done releases the slot used by a command (IOW command exited) and starts
+// queued commands when possible
+func (sc *ExecScheduler) Done(cmd *ExecCommand) {
+	folderID := cmd.GetInfo().FolderID
+
+	sc.mutex.Lock()
+	if sc.running[folderID] > 0 {
+		sc.running[folderID]--
+		if sc.running[folderID] == 0 {
+			delete(sc.running, folderID)
+		}
+	}
+	if sc.nbRunning > 0 {
+		sc.nbRunning--
+	}
+	jobs := sc.popRunnable()
+	positions := sc.getPositions()
+	sc.mutex.Unlock()
+
+	for _, j := range jobs {
+		sc.start(j)
+	}
+	if len(jobs) > 0 {
+		sc.emitPositions(positions)
+	}
+}
+
+// Cancel removes a command from queue
+func (sc *ExecScheduler) Cancel(cmd *ExecCommand) error {
+	sc.mutex.Lock()
+	idx := -1
+	for i, j := range sc.queue {
+		if j.cmd == cmd {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		sc.mutex.Unlock()
+		return errNotQueued
+	}
+	sc.queue = append(sc.queue[:idx], sc.queue[idx+1:]...)
+	positions := sc.getPositions()
+	sc.mutex.Unlock()
+
+	sc.Log.Infof("Command %s removed from queue", cmd.info.CmdID)
+
+	err := fmt.Errorf("command canceled while queued")
+	if errH := cmd.Exit(-1, err); errH != nil {
+		sc.Log.Errorf("Cannot save exit status of command %s: %v", cmd.info.CmdID, errH)
+	}
+	sc.ec.EmitExit(cmd, xsapiv1.ExecExitMsg{
+		CmdID:     cmd.info.CmdID,
+		Timestamp: time.Now().String(),
+		Code:      -1,
+		Error:     err,
+	})
+	sc.emitPositions(positions)
+	return nil
+}
+
+// start starts a command that was queued
+func (sc *ExecScheduler) start(j *execJob) {
+	cmd := j.cmd
+
+	cmd.mutex.Lock()
+	cmd.info.State = xsapiv1.ExecStateRunning
+	cmd.info.StartTime = time.Now()
+	cmd.mutex.Unlock()
+
+	sc.Log.Infof("Start queued command %s", cmd.info.CmdID)
+	sc.ec.Emit(cmd, xsapiv1.ExecStartedEvent, xsapiv1.ExecQueueMsg{
+		CmdID:     cmd.info.CmdID,
+		Timestamp: time.Now().String(),
+		Position:  0,
+	})
+
+	if err := j.execWS.Start(); err != nil {
+		sc.Log.Errorf("Cannot start queued command %s: %v", cmd.info.CmdID, err)
+		if errH := cmd.Exit(-1, err); errH != nil {
+			sc.Log.Errorf("Cannot save exit status of command %s: %v", cmd.info.CmdID, errH)
+		}
+		sc.ec.EmitExit(cmd, xsapiv1.ExecExitMsg{
+			CmdID:     cmd.info.CmdID,
+			Timestamp: time.Now().String(),
+			Code:      -1,
+			Error:     err,
+		})
+		sc.Done(cmd)
+	}
+}
+
+// canRun returns true when limits allow to start a command in a folder
+// (must be called with mutex locked)
+func (sc *ExecScheduler) canRun(folderID string) bool {
+	if sc.maxRunning > 0 && sc.nbRunning >= sc.maxRunning {
+		return false
+	}
+	if sc.maxPerFolder > 0 && sc.running[folderID] >= sc.maxPerFolder {
+		return false
+	}
+	return true
+}
+
+// reserve accounts a started command (must be called with mutex locked)
+func (sc *ExecScheduler) reserve(folderID string) {
+	sc.running[folderID]++
+	sc.nbRunning++
+}
+
+// popRunnable removes from queue and reserves the commands that can be
+// started (must be called with mutex locked)
+func (sc *ExecScheduler) popRunnable() []*execJob {
+	jobs := []*execJob{}
+	queue := []*execJob{}
+	for _, j := range sc.queue {
+		folderID := j.cmd.info.FolderID
+		if sc.canRun(folderID) {
+			sc.reserve(folderID)
+			jobs = append(jobs, j)
+		} else {
+			queue = append(queue, j)
+		}
+	}
+	sc.queue = queue
+	return jobs
+}
+
+// sortQueue sorts queue by insertion order or by priority
+// (must be called with mutex locked)
+func (sc *ExecScheduler) sortQueue() {
+	sort.SliceStable(sc.queue, func(i, j int) bool {
+		qi, qj := sc.queue[i], sc.queue[j]
+		if sc.priority && qi.cmd.info.Priority != qj.cmd.info.Priority {
+			return qi.cmd.info.Priority > qj.cmd.info.Priority
+		}
+		return qi.seq < qj.seq
+	})
+}
+
+// boundExecPriority bounds the priority of a command to [-max, max]
+func boundExecPriority(priority, max int) int {
+	if max < 0 {
+		max = 0
+	}
+	if priority > max {
+		return max
+	}
+	if priority < -max {
+		return -max
+	}
+	return priority
+}
+
+// getPositions returns the queued commands indexed by their position
+// (must be called with mutex locked)
+func (sc *ExecScheduler) getPositions() []*ExecCommand {
+	res := []*ExecCommand{}
+	for _, j := range sc.queue {
+		res = append(res, j.cmd)
+	}
+	return res
+}
+
+// emitPositions emits position in queue to all queued commands
+func (sc *ExecScheduler) emitPositions(cmds []*ExecCommand) {
+	for idx, cmd := range cmds {
+		err := sc.ec.Emit(cmd, xsapiv1.ExecQueuedEvent, xsapiv1.ExecQueueMsg{
+			CmdID:     cmd.info.CmdID,
+			Timestamp: time.Now().String(),
+			Position:  idx + 1,
+		})
+		if err != nil {
+			sc.Log.Errorf("WS Emit : %v", err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// testExecJob A queued command: ID, folder and priority
+type testExecJob struct {
+	id       string
+	folder   string
+	priority int
+}
+
+func TestExecSchedulerOrder(t *testing.T) {
+	jobs := []testExecJob{
+		{"a", "f1", 0},
+		{"b", "f2", 5},
+		{"c", "f1", 5},
+		{"d", "f2", -1},
+		{"e", "f1", 0},
+	}
+	tests := []struct {
+		name         string
+		order        string
+		maxRunning   int
+		maxPerFolder int
+		queued       []string // order of queue
+		started      []string // commands started when a slot of f1 is released
+	}{
+		{"fifo", xdsconfig.ExecQueueFIFO, 1, 0, []string{"a", "b", "c", "d", "e"}, []string{"a"}},
+		{"priority", xdsconfig.ExecQueuePriority, 1, 0, []string{"b", "c", "a", "e", "d"}, []string{"b"}},
+		{"fifo per folder", xdsconfig.ExecQueueFIFO, 0, 1, []string{"a", "b", "c", "d", "e"}, []string{"a", "b"}},
+		{"priority per folder", xdsconfig.ExecQueuePriority, 0, 1, []string{"b", "c", "a", "e", "d"}, []string{"b", "c"}},
+		{"global and per folder", xdsconfig.ExecQueuePriority, 3, 1, []string{"b", "c", "a", "e", "d"}, []string{"b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cleanup := newTestContext(t)
+			defer cleanup()
+			ctx.Config.FileConf.ExecConf.QueueOrder = tt.order
+			ctx.Config.FileConf.ExecConf.MaxRunning = tt.maxRunning
+			ctx.Config.FileConf.ExecConf.MaxRunningPerFolder = tt.maxPerFolder
+			sc, err := NewExecScheduler(ctx, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// One command of f1 running, others queued
+			sc.reserve("f1")
+			for _, j := range jobs {
+				cmd := &ExecCommand{info: xsapiv1.ExecCommandInfo{CmdID: j.id, FolderID: j.folder, Priority: j.priority}}
+				sc.seq++
+				sc.queue = append(sc.queue, &execJob{cmd: cmd, seq: sc.seq})
+				sc.sortQueue()
+			}
+			queued := []string{}
+			for _, cmd := range sc.getPositions() {
+				queued = append(queued, cmd.info.CmdID)
+			}
+			if !reflect.DeepEqual(queued, tt.queued) {
+				t.Errorf("queue = %v, want %v", queued, tt.queued)
+			}
+
+			// Slot of f1 released
+			sc.running["f1"]--
+			sc.nbRunning--
+			started := []string{}
+			for _, j := range sc.popRunnable() {
+				started = append(started, j.cmd.info.CmdID)
+			}
+			if !reflect.DeepEqual(started, tt.started) {
+				t.Errorf("started = %v, want %v", started, tt.started)
+			}
+			if len(sc.queue)+len(started) != len(jobs) {
+				t.Errorf("%d commands queued, want %d", len(sc.queue), len(jobs)-len(started))
+			}
+		})
+	}
+}
+
+func TestExecSchedulerInvalidOrder(t *testing.T) {
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+	ctx.Config.FileConf.ExecConf.QueueOrder = "random"
+	if _, err := NewExecScheduler(ctx, nil); err == nil {
+		t.Errorf("NewExecScheduler() with invalid queue order succeeded")
+	}
+}
+
+func TestBoundExecPriority(t *testing.T) {
+	tests := []struct {
+		priority int
+		max      int
+		want     int
+	}{
+		{0, 10, 0},
+		{10, 10, 10},
+		{11, 10, 10},
+		{1 << 30, 10, 10},
+		{-5, 10, -5},
+		{-1 << 30, 10, -10},
+		{3, 0, 0},
+		{3, -1, 0},
+	}
+	for _, tt := range tests {
+		if got := boundExecPriority(tt.priority, tt.max); got != tt.want {
+			t.Errorf("boundExecPriority(%d, %d) = %d, want %d", tt.priority, tt.max, got, tt.want)
+		}
+	}
+}
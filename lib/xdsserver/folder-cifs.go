@@ -0,0 +1,367 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// IFOLDER interface implementation for CIFS/SMB folders: share is mounted
+// on server using a mount helper (mount.cifs or any user-space equivalent)
+
+// Period of mount health check
+const cifsCheckPeriod = 30 * time.Second
+
+// Max time to access mounted share before considering it as not responding
+const cifsAccessTimeout = 10 * time.Second
+
+// CifsFolder .
+type CifsFolder struct {
+	*Context
+	fConfig xsapiv1.FolderConfig
+	stop    chan struct{}
+	mutex   sync.Mutex
+}
+
+// NewFolderCifs Create a new instance of CifsFolder
+func NewFolderCifs(ctx *Context) *CifsFolder {
+	f := CifsFolder{
+		Context: ctx,
+		fConfig: xsapiv1.FolderConfig{
+			Status: xsapiv1.StatusDisable,
+		},
+		mutex: sync.NewMutex(),
+	}
+	return &f
+}
+
+// NewUID Get a UUID
+func (f *CifsFolder) NewUID(suffix string) string {
+	uuid := uuid.NewV1().String()
+	if len(suffix) > 0 {
+		uuid += "_" + suffix
+	}
+	return uuid
+}
+
+// Add a new folder
+func (f *CifsFolder) Add(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	return f.Setup(cfg)
+}
+
+// Setup Setup local project config
+func (f *CifsFolder) Setup(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	if cfg.DataCifs.Share == "" {
+		return nil, fmt.Errorf("Share must be set")
+	}
+	if !strings.HasPrefix(cfg.DataCifs.Share, "//") {
+		return nil, fmt.Errorf("Invalid share, format must be //server/share")
+	}
+	if cfg.DataCifs.Credentials != "" {
+		if _, exist := f.Config.FileConf.CifsConf.Credentials[cfg.DataCifs.Credentials]; !exist {
+			return nil, fmt.Errorf("Unknown credentials: %s", cfg.DataCifs.Credentials)
+		}
+	}
+
+	// Share is re-mounted when setup changes
+	f.stopMonitor()
+	if mp := f.GetConfig().DataCifs.MountPoint; mp != "" && isMountPoint(mp) {
+		if err := f.umount(mp); err != nil {
+			return nil, err
+		}
+	}
+
+	dir := filepath.Join(f.Config.FileConf.ShareRootDir, "cifs", cfg.ID)
+	if !common.Exists(dir) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("Cannot create mount point directory: %s", dir)
+		}
+	}
+
+	f.mutex.Lock()
+	f.fConfig = cfg
+	f.fConfig.RootPath = dir
+	f.fConfig.DataCifs.MountPoint = dir
+	f.mutex.Unlock()
+
+	// Folder is kept when share cannot be mounted (eg. server not reachable),
+	// mount is retried by health monitor
+	if err := f.mount(); err != nil {
+		f.Log.Warningf("CIFS folder %s not mounted: %v", cfg.ID, err)
+		f.setStatus(xsapiv1.StatusErrorMount, err.Error())
+	} else {
+		f.setStatus(xsapiv1.StatusEnable, "")
+	}
+
+	f.startMonitor()
+
+	fc := f.GetConfig()
+	return &fc, nil
+}
+
+// GetConfig Get public part of folder config
+func (f *CifsFolder) GetConfig() xsapiv1.FolderConfig {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.fConfig
+}
+
+// GetFullPath returns the full path of a directory (from server POV)
+func (f *CifsFolder) GetFullPath(dir string) string {
+	return filepath.Join(f.GetConfig().DataCifs.MountPoint, dir)
+}
+
+// ConvPathCli2Svr Convert path from Client to Server
+func (f *CifsFolder) ConvPathCli2Svr(s string) string {
+	return f.PathConverter().Cli2Svr(s)
+}
+
+// ConvPathSvr2Cli Convert path from Server to Client
+func (f *CifsFolder) ConvPathSvr2Cli(s string) string {
+	return f.PathConverter().Svr2Cli(s)
+}
+
+// PathConverter Get converter of paths between Client and Server
+func (f *CifsFolder) PathConverter() *PathConverter {
+	fc := f.GetConfig()
+	return NewPathConverter(folderPathMappings(fc, fc.DataCifs.MountPoint))
+}
+
+// Remove a folder
+func (f *CifsFolder) Remove() error {
+	f.stopMonitor()
+
+	mp := f.GetConfig().DataCifs.MountPoint
+	if mp == "" {
+		return nil
+	}
+	if isMountPoint(mp) {
+		if err := f.umount(mp); err != nil {
+			return err
+		}
+	}
+	// Only remove empty mount point (never files of share)
+	if err := syscall.Rmdir(mp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Update update some fields of a folder (status is kept as it may be
+// changed by health monitor meanwhile)
+func (f *CifsFolder) Update(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.fConfig.ID != cfg.ID {
+		return nil, fmt.Errorf("Invalid id")
+	}
+	newCfg := f.fConfig
+	if err := folderUpdateFields(&newCfg, cfg); err != nil {
+		return nil, err
+	}
+	f.fConfig = newCfg
+	fc := f.fConfig
+	return &fc, nil
+}
+
+// Sync Force folder files synchronization (IOW check mount)
+func (f *CifsFolder) Sync() error {
+	return f.checkMount()
+}
+
+// IsInSync Check if folder files are in-sync
+func (f *CifsFolder) IsInSync() (bool, error) {
+	// Files are directly accessed in share when mounted
+	return f.GetConfig().Status == xsapiv1.StatusEnable, nil
+}
+
+// mount mounts share
+func (f *CifsFolder) mount() error {
+	cfg := f.Config.FileConf.CifsConf
+	data := f.GetConfig().DataCifs
+	mp := data.MountPoint
+
+	if isMountPoint(mp) {
+		return nil
+	}
+
+	opts := []string{
+		"uid=" + strconv.Itoa(os.Getuid()),
+		"gid=" + strconv.Itoa(os.Getgid()),
+	}
+
+	// Credentials are written in a temporary file to not be visible in
+	// processes list
+	if credName := data.Credentials; credName != "" {
+		cred := cfg.Credentials[credName]
+		fd, err := ioutil.TempFile("", "xds-cifs-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(fd.Name())
+		content := "username=" + cred.Username + "\npassword=" + cred.Password + "\n"
+		if cred.Domain != "" {
+			content += "domain=" + cred.Domain + "\n"
+		}
+		_, err = fd.WriteString(content)
+		fd.Close()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, "credentials="+fd.Name())
+	} else {
+		opts = append(opts, "guest")
+	}
+	if cfg.MountOptions != "" {
+		opts = append(opts, cfg.MountOptions)
+	}
+
+	args := append(strings.Fields(cfg.MountHelper), data.Share, mp, "-o", strings.Join(opts, ","))
+	f.Log.Infof("Mount CIFS share %s on %s", data.Share, mp)
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Cannot mount %s: %v (%s)", data.Share, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// umount unmounts share
+func (f *CifsFolder) umount(mp string) error {
+	args := append(strings.Fields(f.Config.FileConf.CifsConf.UmountHelper), mp)
+	f.Log.Infof("Unmount CIFS share from %s", mp)
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Cannot unmount %s: %v (%s)", mp, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// checkMount checks that share is mounted and responding (share is
+// re-mounted when needed) and updates folder status accordingly
+func (f *CifsFolder) checkMount() error {
+	fc := f.GetConfig()
+	mp := fc.DataCifs.MountPoint
+
+	err := checkDirAccess(mp)
+	if err != nil {
+		f.Log.Warningf("CIFS folder %s not healthy: %v", fc.ID, err)
+		if isMountPoint(mp) {
+			// stale mount: force remount
+			f.umount(mp)
+		}
+		if err = f.mount(); err == nil {
+			err = checkDirAccess(mp)
+		}
+	}
+
+	if err != nil {
+		f.setStatus(xsapiv1.StatusErrorMount, err.Error())
+		return err
+	}
+	f.setStatus(xsapiv1.StatusEnable, "")
+	return nil
+}
+
+// setStatus sets folder status and emits an event when status changed
+func (f *CifsFolder) setStatus(status, mountStatus string) {
+	f.mutex.Lock()
+	changed := f.fConfig.Status != status
+	f.fConfig.Status = status
+	f.fConfig.IsInSync = status == xsapiv1.StatusEnable
+	f.fConfig.DataCifs.MountStatus = mountStatus
+	cfg := f.fConfig
+	f.mutex.Unlock()
+
+	if changed && f.events != nil {
+		if err := f.events.Emit(xsapiv1.EVTFolderStateChange, &cfg, ""); err != nil {
+			f.Log.Warningf("Cannot notify folder change: %v", err)
+		}
+	}
+}
+
+// startMonitor starts periodic check of mount health
+func (f *CifsFolder) startMonitor() {
+	f.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(cifsCheckPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				f.checkMount()
+			}
+		}
+	}(f.stop)
+}
+
+// stopMonitor stops periodic check of mount health
+func (f *CifsFolder) stopMonitor() {
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+}
+
+// isMountPoint returns true when dir is a mount point
+func isMountPoint(dir string) bool {
+	data, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	dir = filepath.Clean(dir)
+	for _, line := range strings.Split(string(data), "\n") {
+		// 5th field is mount point (spaces are escaped as \040)
+		fields := strings.Fields(line)
+		if len(fields) > 4 && strings.Replace(fields[4], "\\040", " ", -1) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDirAccess checks that a mounted directory is readable (a not
+// responding share may block, so access is done with a timeout)
+func checkDirAccess(dir string) error {
+	if !isMountPoint(dir) {
+		return fmt.Errorf("not mounted")
+	}
+	res := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadDir(dir)
+		res <- err
+	}()
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(cifsAccessTimeout):
+		return fmt.Errorf("share not responding")
+	}
+}
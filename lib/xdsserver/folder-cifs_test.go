@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"testing"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+func TestCifsFolderMountFailure(t *testing.T) {
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+	ctx.Config.FileConf.CifsConf.MountHelper = "false"
+	ctx.Config.FileConf.CifsConf.UmountHelper = "false"
+
+	f := NewFolderCifs(ctx)
+	cfg := xsapiv1.FolderConfig{
+		ID:       "cifs-test",
+		Type:     xsapiv1.TypeCifsSmb,
+		DataCifs: xsapiv1.CifsConfig{Share: "//server/share"},
+	}
+
+	// Folder is kept (with an error status) when share cannot be mounted
+	fc, err := f.Setup(cfg)
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	defer f.Remove()
+	if fc.Status != xsapiv1.StatusErrorMount || fc.DataCifs.MountStatus == "" {
+		t.Errorf("Setup() status = %q (%q), want %q", fc.Status, fc.DataCifs.MountStatus, xsapiv1.StatusErrorMount)
+	}
+
+	// Status is not overwritten by update
+	cfg.Status = xsapiv1.StatusEnable
+	if fc, err = f.Update(cfg); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if fc.Status != xsapiv1.StatusErrorMount {
+		t.Errorf("Update() status = %q, want %q", fc.Status, xsapiv1.StatusErrorMount)
+	}
+
+	cfg.ID = "other"
+	if _, err = f.Update(cfg); err == nil {
+		t.Errorf("Update() of another folder succeeded")
+	}
+}
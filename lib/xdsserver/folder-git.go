@@ -0,0 +1,353 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// IFOLDER interface implementation for Git folders: repository is cloned
+// on server side and the requested ref is checked out (no client copy)
+
+// GitFolder .
+type GitFolder struct {
+	*Context
+	fConfig xsapiv1.FolderConfig
+	mutex   sync.Mutex // protect fConfig
+	gitLock sync.Mutex // serialize git operations
+}
+
+// NewFolderGit Create a new instance of GitFolder
+func NewFolderGit(ctx *Context) *GitFolder {
+	f := GitFolder{
+		Context: ctx,
+		fConfig: xsapiv1.FolderConfig{
+			Status: xsapiv1.StatusDisable,
+		},
+		mutex:   sync.NewMutex(),
+		gitLock: sync.NewMutex(),
+	}
+	return &f
+}
+
+// NewUID Get a UUID
+func (f *GitFolder) NewUID(suffix string) string {
+	uuid := uuid.NewV1().String()
+	if len(suffix) > 0 {
+		uuid += "_" + suffix
+	}
+	return uuid
+}
+
+// Add a new folder
+func (f *GitFolder) Add(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	return f.Setup(cfg)
+}
+
+// Setup Setup local project config
+func (f *GitFolder) Setup(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	if cfg.DataGit.URL == "" {
+		return nil, fmt.Errorf("Repository URL must be set")
+	}
+	if err := gitCheckRef(cfg.DataGit.Ref); err != nil {
+		return nil, err
+	}
+
+	f.gitLock.Lock()
+	defer f.gitLock.Unlock()
+
+	dir := filepath.Join(f.Config.FileConf.ShareRootDir, "git", cfg.ID)
+
+	// Re-clone when repository changed
+	if common.Exists(dir) {
+		url, err := f.git(dir, "config", "--get", "remote.origin.url")
+		if err != nil || url != cfg.DataGit.URL {
+			if err := os.RemoveAll(dir); err != nil {
+				return nil, fmt.Errorf("Cannot remove previous clone: %v", err)
+			}
+		}
+	}
+
+	cloned := false
+	if !common.Exists(dir) {
+		if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			return nil, fmt.Errorf("Cannot create directory: %v", err)
+		}
+		f.Log.Infof("Clone %s in %s", cfg.DataGit.URL, dir)
+		if _, err := f.git("", "clone", "--no-checkout", "--", cfg.DataGit.URL, dir); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		cloned = true
+	}
+
+	f.mutex.Lock()
+	f.fConfig = cfg
+	f.fConfig.RootPath = dir
+	f.mutex.Unlock()
+
+	// Files are available as soon as folder is created (files of an existing
+	// clone are kept, for example after a server restart)
+	if err := f.checkout(cloned); err != nil {
+		if cloned {
+			os.RemoveAll(dir)
+		}
+		return nil, err
+	}
+
+	cfgOut := f.GetConfig()
+	return &cfgOut, nil
+}
+
+// GetConfig Get public part of folder config
+func (f *GitFolder) GetConfig() xsapiv1.FolderConfig {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.fConfig
+}
+
+// GetFullPath returns the full path of a directory (from server POV)
+func (f *GitFolder) GetFullPath(dir string) string {
+	return filepath.Join(f.fConfig.RootPath, dir)
+}
+
+// ConvPathCli2Svr Convert path from Client to Server
+func (f *GitFolder) ConvPathCli2Svr(s string) string {
+	return f.PathConverter().Cli2Svr(s)
+}
+
+// ConvPathSvr2Cli Convert path from Server to Client
+func (f *GitFolder) ConvPathSvr2Cli(s string) string {
+	return f.PathConverter().Svr2Cli(s)
+}
+
+// PathConverter Get converter of paths between Client and Server
+func (f *GitFolder) PathConverter() *PathConverter {
+	return NewPathConverter(folderPathMappings(f.fConfig, f.fConfig.RootPath))
+}
+
+// Remove a folder
+func (f *GitFolder) Remove() error {
+	f.gitLock.Lock()
+	defer f.gitLock.Unlock()
+
+	if f.fConfig.RootPath == "" {
+		return nil
+	}
+	// Clone is owned by server, so it can be deleted
+	return os.RemoveAll(f.fConfig.RootPath)
+}
+
+// Update update some fields of a folder (repository URL cannot be changed,
+// requested ref is checked out when changed)
+func (f *GitFolder) Update(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	if f.fConfig.ID != cfg.ID {
+		return nil, fmt.Errorf("Invalid id")
+	}
+	if cfg.DataGit.URL != f.GetConfig().DataGit.URL {
+		return nil, fmt.Errorf("Repository URL cannot be changed")
+	}
+	if err := gitCheckRef(cfg.DataGit.Ref); err != nil {
+		return nil, err
+	}
+
+	f.gitLock.Lock()
+	defer f.gitLock.Unlock()
+
+	f.mutex.Lock()
+	dataGit := f.fConfig.DataGit
+	prevRef := dataGit.Ref
+	if err := folderUpdateFields(&f.fConfig, cfg); err != nil {
+		f.mutex.Unlock()
+		return nil, err
+	}
+	dataGit.Ref = cfg.DataGit.Ref
+	f.fConfig.DataGit = dataGit
+	f.mutex.Unlock()
+
+	if cfg.DataGit.Ref != prevRef {
+		if err := f.fetchCheckout(); err != nil {
+			f.mutex.Lock()
+			f.fConfig.DataGit.Ref = prevRef
+			f.mutex.Unlock()
+			return nil, err
+		}
+	}
+
+	cfgOut := f.GetConfig()
+	return &cfgOut, nil
+}
+
+// Sync Force folder files synchronization: fetch repository and check out
+// requested ref when it moved
+func (f *GitFolder) Sync() error {
+	f.gitLock.Lock()
+	defer f.gitLock.Unlock()
+
+	return f.fetchCheckout()
+}
+
+// fetchCheckout fetches repository and checks out requested ref
+// (must be called with gitLock locked)
+func (f *GitFolder) fetchCheckout() error {
+	dir := f.GetConfig().RootPath
+	f.setStatus(xsapiv1.StatusSyncing, false)
+	if _, err := f.git(dir, "fetch", "--prune", "--tags", "--force", "origin"); err != nil {
+		f.setStatus(xsapiv1.StatusErrorConfig, false)
+		return err
+	}
+	return f.checkout(false)
+}
+
+// IsInSync Check if folder files are in-sync (IOW HEAD is the requested ref)
+func (f *GitFolder) IsInSync() (bool, error) {
+	f.gitLock.Lock()
+	defer f.gitLock.Unlock()
+
+	dir := f.GetConfig().RootPath
+	want, err := f.resolveRef()
+	if err != nil {
+		return false, err
+	}
+	head, err := f.git(dir, "rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return false, err
+	}
+	return head == want, nil
+}
+
+// checkout checks out requested ref (detached) and updates folder status,
+// nothing is done when HEAD is already the requested commit (IOW files
+// modified by commands are kept), unless force is set
+// (must be called with gitLock locked)
+func (f *GitFolder) checkout(force bool) error {
+	cfg := f.GetConfig()
+	dir := cfg.RootPath
+
+	commit, err := f.resolveRef()
+	if err == nil {
+		head, errH := f.git(dir, "rev-parse", "--verify", "--quiet", "HEAD")
+		if force || errH != nil || head != commit {
+			_, err = f.git(dir, "checkout", "--force", "--detach", commit)
+			if err == nil {
+				// submodules are optional, so error is only logged
+				subArgs := []string{"submodule", "update", "--init", "--recursive"}
+				if gitRemoteURL(cfg.DataGit.URL) {
+					// a remote repository must not reference server local repositories
+					subArgs = append([]string{"-c", "protocol.file.allow=never"}, subArgs...)
+				}
+				if _, errSub := f.git(dir, subArgs...); errSub != nil {
+					f.Log.Warningf("Git folder %s: %v", cfg.ID, errSub)
+				}
+			}
+		}
+	}
+	if err != nil {
+		f.setStatus(xsapiv1.StatusErrorConfig, false)
+		return err
+	}
+
+	f.mutex.Lock()
+	f.fConfig.DataGit.Commit = commit
+	f.mutex.Unlock()
+	f.setStatus(xsapiv1.StatusEnable, true)
+	return nil
+}
+
+// resolveRef returns the commit of requested ref: remote branch first,
+// then tag or commit id
+func (f *GitFolder) resolveRef() (string, error) {
+	cfg := f.GetConfig()
+	ref := cfg.DataGit.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	for _, r := range []string{"refs/remotes/origin/" + ref, ref} {
+		if c, err := f.git(cfg.RootPath, "rev-parse", "--verify", "--quiet", r+"^{commit}"); err == nil && c != "" {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown ref '%s' in %s", ref, cfg.DataGit.URL)
+}
+
+// setStatus sets folder status and emits an event when status changed
+func (f *GitFolder) setStatus(status string, inSync bool) {
+	f.mutex.Lock()
+	changed := f.fConfig.Status != status || f.fConfig.IsInSync != inSync
+	f.fConfig.Status = status
+	f.fConfig.IsInSync = inSync
+	cfg := f.fConfig
+	f.mutex.Unlock()
+
+	if changed && f.events != nil {
+		if err := f.events.Emit(xsapiv1.EVTFolderStateChange, &cfg, ""); err != nil {
+			f.Log.Warningf("Cannot notify folder change: %v", err)
+		}
+	}
+}
+
+// gitCheckRef checks ref requested by client
+func gitCheckRef(ref string) error {
+	if strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("Invalid ref: %s", ref)
+	}
+	return nil
+}
+
+var gitScpLikeURL = regexp.MustCompile(`^([^@/:]+@)?[^@/:]+:`)
+
+// gitRemoteURL returns true when url is a network repository (http, https,
+// ssh, git or scp-like syntax) and not a local one (file:// or path) that
+// may be a repository of another user of server
+func gitRemoteURL(url string) bool {
+	if idx := strings.Index(url, "://"); idx > 0 {
+		switch strings.ToLower(url[:idx]) {
+		case "http", "https", "ssh", "git":
+			return true
+		}
+		return false
+	}
+	// <transport>::<address> syntax uses a remote helper
+	if strings.Contains(url, "::") {
+		return false
+	}
+	return gitScpLikeURL.MatchString(url)
+}
+
+// git executes a git command in dir and returns its trimmed output
+func (f *GitFolder) git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	// never prompt for credentials (no terminal)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=true")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %v (%s)", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
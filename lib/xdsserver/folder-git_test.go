@@ -0,0 +1,165 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// gitTestRun executes a git command in dir (test fails on error)
+func gitTestRun(t *testing.T, dir string, args ...string) string {
+	args = append([]string{"-c", "user.name=xds", "-c", "user.email=xds@localhost", "-c", "init.defaultBranch=master"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v (%s)", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// gitTestCommit commits a new content of file.txt and pushes it to origin
+func gitTestCommit(t *testing.T, work, content string) string {
+	if err := ioutil.WriteFile(filepath.Join(work, "file.txt"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitTestRun(t, work, "add", "file.txt")
+	gitTestRun(t, work, "commit", "-q", "-m", content)
+	gitTestRun(t, work, "push", "-q", "origin", "HEAD:master")
+	return gitTestRun(t, work, "rev-parse", "HEAD")
+}
+
+func gitTestContent(t *testing.T, f *GitFolder) string {
+	data, err := ioutil.ReadFile(filepath.Join(f.GetConfig().RootPath, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGitFolder(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+
+	// Local bare repository and a working copy used to push commits
+	tmp := ctx.Config.FileConf.ShareRootDir
+	bare := filepath.Join(tmp, "origin.git")
+	work := filepath.Join(tmp, "work")
+	gitTestRun(t, tmp, "init", "-q", "--bare", bare)
+	gitTestRun(t, tmp, "clone", "-q", bare, work)
+	c1 := gitTestCommit(t, work, "v1")
+
+	f := NewFolderGit(ctx)
+	cfg, err := f.Setup(xsapiv1.FolderConfig{
+		ID:         "git-test",
+		ClientPath: "/home/me/prj",
+		Type:       xsapiv1.TypeGit,
+		DataGit:    xsapiv1.GitConfig{URL: bare},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DataGit.Commit != c1 || gitTestContent(t, f) != "v1" {
+		t.Fatalf("invalid clone: commit %s, content %q", cfg.DataGit.Commit, gitTestContent(t, f))
+	}
+	if sync, err := f.IsInSync(); !sync || err != nil {
+		t.Errorf("IsInSync() = %v, %v", sync, err)
+	}
+
+	// Files modified by a build are kept while requested commit doesn't move
+	if err := ioutil.WriteFile(filepath.Join(cfg.RootPath, "file.txt"), []byte("generated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := gitTestContent(t, f); got != "generated" {
+		t.Errorf("file modified by build reverted by Sync: %q", got)
+	}
+
+	// New upstream commit
+	c2 := gitTestCommit(t, work, "v2")
+	if sync, _ := f.IsInSync(); !sync {
+		t.Errorf("folder must stay in sync until fetched")
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.GetConfig().DataGit.Commit; got != c2 || gitTestContent(t, f) != "v2" {
+		t.Errorf("Sync: commit %s (want %s), content %q", got, c2, gitTestContent(t, f))
+	}
+
+	// Requested ref can be changed
+	upCfg := f.GetConfig()
+	upCfg.DataGit.Ref = c1
+	if _, err := f.Update(upCfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.GetConfig().DataGit.Commit; got != c1 || gitTestContent(t, f) != "v1" {
+		t.Errorf("Update ref: commit %s (want %s), content %q", got, c1, gitTestContent(t, f))
+	}
+	upCfg.DataGit.Ref = "unknown-branch"
+	if _, err := f.Update(upCfg); err == nil {
+		t.Errorf("Update with an unknown ref must fail")
+	}
+	if got := f.GetConfig().DataGit.Ref; got != c1 {
+		t.Errorf("ref not restored after error: %s", got)
+	}
+	upCfg.DataGit.Ref = c1
+	upCfg.DataGit.URL = work
+	if _, err := f.Update(upCfg); err == nil {
+		t.Errorf("Update of repository URL must fail")
+	}
+}
+
+func TestGitRemoteURL(t *testing.T) {
+	tests := []struct {
+		url    string
+		remote bool
+	}{
+		{"https://github.com/iotbzh/xds-server.git", true},
+		{"http://git.example.com/prj.git", true},
+		{"ssh://git@git.example.com:2222/prj.git", true},
+		{"git://git.example.com/prj.git", true},
+		{"git@github.com:iotbzh/xds-server.git", true},
+		{"github.com:iotbzh/xds-server.git", true},
+		{"file:///srv/git/other-team.git", false},
+		{"FILE:///srv/git/other-team.git", false},
+		{"/srv/git/other-team.git", false},
+		{"../other-team.git", false},
+		{"other-team.git", false},
+		{"./host:path", false},
+		{"ext::sh -c touch% /tmp/pwned", false},
+		{"fd::17", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := gitRemoteURL(tt.url); got != tt.remote {
+			t.Errorf("gitRemoteURL(%q) = %v, want %v", tt.url, got, tt.remote)
+		}
+	}
+}
@@ -31,6 +31,7 @@ type IFOLDER interface {
 	GetFullPath(dir string) string                                  // Get folder full path
 	ConvPathCli2Svr(s string) string                                // Convert path from Client to Server
 	ConvPathSvr2Cli(s string) string                                // Convert path from Server to Client
+	PathConverter() *PathConverter                                  // Get converter of paths between Client and Server
 	Remove() error                                                  // Remove a folder
 	Update(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) // Update a new folder
 	Sync() error                                                    // Force folder files synchronization
@@ -0,0 +1,413 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bytes"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+// PathMapping A client path and its equivalent path on server
+type PathMapping struct {
+	ClientPath string
+	ServerPath string
+}
+
+// PathConverter Translate paths between client and server
+//
+// A path is only translated when it matches on path boundaries (IOW
+// /home/me/prj is not translated in /home/me/prj2), and following forms
+// are supported:
+//   - quoted paths and shell escaped paths (eg. /home/me/my\ prj)
+//   - Windows paths using backslash or slash separators, with any drive
+//     letter case and with doubled backslashes (eg. in JSON strings)
+//   - file:// URIs (percent-encoded)
+type PathConverter struct {
+	cli2svr []pathRule
+	svr2cli []pathRule
+}
+
+// pathRule a form of a path (raw, escaped, URI...) and its replacement
+type pathRule struct {
+	from    string
+	to      string
+	fromSep string // separator used in matched path
+	toSep   string // separator to use in translated path
+}
+
+// pathForm a form of a path
+type pathForm struct {
+	str string
+	sep string
+}
+
+// Kinds of path forms (a form is translated into the same kind of form)
+const (
+	pathFormRaw   = "raw"
+	pathFormShell = "shell"
+	pathFormDbl   = "dbl"
+	pathFormURI   = "uri"
+)
+
+var pathFormKinds = []string{pathFormRaw, pathFormShell, pathFormDbl, pathFormURI}
+
+// NewPathConverter creates a new path converter, when several mappings
+// match the same path the longest one is used (IOW a mapping of a
+// sub-directory takes precedence over the mapping of its parent)
+func NewPathConverter(mappings []PathMapping) *PathConverter {
+	pc := PathConverter{
+		cli2svr: []pathRule{},
+		svr2cli: []pathRule{},
+	}
+	for _, m := range mappings {
+		if m.ClientPath == "" || m.ServerPath == "" {
+			continue
+		}
+		cliForms := getPathForms(m.ClientPath)
+		svrForms := getPathForms(m.ServerPath)
+		pc.cli2svr = append(pc.cli2svr, getPathRules(cliForms, svrForms)...)
+		pc.svr2cli = append(pc.svr2cli, getPathRules(svrForms, cliForms)...)
+	}
+	sortPathRules(pc.cli2svr)
+	sortPathRules(pc.svr2cli)
+	return &pc
+}
+
+// folderPathMappings returns the path mappings of a folder: main mapping
+// (client path and its equivalent server path) and then additional ones
+func folderPathMappings(cfg xsapiv1.FolderConfig, serverPath string) []PathMapping {
+	res := []PathMapping{}
+	if cfg.ClientPath != "" && serverPath != "" {
+		res = append(res, PathMapping{ClientPath: cfg.ClientPath, ServerPath: serverPath})
+	}
+	for _, m := range cfg.PathMappings {
+		res = append(res, PathMapping{ClientPath: m.ClientPath, ServerPath: m.ServerPath})
+	}
+	return res
+}
+
+// Cli2Svr translates paths from client to server
+func (pc *PathConverter) Cli2Svr(s string) string {
+	st := pc.Cli2SvrStream()
+	return st.Write(s) + st.Flush()
+}
+
+// Svr2Cli translates paths from server to client
+func (pc *PathConverter) Svr2Cli(s string) string {
+	st := pc.Svr2CliStream()
+	return st.Write(s) + st.Flush()
+}
+
+// Cli2SvrStream returns a new stream translating paths from client to server
+func (pc *PathConverter) Cli2SvrStream() *PathConvStream {
+	return &PathConvStream{rules: pc.cli2svr}
+}
+
+// Svr2CliStream returns a new stream translating paths from server to client
+func (pc *PathConverter) Svr2CliStream() *PathConvStream {
+	return &PathConvStream{rules: pc.svr2cli}
+}
+
+// PathConvStream Translate paths of a stream split in several chunks (a
+// path may be split between two chunks)
+type PathConvStream struct {
+	rules   []pathRule
+	pending string    // end of previous chunk that may be the beginning of a path
+	token   *pathRule // rule of a translated path whose separators are still converted
+}
+
+// Write translates a chunk, the end of chunk that may be a part of a path
+// is kept till next chunk (or Flush call)
+func (st *PathConvStream) Write(s string) string {
+	return st.convert(st.pending+s, false)
+}
+
+// Flush returns data kept from previous chunk (to be called at end of stream)
+func (st *PathConvStream) Flush() string {
+	res := st.convert(st.pending, true)
+	st.token = nil
+	return res
+}
+
+// convert translates data, when final is false the end of data that may be
+// a part of a path is kept in pending
+func (st *PathConvStream) convert(s string, final bool) string {
+	st.pending = ""
+	if len(st.rules) == 0 {
+		return s
+	}
+
+	var out bytes.Buffer
+	i := 0
+
+	// Continue conversion of separators of a path started in previous chunk
+	if st.token != nil {
+		var done bool
+		if i, done = st.convertSeps(&out, s, 0, final); !done {
+			st.pending = s[i:]
+			return out.String()
+		}
+	}
+
+	for i < len(s) {
+		matched, hold := false, false
+		if pathBoundaryBefore(s, i) {
+			for idx := range st.rules {
+				r := &st.rules[idx]
+				m, h := r.match(s, i, final)
+				if h {
+					hold = true
+					break
+				}
+				if m {
+					out.WriteString(r.to)
+					i += len(r.from)
+					matched = true
+					if r.fromSep != r.toSep {
+						st.token = r
+						var done bool
+						if i, done = st.convertSeps(&out, s, i, final); !done {
+							st.pending = s[i:]
+							return out.String()
+						}
+					}
+					break
+				}
+			}
+		}
+		if hold {
+			st.pending = s[i:]
+			return out.String()
+		}
+		if !matched {
+			out.WriteByte(s[i])
+			i++
+		}
+	}
+	return out.String()
+}
+
+// convertSeps converts separators of the remaining part of a translated
+// path, returns the index of path end and false when end of data is reached
+// before path end (IOW path continues in next chunk)
+func (st *PathConvStream) convertSeps(out *bytes.Buffer, s string, i int, final bool) (int, bool) {
+	r := st.token
+	for i < len(s) {
+		if strings.HasPrefix(s[i:], r.fromSep) {
+			out.WriteString(r.toSep)
+			i += len(r.fromSep)
+		} else if !final && strings.HasPrefix(r.fromSep, s[i:]) {
+			// separator split between chunks
+			return i, false
+		} else if isPathChar(s[i]) && !(s[i] == '.' && !isPathCharAt(s, i+1, true)) {
+			out.WriteByte(s[i])
+			i++
+		} else {
+			st.token = nil
+			return i, true
+		}
+	}
+	if final {
+		st.token = nil
+		return i, true
+	}
+	return i, false
+}
+
+// match checks whether rule matches at index i of s, hold is true when
+// there isn't enough data to decide
+func (r *pathRule) match(s string, i int, final bool) (match bool, hold bool) {
+	rest := s[i:]
+	if len(rest) < len(r.from) {
+		return false, !final && strings.HasPrefix(r.from, rest)
+	}
+	if !strings.HasPrefix(rest, r.from) {
+		return false, false
+	}
+
+	// Check path boundary after matched path
+	k := i + len(r.from)
+	if k == len(s) {
+		return final, !final
+	}
+	if strings.HasPrefix(s[k:], r.fromSep) {
+		return true, false
+	}
+	if !final && strings.HasPrefix(r.fromSep, s[k:]) {
+		return false, true
+	}
+	if s[k] == '.' {
+		// end of sentence (eg. "see /home/me/prj.") vs /home/me/prj.old
+		if k+1 == len(s) {
+			return final, !final
+		}
+		return !isPathChar(s[k+1]), false
+	}
+	return !isPathChar(s[k]), false
+}
+
+// pathBoundaryBefore returns true when a path may start at index i
+func pathBoundaryBefore(s string, i int) bool {
+	if i == 0 || !isPathChar(s[i-1]) {
+		return true
+	}
+	// Allow paths glued to short options (eg. -I/home/me/prj/include)
+	j := i - 1
+	for j >= 0 && isLetter(s[j]) {
+		j--
+	}
+	return j >= 0 && j < i-1 && s[j] == '-' && (j == 0 || !isPathChar(s[j-1]))
+}
+
+// isPathChar returns true when c may be a part of a path
+func isPathChar(c byte) bool {
+	return isLetter(c) || (c >= '0' && c <= '9') || strings.IndexByte("/\\._-~+@%", c) >= 0
+}
+
+// isPathCharAt same as isPathChar for s[i] (dflt is returned when out of range)
+func isPathCharAt(s string, i int, dflt bool) bool {
+	if i >= len(s) {
+		return dflt
+	}
+	return isPathChar(s[i])
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isWindowsPath returns true when path is a Windows path (eg. C:\Users\me)
+func isWindowsPath(p string) bool {
+	return (len(p) >= 2 && isLetter(p[0]) && p[1] == ':') || strings.Contains(p, "\\")
+}
+
+// getPathForms returns the different forms (by kind) of a path, the first
+// form of each kind is the one used when path is the translation result
+func getPathForms(p string) map[string][]pathForm {
+	forms := make(map[string][]pathForm)
+
+	if isWindowsPath(p) {
+		p = strings.TrimRight(p, "\\/")
+		native := "/"
+		if strings.Contains(p, "\\") {
+			native = "\\"
+		}
+		bs := strings.Replace(p, "/", "\\", -1)
+		sl := strings.Replace(p, "\\", "/", -1)
+		raw := []pathForm{{bs, "\\"}, {sl, "/"}}
+		if native == "/" {
+			raw = []pathForm{{sl, "/"}, {bs, "\\"}}
+		}
+		dbl := pathForm{strings.Replace(bs, "\\", "\\\\", -1), "\\\\"}
+		uri := pathForm{"file:///" + uriEscapePath(sl), "/"}
+
+		// Drive letter is case insensitive
+		for _, f := range append(raw, dbl, uri) {
+			kind := pathFormRaw
+			if f == dbl {
+				kind = pathFormDbl
+			} else if f == uri {
+				kind = pathFormURI
+			}
+			forms[kind] = append(forms[kind], f)
+			if alt := swapDriveCase(f.str); alt != f.str {
+				forms[kind] = append(forms[kind], pathForm{alt, f.sep})
+			}
+		}
+		return forms
+	}
+
+	if p != "/" {
+		p = strings.TrimRight(p, "/")
+	}
+	forms[pathFormRaw] = []pathForm{{p, "/"}}
+	if esc := shellEscapePath(p); esc != p {
+		forms[pathFormShell] = []pathForm{{esc, "/"}}
+	}
+	forms[pathFormURI] = []pathForm{{"file://" + uriEscapePath(p), "/"}}
+	return forms
+}
+
+// getPathRules returns the rules translating forms of a path into forms of
+// another path (longest forms first)
+func getPathRules(from, to map[string][]pathForm) []pathRule {
+	rules := []pathRule{}
+	for _, kind := range pathFormKinds {
+		dst, exist := to[kind]
+		if !exist {
+			dst = to[pathFormRaw]
+		}
+		for _, f := range from[kind] {
+			rules = append(rules, pathRule{
+				from:    f.str,
+				to:      dst[0].str,
+				fromSep: f.sep,
+				toSep:   dst[0].sep,
+			})
+		}
+	}
+	return rules
+}
+
+// sortPathRules sorts rules by decreasing length of matched path, so that
+// longest path is matched first
+func sortPathRules(rules []pathRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].from) > len(rules[j].from)
+	})
+}
+
+// shellEscapePath escapes characters of a path that must be escaped in shell
+func shellEscapePath(p string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(p); i++ {
+		if strings.IndexByte(" \t'\"()&;|<>$`!*?[]{}#", p[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
+
+// uriEscapePath percent-encodes a path to be used in a file:// URI
+func uriEscapePath(p string) string {
+	u := url.URL{Path: p}
+	return strings.TrimPrefix(u.EscapedPath(), "./")
+}
+
+// swapDriveCase swaps case of drive letter of a Windows path (if any)
+func swapDriveCase(p string) string {
+	idx := 0
+	if strings.HasPrefix(p, "file:///") {
+		idx = len("file:///")
+	}
+	if len(p) < idx+2 || !isLetter(p[idx]) || p[idx+1] != ':' {
+		return p
+	}
+	c := p[idx]
+	if c >= 'a' && c <= 'z' {
+		c = c - 'a' + 'A'
+	} else {
+		c = c - 'A' + 'a'
+	}
+	return p[:idx] + string(c) + p[idx+1:]
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"testing"
+)
+
+func TestPathConverter(t *testing.T) {
+	linux := []PathMapping{
+		{ClientPath: "/home/me/prj", ServerPath: "/srv/xds/prj"},
+		{ClientPath: "/home/me/prj/build", ServerPath: "/srv/xds/build"},
+		{ClientPath: "/home/me/my prj", ServerPath: "/srv/xds/other"},
+	}
+	windows := []PathMapping{
+		{ClientPath: `C:\Users\me\prj`, ServerPath: "/srv/xds/prj"},
+	}
+	tests := []struct {
+		name     string
+		mappings []PathMapping
+		cli      string
+		svr      string
+	}{
+		{"path", linux, "/home/me/prj/src/main.c", "/srv/xds/prj/src/main.c"},
+		{"root", linux, "cd /home/me/prj", "cd /srv/xds/prj"},
+		{"boundary", linux, "/home/me/prj2/main.c", "/home/me/prj2/main.c"},
+		{"not at start", linux, "/opt/home/me/prj", "/opt/home/me/prj"},
+		{"nested mapping", linux, "/home/me/prj/build/out.o", "/srv/xds/build/out.o"},
+		{"nested prefix", linux, "/home/me/prj/builds/out.o", "/srv/xds/prj/builds/out.o"},
+		{"end of sentence", linux, "see /home/me/prj.", "see /srv/xds/prj."},
+		{"dot suffix", linux, "/home/me/prj.old", "/home/me/prj.old"},
+		{"quoted", linux, `"/home/me/prj/a.c"`, `"/srv/xds/prj/a.c"`},
+		{"option", linux, "-I/home/me/prj/include", "-I/srv/xds/prj/include"},
+		{"several", linux, "/home/me/prj/a.c:12: see /home/me/prj/b.h", "/srv/xds/prj/a.c:12: see /srv/xds/prj/b.h"},
+		{"shell escaped", linux, `/home/me/my\ prj/a.c`, "/srv/xds/other/a.c"},
+		{"uri", linux, "file:///home/me/my%20prj/a.c", "file:///srv/xds/other/a.c"},
+		{"windows", windows, `C:\Users\me\prj\src\main.c`, "/srv/xds/prj/src/main.c"},
+		{"windows slashes", windows, "C:/Users/me/prj/src/main.c", "/srv/xds/prj/src/main.c"},
+		{"windows drive case", windows, `c:\Users\me\prj\main.c`, "/srv/xds/prj/main.c"},
+		{"windows json", windows, `{"file":"C:\\Users\\me\\prj\\main.c"}`, `{"file":"/srv/xds/prj/main.c"}`},
+		{"windows uri", windows, "file:///C:/Users/me/prj/main.c", "file:///srv/xds/prj/main.c"},
+		{"no mapping", nil, "/home/me/prj", "/home/me/prj"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := NewPathConverter(tt.mappings)
+			if got := pc.Cli2Svr(tt.cli); got != tt.svr {
+				t.Errorf("Cli2Svr(%q) = %q, want %q", tt.cli, got, tt.svr)
+			}
+		})
+	}
+}
+
+func TestPathConverterSvr2Cli(t *testing.T) {
+	pc := NewPathConverter([]PathMapping{
+		{ClientPath: `C:\Users\me\prj`, ServerPath: "/srv/xds/prj"},
+		{ClientPath: `C:\Users\me\sdk`, ServerPath: "/srv/xds/prj/sdk"},
+	})
+	tests := []struct {
+		svr string
+		cli string
+	}{
+		{"/srv/xds/prj/src/main.c:3: error", `C:\Users\me\prj\src\main.c:3: error`},
+		{"/srv/xds/prj/sdk/include/stdio.h", `C:\Users\me\sdk\include\stdio.h`},
+		{"/srv/xds/prj2/a.c", "/srv/xds/prj2/a.c"},
+	}
+	for _, tt := range tests {
+		if got := pc.Svr2Cli(tt.svr); got != tt.cli {
+			t.Errorf("Svr2Cli(%q) = %q, want %q", tt.svr, got, tt.cli)
+		}
+	}
+}
+
+func TestPathConvStream(t *testing.T) {
+	pc := NewPathConverter([]PathMapping{{ClientPath: `C:\Users\me\prj`, ServerPath: "/srv/xds/prj"}})
+	in := "/srv/xds/prj/src/main.c:3: error\n/srv/xds/prj2/a.c\n"
+	want := pc.Svr2Cli(in)
+
+	// Same result whatever the split of data in chunks
+	for size := 1; size <= len(in); size++ {
+		st := pc.Svr2CliStream()
+		got := ""
+		for i := 0; i < len(in); i += size {
+			end := i + size
+			if end > len(in) {
+				end = len(in)
+			}
+			got += st.Write(in[i:end])
+		}
+		got += st.Flush()
+		if got != want {
+			t.Errorf("chunks of %d bytes: got %q, want %q", size, got, want)
+		}
+	}
+}
@@ -22,7 +22,6 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 
 	common "github.com/iotbzh/xds-common/golib"
 	"github.com/iotbzh/xds-server/lib/xsapiv1"
@@ -142,24 +141,17 @@ func (f *PathMap) GetFullPath(dir string) string {
 
 // ConvPathCli2Svr Convert path from Client to Server
 func (f *PathMap) ConvPathCli2Svr(s string) string {
-	if f.fConfig.ClientPath != "" && f.fConfig.DataPathMap.ServerPath != "" {
-		return strings.Replace(s,
-			f.fConfig.ClientPath,
-			f.fConfig.DataPathMap.ServerPath,
-			-1)
-	}
-	return s
+	return f.PathConverter().Cli2Svr(s)
 }
 
 // ConvPathSvr2Cli Convert path from Server to Client
 func (f *PathMap) ConvPathSvr2Cli(s string) string {
-	if f.fConfig.ClientPath != "" && f.fConfig.DataPathMap.ServerPath != "" {
-		return strings.Replace(s,
-			f.fConfig.DataPathMap.ServerPath,
-			f.fConfig.ClientPath,
-			-1)
-	}
-	return s
+	return f.PathConverter().Svr2Cli(s)
+}
+
+// PathConverter Get converter of paths between Client and Server
+func (f *PathMap) PathConverter() *PathConverter {
+	return NewPathConverter(folderPathMappings(f.fConfig, f.fConfig.DataPathMap.ServerPath))
 }
 
 // Remove a folder
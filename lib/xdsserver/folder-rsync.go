@@ -0,0 +1,698 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	common "github.com/iotbzh/xds-common/golib"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// IFOLDER interface implementation for RsyncHTTP folders: client pushes
+// the manifest of folder files and uploads deltas of modified files using
+// REST API (see apiv1-rsync.go)
+
+// Block size used for signatures
+const (
+	rsyncDefaultBlockSize = 4096
+	rsyncMinBlockSize     = 512
+	rsyncMaxBlockSize     = 1024 * 1024
+)
+
+// Max size of a delta request and of its literal data (bigger files are
+// uploaded with several deltas, each one reusing blocks of the previous one)
+const (
+	rsyncMaxDeltaRequest = 64 * 1024 * 1024
+	rsyncMaxDeltaLiteral = 32 * 1024 * 1024
+)
+
+// rsyncCacheEntry hash of a file, valid while size and mtime don't change
+type rsyncCacheEntry struct {
+	size  int64
+	mtime time.Time
+	hash  string
+}
+
+// rsyncManifestFile manifest saved on disk
+type rsyncManifestFile struct {
+	Version int64                             `json:"version"`
+	Files   map[string]xsapiv1.RsyncFileEntry `json:"files"`
+}
+
+// RsyncFolder .
+type RsyncFolder struct {
+	*Context
+	fConfig  xsapiv1.FolderConfig
+	manifest rsyncManifestFile
+	cache    map[string]rsyncCacheEntry
+	mutex    sync.Mutex // protect fConfig
+	opLock   sync.Mutex // serialize files operations
+}
+
+// NewFolderRsync Create a new instance of RsyncFolder
+func NewFolderRsync(ctx *Context) *RsyncFolder {
+	f := RsyncFolder{
+		Context: ctx,
+		fConfig: xsapiv1.FolderConfig{
+			Status: xsapiv1.StatusDisable,
+		},
+		cache:  make(map[string]rsyncCacheEntry),
+		mutex:  sync.NewMutex(),
+		opLock: sync.NewMutex(),
+	}
+	return &f
+}
+
+// NewUID Get a UUID
+func (f *RsyncFolder) NewUID(suffix string) string {
+	uuid := uuid.NewV1().String()
+	if len(suffix) > 0 {
+		uuid += "_" + suffix
+	}
+	return uuid
+}
+
+// Add a new folder
+func (f *RsyncFolder) Add(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	return f.Setup(cfg)
+}
+
+// Setup Setup local project config
+func (f *RsyncFolder) Setup(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	f.opLock.Lock()
+	defer f.opLock.Unlock()
+
+	dir := filepath.Join(f.Config.FileConf.ShareRootDir, "rsync", cfg.ID)
+	if !common.Exists(dir) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("Cannot create folder directory: %v", err)
+		}
+	}
+
+	f.mutex.Lock()
+	f.fConfig = cfg
+	f.fConfig.RootPath = dir
+	f.mutex.Unlock()
+
+	// Manifest pushed before restart
+	f.manifest = rsyncManifestFile{Files: make(map[string]xsapiv1.RsyncFileEntry)}
+	if data, err := ioutil.ReadFile(f.manifestFile()); err == nil {
+		if err := json.Unmarshal(data, &f.manifest); err != nil {
+			f.Log.Warningf("Invalid manifest of folder %s: %v", cfg.ID, err)
+		}
+		if f.manifest.Files == nil {
+			f.manifest.Files = make(map[string]xsapiv1.RsyncFileEntry)
+		}
+	}
+
+	if _, err := f.status(); err != nil {
+		return nil, err
+	}
+
+	cfgOut := f.GetConfig()
+	return &cfgOut, nil
+}
+
+// GetConfig Get public part of folder config
+func (f *RsyncFolder) GetConfig() xsapiv1.FolderConfig {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.fConfig
+}
+
+// GetFullPath returns the full path of a directory (from server POV)
+func (f *RsyncFolder) GetFullPath(dir string) string {
+	return filepath.Join(f.fConfig.RootPath, dir)
+}
+
+// ConvPathCli2Svr Convert path from Client to Server
+func (f *RsyncFolder) ConvPathCli2Svr(s string) string {
+	return f.PathConverter().Cli2Svr(s)
+}
+
+// ConvPathSvr2Cli Convert path from Server to Client
+func (f *RsyncFolder) ConvPathSvr2Cli(s string) string {
+	return f.PathConverter().Svr2Cli(s)
+}
+
+// PathConverter Get converter of paths between Client and Server
+func (f *RsyncFolder) PathConverter() *PathConverter {
+	return NewPathConverter(folderPathMappings(f.fConfig, f.fConfig.RootPath))
+}
+
+// Remove a folder
+func (f *RsyncFolder) Remove() error {
+	f.opLock.Lock()
+	defer f.opLock.Unlock()
+
+	if f.fConfig.RootPath == "" {
+		return nil
+	}
+	if err := os.Remove(f.manifestFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Files are owned by server (uploaded by client), so they can be deleted
+	return os.RemoveAll(f.fConfig.RootPath)
+}
+
+// Update update some fields of a folder
+func (f *RsyncFolder) Update(cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+	if f.fConfig.ID != cfg.ID {
+		return nil, fmt.Errorf("Invalid id")
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.fConfig = cfg
+	return &f.fConfig, nil
+}
+
+// Sync Update folder status (files are uploaded by client, so nothing is
+// modified here: files to upload are reported by GetStatus)
+func (f *RsyncFolder) Sync() error {
+	f.opLock.Lock()
+	defer f.opLock.Unlock()
+
+	_, err := f.status()
+	return err
+}
+
+// IsInSync Check if folder files are in-sync (IOW match manifest)
+func (f *RsyncFolder) IsInSync() (bool, error) {
+	f.opLock.Lock()
+	defer f.opLock.Unlock()
+
+	st, err := f.status()
+	if err != nil {
+		return false, err
+	}
+	return st.IsInSync, nil
+}
+
+// GetStatus returns files on server and differences with manifest
+func (f *RsyncFolder) GetStatus() (*xsapiv1.RsyncStatus, error) {
+	f.opLock.Lock()
+	defer f.opLock.Unlock()
+
+	return f.status()
+}
+
+// SetManifest sets the manifest of folder: files of previous manifest that
+// are not part of new one are removed (files created on server, for example
+// build outputs, are kept)
+func (f *RsyncFolder) SetManifest(m xsapiv1.RsyncManifest) (*xsapiv1.RsyncStatus, error) {
+	f.opLock.Lock()
+	defer f.opLock.Unlock()
+
+	if m.Files == nil {
+		m.Files = make(map[string]xsapiv1.RsyncFileEntry)
+	}
+	for p, e := range m.Files {
+		if _, err := f.filePath(p); err != nil {
+			return nil, err
+		}
+		if e.Size < 0 || len(e.Hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("Invalid entry of file %s", p)
+		}
+	}
+
+	prev := f.manifest.Files
+	f.manifest.Version++
+	f.manifest.Files = m.Files
+	if err := f.saveManifest(); err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	for p := range prev {
+		if _, exist := m.Files[p]; exist {
+			continue
+		}
+		full, err := f.filePath(p)
+		if err != nil {
+			continue
+		}
+		if st, err := os.Lstat(full); err != nil || !st.Mode().IsRegular() {
+			continue
+		}
+		if err := os.Remove(full); err != nil {
+			f.Log.Warningf("Cannot remove %s: %v", full, err)
+			continue
+		}
+		delete(f.cache, p)
+		removed = append(removed, p)
+		f.pruneDirs(filepath.Dir(full))
+	}
+
+	st, err := f.status()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(removed)
+	st.Removed = removed
+
+	// Fix permissions of files which content is up-to-date
+	for p, e := range m.Files {
+		cur, exist := st.Files[p]
+		if !exist || cur.Hash != e.Hash || e.Mode == 0 || cur.Mode == e.Mode&uint32(os.ModePerm) {
+			continue
+		}
+		full, _ := f.filePath(p)
+		if err := os.Chmod(full, os.FileMode(e.Mode)&os.ModePerm); err == nil {
+			cur.Mode = e.Mode & uint32(os.ModePerm)
+			st.Files[p] = cur
+		}
+	}
+
+	return st, nil
+}
+
+// Signature returns the blocks checksums of a file
+func (f *RsyncFolder) Signature(rel string, blockSize int) (*xsapiv1.RsyncSignature, error) {
+	if blockSize == 0 {
+		blockSize = rsyncDefaultBlockSize
+	}
+	if blockSize < rsyncMinBlockSize || blockSize > rsyncMaxBlockSize {
+		return nil, fmt.Errorf("Invalid block size (must be between %d and %d)", rsyncMinBlockSize, rsyncMaxBlockSize)
+	}
+
+	f.opLock.Lock()
+	defer f.opLock.Unlock()
+
+	full, err := f.filePath(rel)
+	if err != nil {
+		return nil, err
+	}
+	fd, st, err := rsyncOpenFile(full)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	sig := xsapiv1.RsyncSignature{
+		Path:      rel,
+		Size:      st.Size(),
+		BlockSize: blockSize,
+		Blocks:    []xsapiv1.RsyncBlockSum{},
+	}
+	h := sha256.New()
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(fd, buf)
+		if n > 0 {
+			blk := buf[:n]
+			h.Write(blk)
+			strong := sha256.Sum256(blk)
+			sig.Blocks = append(sig.Blocks, xsapiv1.RsyncBlockSum{
+				Weak:   rsyncWeakSum(blk),
+				Strong: hex.EncodeToString(strong[:]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	sig.Hash = hex.EncodeToString(h.Sum(nil))
+	f.cache[rel] = rsyncCacheEntry{size: st.Size(), mtime: st.ModTime(), hash: sig.Hash}
+
+	return &sig, nil
+}
+
+// ApplyDelta rebuilds a file from blocks of its current version and
+// literal data uploaded by client
+func (f *RsyncFolder) ApplyDelta(args xsapiv1.RsyncDeltaArgs) (*xsapiv1.RsyncStatus, error) {
+	f.opLock.Lock()
+	defer f.opLock.Unlock()
+
+	full, err := f.filePath(args.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(args.File.Hash) != sha256.Size*2 || args.File.Size < 0 {
+		return nil, fmt.Errorf("Invalid file hash or size")
+	}
+	literal := 0
+	for _, op := range args.Ops {
+		literal += len(op.Data)
+	}
+	if literal > rsyncMaxDeltaLiteral {
+		return nil, fmt.Errorf("Literal data too big (max %d bytes)", rsyncMaxDeltaLiteral)
+	}
+
+	// Base file is only needed when some blocks are copied
+	var base *os.File
+	var baseSize int64
+	size := int64(literal)
+	for _, op := range args.Ops {
+		if len(op.Data) > 0 {
+			continue
+		}
+		if base == nil {
+			if args.BlockSize < rsyncMinBlockSize || args.BlockSize > rsyncMaxBlockSize {
+				return nil, fmt.Errorf("Invalid block size")
+			}
+			hash, err := f.fileHash(args.Path, full)
+			if err != nil {
+				return nil, err
+			}
+			if hash != args.BaseHash {
+				return nil, fmt.Errorf("File %s changed since signature was computed", args.Path)
+			}
+			var st os.FileInfo
+			if base, st, err = rsyncOpenFile(full); err != nil {
+				return nil, err
+			}
+			defer base.Close()
+			baseSize = st.Size()
+		}
+		bs := int64(args.BlockSize)
+		nBlocks := (baseSize + bs - 1) / bs
+		if op.Block < 0 || op.Count <= 0 || int64(op.Block) >= nBlocks || int64(op.Count) > nBlocks-int64(op.Block) {
+			return nil, fmt.Errorf("Invalid blocks range %d+%d", op.Block, op.Count)
+		}
+		start := int64(op.Block) * bs
+		if n := int64(op.Count) * bs; start+n < baseSize {
+			size += n
+		} else {
+			size += baseSize - start
+		}
+	}
+	// Don't write more than expected (blocks may be copied several times)
+	if size != args.File.Size {
+		return nil, fmt.Errorf("Delta of %s doesn't match file size (%d != %d)", args.Path, size, args.File.Size)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(full), ".xds-rsync-")
+	if err != nil {
+		return nil, err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	h := sha256.New()
+	w := io.MultiWriter(tmp, h)
+	size = 0
+	for _, op := range args.Ops {
+		var n int64
+		if len(op.Data) > 0 {
+			var nw int
+			nw, err = w.Write(op.Data)
+			n = int64(nw)
+		} else {
+			bs := int64(args.BlockSize)
+			n, err = io.Copy(w, io.NewSectionReader(base, int64(op.Block)*bs, int64(op.Count)*bs))
+		}
+		size += n
+		if err != nil {
+			tmp.Close()
+			return nil, err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	if size != args.File.Size || hash != args.File.Hash {
+		return nil, fmt.Errorf("Checksum mismatch of %s (size %d, hash %s)", args.Path, size, hash)
+	}
+
+	mode := os.FileMode(args.File.Mode) & os.ModePerm
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := os.Chmod(tmpName, mode); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpName, full); err != nil {
+		return nil, err
+	}
+	if args.File.Mtime > 0 {
+		mtime := time.Unix(args.File.Mtime, 0)
+		os.Chtimes(full, mtime, mtime)
+	}
+	if st, err := os.Stat(full); err == nil {
+		f.cache[args.Path] = rsyncCacheEntry{size: st.Size(), mtime: st.ModTime(), hash: hash}
+	}
+
+	return f.status(args.Path)
+}
+
+// status compares files on server with manifest and updates folder status;
+// only files of manifest and extra files (eg. file just uploaded) are checked
+// (must be called with opLock locked)
+func (f *RsyncFolder) status(extra ...string) (*xsapiv1.RsyncStatus, error) {
+	files, err := f.scan(extra)
+	if err != nil {
+		f.setStatus(xsapiv1.StatusErrorConfig, false)
+		return nil, err
+	}
+
+	st := xsapiv1.RsyncStatus{
+		Version: f.manifest.Version,
+		Files:   files,
+		Missing: []string{},
+		Removed: []string{},
+	}
+
+	for p, e := range f.manifest.Files {
+		cur, exist := files[p]
+		if !exist || cur.Hash != e.Hash {
+			st.Missing = append(st.Missing, p)
+		}
+	}
+
+	// Files that are not part of manifest (eg. build outputs) are ignored
+	sort.Strings(st.Missing)
+	st.IsInSync = f.manifest.Version > 0 && len(st.Missing) == 0
+
+	if st.IsInSync {
+		f.setStatus(xsapiv1.StatusEnable, true)
+	} else {
+		f.setStatus(xsapiv1.StatusSyncing, false)
+	}
+
+	return &st, nil
+}
+
+// scan returns regular files of manifest and extra files present on server
+// (hashes are cached, so unchanged files are not read again)
+func (f *RsyncFolder) scan(extra []string) (map[string]xsapiv1.RsyncFileEntry, error) {
+	root := f.GetConfig().RootPath
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]xsapiv1.RsyncFileEntry)
+	check := func(rel string) error {
+		if _, done := files[rel]; done {
+			return nil
+		}
+		// Files outside folder (eg. through a symlink) are considered missing
+		full, err := f.filePath(rel)
+		if err != nil {
+			return nil
+		}
+		info, err := os.Lstat(full)
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		hash, err := f.fileHash(rel, full)
+		if err != nil {
+			return err
+		}
+		files[rel] = xsapiv1.RsyncFileEntry{
+			Size:  info.Size(),
+			Mode:  uint32(info.Mode() & os.ModePerm),
+			Mtime: info.ModTime().Unix(),
+			Hash:  hash,
+		}
+		return nil
+	}
+
+	for p := range f.manifest.Files {
+		if err := check(p); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range extra {
+		if err := check(p); err != nil {
+			return nil, err
+		}
+	}
+
+	for p := range f.cache {
+		if _, exist := files[p]; !exist {
+			delete(f.cache, p)
+		}
+	}
+	return files, nil
+}
+
+// fileHash returns hash of a file (computed only when file changed)
+func (f *RsyncFolder) fileHash(rel, full string) (string, error) {
+	st, err := os.Lstat(full)
+	if err != nil {
+		return "", err
+	}
+	if c, exist := f.cache[rel]; exist && c.size == st.Size() && c.mtime.Equal(st.ModTime()) {
+		return c.hash, nil
+	}
+
+	fd, st, err := rsyncOpenFile(full)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	f.cache[rel] = rsyncCacheEntry{size: st.Size(), mtime: st.ModTime(), hash: hash}
+	return hash, nil
+}
+
+// filePath returns the full path of a file of manifest (path must stay
+// inside folder, including when parent directories are symlinks)
+func (f *RsyncFolder) filePath(rel string) (string, error) {
+	clean := path.Clean(rel)
+	if rel == "" || clean != rel || path.IsAbs(clean) || clean == "." ||
+		clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Invalid path: %s", rel)
+	}
+
+	root := f.GetConfig().RootPath
+	full := filepath.Join(root, filepath.FromSlash(clean))
+
+	// Check existing part of path
+	dir := filepath.Dir(full)
+	for !common.Exists(dir) && dir != root {
+		dir = filepath.Dir(dir)
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	if realDir != realRoot && !strings.HasPrefix(realDir, realRoot+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid path (outside folder): %s", rel)
+	}
+	return full, nil
+}
+
+// pruneDirs removes empty directories from dir up to folder root
+func (f *RsyncFolder) pruneDirs(dir string) {
+	root := f.GetConfig().RootPath
+	for dir != root && strings.HasPrefix(dir, root) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// manifestFile returns path of file where manifest is saved
+func (f *RsyncFolder) manifestFile() string {
+	return f.fConfig.RootPath + ".manifest"
+}
+
+// saveManifest saves manifest on disk
+func (f *RsyncFolder) saveManifest() error {
+	data, err := json.Marshal(f.manifest)
+	if err != nil {
+		return err
+	}
+	tmp := f.manifestFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.manifestFile())
+}
+
+// setStatus sets folder status and emits an event when status changed
+func (f *RsyncFolder) setStatus(status string, inSync bool) {
+	f.mutex.Lock()
+	changed := f.fConfig.Status != status || f.fConfig.IsInSync != inSync
+	f.fConfig.Status = status
+	f.fConfig.IsInSync = inSync
+	cfg := f.fConfig
+	f.mutex.Unlock()
+
+	if changed && f.events != nil {
+		if err := f.events.Emit(xsapiv1.EVTFolderStateChange, &cfg, ""); err != nil {
+			f.Log.Warningf("Cannot notify folder change: %v", err)
+		}
+	}
+}
+
+// rsyncOpenFile opens a regular file of folder: symbolic links are refused,
+// because a command may create a link to a file outside of folder
+func rsyncOpenFile(full string) (*os.File, os.FileInfo, error) {
+	lst, err := os.Lstat(full)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !lst.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("Not a regular file: %s", filepath.Base(full))
+	}
+	fd, err := os.Open(full)
+	if err != nil {
+		return nil, nil, err
+	}
+	// File may have been replaced between Lstat and Open
+	st, err := fd.Stat()
+	if err != nil || !os.SameFile(lst, st) {
+		fd.Close()
+		return nil, nil, fmt.Errorf("File changed while opening: %s", filepath.Base(full))
+	}
+	return fd, st, nil
+}
+
+// rsyncWeakSum returns the rsync rolling checksum of a block
+func rsyncWeakSum(blk []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(blk))
+	for i, c := range blk {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return (a & 0xffff) | (b << 16)
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+func newTestRsyncFolder(t *testing.T) (*RsyncFolder, func()) {
+	ctx, cleanup := newTestContext(t)
+	f := NewFolderRsync(ctx)
+	if _, err := f.Setup(xsapiv1.FolderConfig{ID: "rsync-test", ClientPath: "/home/me/prj", Type: xsapiv1.TypeRsyncHTTP}); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return f, cleanup
+}
+
+func rsyncTestEntry(data []byte) xsapiv1.RsyncFileEntry {
+	h := sha256.Sum256(data)
+	return xsapiv1.RsyncFileEntry{Size: int64(len(data)), Mode: 0644, Hash: hex.EncodeToString(h[:])}
+}
+
+func TestRsyncFilePath(t *testing.T) {
+	f, cleanup := newTestRsyncFolder(t)
+	defer cleanup()
+
+	outside, err := ioutil.TempDir("", "xds-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(f.fConfig.RootPath, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"main.c", false},
+		{"src/lib/util.c", false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"../main.c", true},
+		{"src/../../main.c", true},
+		{"src/../main.c", true},
+		{"src//main.c", true},
+		{"/etc/passwd", true},
+		{"link/main.c", true},
+		{"link/sub/main.c", true},
+	}
+	for _, tt := range tests {
+		full, err := f.filePath(tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("filePath(%q) = %q, %v, wantErr %v", tt.path, full, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRsyncApplyDelta(t *testing.T) {
+	f, cleanup := newTestRsyncFolder(t)
+	defer cleanup()
+
+	// Upload a new file, then a modified version reusing its blocks
+	v1 := bytes.Repeat([]byte("0123456789abcdef"), 128) // 4 blocks of 512 bytes
+	if _, err := f.ApplyDelta(xsapiv1.RsyncDeltaArgs{
+		Path: "src/data.bin",
+		Ops:  []xsapiv1.RsyncDeltaOp{{Data: v1}},
+		File: rsyncTestEntry(v1),
+	}); err != nil {
+		t.Fatalf("upload of new file: %v", err)
+	}
+	sig, err := f.Signature("src/data.bin", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig.Blocks) != 4 || sig.Hash != rsyncTestEntry(v1).Hash {
+		t.Fatalf("invalid signature: %d blocks, hash %s", len(sig.Blocks), sig.Hash)
+	}
+
+	v2 := append(append([]byte{}, v1[:1024]...), []byte("new tail")...)
+	v2 = append(v2, v1[:512]...)
+
+	tests := []struct {
+		name    string
+		args    xsapiv1.RsyncDeltaArgs
+		wantErr bool
+	}{
+		{"copy and literal", xsapiv1.RsyncDeltaArgs{
+			Ops:  []xsapiv1.RsyncDeltaOp{{Block: 0, Count: 2}, {Data: []byte("new tail")}, {Block: 0, Count: 1}},
+			File: rsyncTestEntry(v2),
+		}, false},
+		{"wrong base hash", xsapiv1.RsyncDeltaArgs{
+			BaseHash: rsyncTestEntry(nil).Hash,
+			Ops:      []xsapiv1.RsyncDeltaOp{{Block: 0, Count: 2}, {Data: []byte("new tail")}, {Block: 0, Count: 1}},
+			File:     rsyncTestEntry(v2),
+		}, true},
+		{"blocks out of range", xsapiv1.RsyncDeltaArgs{
+			Ops:  []xsapiv1.RsyncDeltaOp{{Block: 3, Count: 2}},
+			File: rsyncTestEntry(v1),
+		}, true},
+		{"blocks count overflow", xsapiv1.RsyncDeltaArgs{
+			Ops:  []xsapiv1.RsyncDeltaOp{{Block: 1, Count: 1 << 53}},
+			File: rsyncTestEntry(v1),
+		}, true},
+		{"output bigger than expected", xsapiv1.RsyncDeltaArgs{
+			Ops:  []xsapiv1.RsyncDeltaOp{{Block: 0, Count: 4}, {Block: 0, Count: 4}},
+			File: rsyncTestEntry(v1),
+		}, true},
+		{"checksum mismatch", xsapiv1.RsyncDeltaArgs{
+			Ops:  []xsapiv1.RsyncDeltaOp{{Block: 1, Count: 1}, {Block: 0, Count: 1}, {Block: 2, Count: 2}},
+			File: rsyncTestEntry(v1),
+		}, true},
+		{"literal too big", xsapiv1.RsyncDeltaArgs{
+			Ops:  []xsapiv1.RsyncDeltaOp{{Data: make([]byte, rsyncMaxDeltaLiteral+1)}},
+			File: rsyncTestEntry(make([]byte, rsyncMaxDeltaLiteral+1)),
+		}, true},
+	}
+	for _, tt := range tests {
+		tt.args.Path = "src/data.bin"
+		tt.args.BlockSize = 512
+		if tt.args.BaseHash == "" {
+			tt.args.BaseHash = sig.Hash
+		}
+		if _, err := f.ApplyDelta(tt.args); (err != nil) != tt.wantErr {
+			t.Errorf("%s: ApplyDelta() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(f.fConfig.RootPath, "src", "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, v2) {
+		t.Errorf("invalid content after delta: %q", data)
+	}
+}
+
+func TestRsyncSymlinkRefused(t *testing.T) {
+	f, cleanup := newTestRsyncFolder(t)
+	defer cleanup()
+
+	secret, err := ioutil.TempFile("", "xds-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secret.Name())
+	content := bytes.Repeat([]byte("secret"), 200)
+	secret.Write(content)
+	secret.Close()
+
+	// Link created by a command executed in folder
+	if err := os.Symlink(secret.Name(), filepath.Join(f.fConfig.RootPath, "x")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Signature("x", 512); err == nil {
+		t.Errorf("Signature of a symlink must fail")
+	}
+	sum := sha256.Sum256(content)
+	if _, err := f.ApplyDelta(xsapiv1.RsyncDeltaArgs{
+		Path:      "copy",
+		BaseHash:  hex.EncodeToString(sum[:]),
+		BlockSize: 512,
+		Ops:       []xsapiv1.RsyncDeltaOp{{Block: 0, Count: 3}},
+		File:      rsyncTestEntry(content),
+	}); err == nil {
+		t.Errorf("ApplyDelta must fail")
+	}
+	if _, err := f.ApplyDelta(xsapiv1.RsyncDeltaArgs{
+		Path:      "x",
+		BaseHash:  hex.EncodeToString(sum[:]),
+		BlockSize: 512,
+		Ops:       []xsapiv1.RsyncDeltaOp{{Block: 0, Count: 3}},
+		File:      rsyncTestEntry(content),
+	}); err == nil {
+		t.Errorf("ApplyDelta using a symlink as base must fail")
+	}
+}
+
+func TestRsyncSyncKeepsServerFiles(t *testing.T) {
+	f, cleanup := newTestRsyncFolder(t)
+	defer cleanup()
+
+	src := []byte("int main() { return 0; }\n")
+	if _, err := f.SetManifest(xsapiv1.RsyncManifest{Files: map[string]xsapiv1.RsyncFileEntry{"main.c": rsyncTestEntry(src)}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ApplyDelta(xsapiv1.RsyncDeltaArgs{Path: "main.c", Ops: []xsapiv1.RsyncDeltaOp{{Data: src}}, File: rsyncTestEntry(src)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Build outputs
+	obj := filepath.Join(f.fConfig.RootPath, "build", "main.o")
+	os.MkdirAll(filepath.Dir(obj), 0755)
+	if err := ioutil.WriteFile(obj, []byte("ELF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !f.GetConfig().IsInSync {
+		t.Errorf("folder must be in sync")
+	}
+	if st, err := f.GetStatus(); err != nil {
+		t.Fatal(err)
+	} else if _, exist := st.Files["build/main.o"]; exist || len(st.Files) != 1 {
+		t.Errorf("only files of manifest must be reported: %v", st.Files)
+	}
+	if _, err := os.Stat(obj); err != nil {
+		t.Errorf("build output removed by Sync: %v", err)
+	}
+
+	// File removed by client
+	st, err := f.SetManifest(xsapiv1.RsyncManifest{Files: map[string]xsapiv1.RsyncFileEntry{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Removed) != 1 || st.Removed[0] != "main.c" {
+		t.Errorf("invalid removed files: %v", st.Removed)
+	}
+	if _, err := os.Stat(obj); err != nil {
+		t.Errorf("build output removed by SetManifest: %v", err)
+	}
+}
@@ -82,6 +82,11 @@ func (f *STFolderDisable) ConvPathSvr2Cli(s string) string {
 	return ""
 }
 
+// PathConverter Get converter of paths between Client and Server
+func (f *STFolderDisable) PathConverter() *PathConverter {
+	return NewPathConverter(nil)
+}
+
 // Remove a folder
 func (f *STFolderDisable) Remove() error {
 	return nil
@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 
 	st "github.com/iotbzh/xds-server/lib/syncthing"
 	"github.com/iotbzh/xds-server/lib/xsapiv1"
@@ -136,24 +135,21 @@ func (f *STFolder) GetFullPath(dir string) string {
 
 // ConvPathCli2Svr Convert path from Client to Server
 func (f *STFolder) ConvPathCli2Svr(s string) string {
-	if f.fConfig.ClientPath != "" && f.fConfig.RootPath != "" {
-		return strings.Replace(s,
-			f.fConfig.ClientPath,
-			f.fConfig.RootPath+"/"+f.fConfig.ClientPath,
-			-1)
-	}
-	return s
+	return f.PathConverter().Cli2Svr(s)
 }
 
 // ConvPathSvr2Cli Convert path from Server to Client
 func (f *STFolder) ConvPathSvr2Cli(s string) string {
+	return f.PathConverter().Svr2Cli(s)
+}
+
+// PathConverter Get converter of paths between Client and Server
+func (f *STFolder) PathConverter() *PathConverter {
+	svrPath := ""
 	if f.fConfig.ClientPath != "" && f.fConfig.RootPath != "" {
-		return strings.Replace(s,
-			f.fConfig.RootPath+"/"+f.fConfig.ClientPath,
-			f.fConfig.ClientPath,
-			-1)
+		svrPath = filepath.Join(f.fConfig.RootPath, f.fConfig.ClientPath)
 	}
-	return s
+	return NewPathConverter(folderPathMappings(f.fConfig, svrPath))
 }
 
 // Remove a folder
@@ -22,7 +22,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"time"
 
@@ -209,9 +211,13 @@ func (f *Folders) getConfigArrUnsafe() []xsapiv1.FolderConfig {
 	return conf
 }
 
-// Add adds a new folder
-func (f *Folders) Add(newF xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
-	return f.createUpdate(newF, true, false)
+// Add adds a new folder (fromSid is the ID of session that requested it)
+func (f *Folders) Add(newF xsapiv1.FolderConfig, fromSid string) (*xsapiv1.FolderConfig, error) {
+	newFolder, err := f.createUpdate(newF, true, false)
+	if err == nil {
+		f.emitChange(newFolder, fromSid)
+	}
+	return newFolder, err
 }
 
 // CreateUpdate creates or update a folder
@@ -228,6 +234,12 @@ func (f *Folders) createUpdate(newF xsapiv1.FolderConfig, create bool, initial b
 	if newF.ClientPath == "" {
 		return nil, fmt.Errorf("ClientPath must be set")
 	}
+	if err := validatePathMappings(&newF, f.Config.FileConf.PathMappingRoots); err != nil {
+		return nil, err
+	}
+	if err := validateACL(&newF); err != nil {
+		return nil, err
+	}
 
 	// Create a new folder object
 	var fld IFOLDER
@@ -244,6 +256,18 @@ func (f *Folders) createUpdate(newF xsapiv1.FolderConfig, create bool, initial b
 	// PATH MAP
 	case xsapiv1.TypePathMap:
 		fld = NewFolderPathMap(f.Context)
+
+	// CIFS/SMB
+	case xsapiv1.TypeCifsSmb:
+		fld = NewFolderCifs(f.Context)
+
+	// GIT
+	case xsapiv1.TypeGit:
+		fld = NewFolderGit(f.Context)
+
+	// RSYNC OVER HTTP
+	case xsapiv1.TypeRsyncHTTP:
+		fld = NewFolderRsync(f.Context)
 	default:
 		return nil, fmt.Errorf("Unsupported folder type")
 	}
@@ -307,8 +331,9 @@ func (f *Folders) createUpdate(newF xsapiv1.FolderConfig, create bool, initial b
 	return newFolder, nil
 }
 
-// Delete deletes a specific folder
-func (f *Folders) Delete(id string) (xsapiv1.FolderConfig, error) {
+// Delete deletes a specific folder (fromSid is the ID of session that
+// requested it)
+func (f *Folders) Delete(id string, fromSid string) (xsapiv1.FolderConfig, error) {
 	var err error
 
 	fcMutex.Lock()
@@ -331,11 +356,17 @@ func (f *Folders) Delete(id string) (xsapiv1.FolderConfig, error) {
 	// Save config on disk
 	err = f.SaveConfig()
 
+	// Send event to notified changes
+	delFld := fld
+	delFld.Status = xsapiv1.StatusDeleted
+	f.emitChange(&delFld, fromSid)
+
 	return fld, err
 }
 
-// Update Update a specific folder
-func (f *Folders) Update(id string, cfg xsapiv1.FolderConfig) (*xsapiv1.FolderConfig, error) {
+// Update Update a specific folder (fromSid is the ID of session that
+// requested it)
+func (f *Folders) Update(id string, cfg xsapiv1.FolderConfig, fromSid string) (*xsapiv1.FolderConfig, error) {
 	fcMutex.Lock()
 	defer fcMutex.Unlock()
 
@@ -354,7 +385,7 @@ func (f *Folders) Update(id string, cfg xsapiv1.FolderConfig) (*xsapiv1.FolderCo
 		valNew, err := reflectme.GetField(cfg, fieldName)
 		if err == nil {
 			valCur, err := reflectme.GetField(newCfg, fieldName)
-			if err == nil && valNew != valCur {
+			if err == nil && !reflect.DeepEqual(valNew, valCur) {
 				err = reflectme.SetField(&newCfg, fieldName, valNew)
 				if err != nil {
 					return nil, err
@@ -368,6 +399,13 @@ func (f *Folders) Update(id string, cfg xsapiv1.FolderConfig) (*xsapiv1.FolderCo
 		return &newCfg, nil
 	}
 
+	if err := validatePathMappings(&newCfg, f.Config.FileConf.PathMappingRoots); err != nil {
+		return nil, err
+	}
+	if err := validateACL(&newCfg); err != nil {
+		return nil, err
+	}
+
 	fld, err := (*fc).Update(newCfg)
 	if err != nil {
 		return fld, err
@@ -377,11 +415,36 @@ func (f *Folders) Update(id string, cfg xsapiv1.FolderConfig) (*xsapiv1.FolderCo
 	err = f.SaveConfig()
 
 	// Send event to notified changes
-	// TODO emit folder change event
+	f.emitChange(fld, fromSid)
 
 	return fld, err
 }
 
+// folderUpdateFields copies fields that can be updated (see
+// FolderConfigUpdatableFields) from src into dst
+func folderUpdateFields(dst *xsapiv1.FolderConfig, src xsapiv1.FolderConfig) error {
+	for _, fieldName := range xsapiv1.FolderConfigUpdatableFields {
+		val, err := reflectme.GetField(src, fieldName)
+		if err != nil {
+			return err
+		}
+		if err := reflectme.SetField(dst, fieldName, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitChange emits a folder change event
+func (f *Folders) emitChange(fld *xsapiv1.FolderConfig, fromSid string) {
+	if fld == nil || f.events == nil {
+		return
+	}
+	if err := f.events.Emit(xsapiv1.EVTFolderChange, fld, fromSid); err != nil {
+		f.Log.Warningf("Cannot notify folder change: %v", err)
+	}
+}
+
 // ForceSync Force the synchronization of a folder
 func (f *Folders) ForceSync(id string) error {
 	fc := f.Get(id)
@@ -402,6 +465,71 @@ func (f *Folders) IsFolderInSync(id string) (bool, error) {
 
 //*** Private functions ***
 
+// validatePathMappings checks and normalizes additional path mappings of a
+// folder (server paths must be located under one of roots directories)
+func validatePathMappings(cfg *xsapiv1.FolderConfig, roots []string) error {
+	clientPaths := map[string]bool{common.PathNormalize(cfg.ClientPath): true}
+	for idx := range cfg.PathMappings {
+		m := &cfg.PathMappings[idx]
+		if m.ClientPath == "" || m.ServerPath == "" {
+			return fmt.Errorf("Path mapping %d: both clientPath and serverPath must be set", idx)
+		}
+		// Normalize path (needed for Windows path including bashlashes)
+		m.ClientPath = common.PathNormalize(m.ClientPath)
+		if !path.IsAbs(m.ClientPath) && !isWindowsPath(m.ClientPath) {
+			return fmt.Errorf("Path mapping %d: clientPath must be an absolute path", idx)
+		}
+		if !filepath.IsAbs(m.ServerPath) {
+			return fmt.Errorf("Path mapping %d: serverPath must be an absolute path", idx)
+		}
+		m.ServerPath = filepath.Clean(m.ServerPath)
+		if !serverPathAllowed(m.ServerPath, roots) {
+			return fmt.Errorf("Path mapping %d: serverPath %s is not located in an allowed directory", idx, m.ServerPath)
+		}
+		if clientPaths[m.ClientPath] {
+			return fmt.Errorf("Path mapping %d: clientPath %s already mapped", idx, m.ClientPath)
+		}
+		clientPaths[m.ClientPath] = true
+	}
+	return nil
+}
+
+// serverPathAllowed returns true when path is located in (and is not) one of
+// roots directories, symbolic links are resolved to not escape from them
+func serverPathAllowed(p string, roots []string) bool {
+	if rp, err := filepath.EvalSymlinks(p); err == nil {
+		p = rp
+	} else if !os.IsNotExist(err) {
+		return false
+	}
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		if rr, err := filepath.EvalSymlinks(root); err == nil {
+			root = rr
+		}
+		rel, err := filepath.Rel(filepath.Clean(root), p)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateACL checks access control list of a folder
+func validateACL(cfg *xsapiv1.FolderConfig) error {
+	for idx, e := range cfg.ACL {
+		if (e.User == "") == (e.Role == "") {
+			return fmt.Errorf("ACL entry %d: either user or role must be set", idx)
+		}
+		if e.Access != xsapiv1.FolderAccessRead && e.Access != xsapiv1.FolderAccessExec {
+			return fmt.Errorf("ACL entry %d: invalid access '%s'", idx, e.Access)
+		}
+	}
+	return nil
+}
+
 // Use XML format and not json to be able to save/load all fields including
 // ones that are masked in json (IOW defined with `json:"-"`)
 type xmlFolders struct {
@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+)
+
+func TestServerPathAllowed(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "xds-folders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := filepath.Join(tmp, "share")
+	if err := os.MkdirAll(filepath.Join(root, "prj"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(root, "etc")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{filepath.Join(root, "prj"), true},
+		{filepath.Join(root, "prj", "not-yet-created"), true},
+		{root, false},
+		{root + "-other", false},
+		{filepath.Join(root, "..", "share-other"), false},
+		{filepath.Join(root, "etc"), false},
+		{filepath.Join(root, "etc", "passwd"), false},
+		{"/", false},
+		{"/etc", false},
+	}
+	for _, tt := range tests {
+		if got := serverPathAllowed(tt.path, []string{root}); got != tt.allowed {
+			t.Errorf("serverPathAllowed(%q) = %v, want %v", tt.path, got, tt.allowed)
+		}
+	}
+}
+
+func TestValidatePathMappings(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "xds-folders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	tests := []struct {
+		name     string
+		mappings []xsapiv1.PathMappingConfig
+		wantErr  bool
+	}{
+		{"none", nil, false},
+		{"in root", []xsapiv1.PathMappingConfig{{ClientPath: "/opt/lib", ServerPath: tmp + "/lib"}}, false},
+		{"host root", []xsapiv1.PathMappingConfig{{ClientPath: "/opt/lib", ServerPath: "/"}}, true},
+		{"host dir", []xsapiv1.PathMappingConfig{{ClientPath: "/opt/lib", ServerPath: "/etc"}}, true},
+		{"escape", []xsapiv1.PathMappingConfig{{ClientPath: "/opt/lib", ServerPath: tmp + "/../etc"}}, true},
+		{"relative", []xsapiv1.PathMappingConfig{{ClientPath: "/opt/lib", ServerPath: "lib"}}, true},
+		{"same client path", []xsapiv1.PathMappingConfig{{ClientPath: "/home/me/prj", ServerPath: tmp + "/lib"}}, true},
+	}
+	for _, tt := range tests {
+		cfg := xsapiv1.FolderConfig{ClientPath: "/home/me/prj", PathMappings: tt.mappings}
+		if err := validatePathMappings(&cfg, []string{tmp}); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validatePathMappings() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
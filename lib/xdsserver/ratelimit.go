@@ -0,0 +1,205 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// Requests are limited (like limit_req of nginx) using token buckets per
+// remote IP and per session, limits depend on the class of request (see
+// rateLimit.classes in server config).
+
+// Rate limit scopes
+const (
+	rateScopeIP      = "ip"
+	rateScopeSession = "session"
+)
+
+// rateBucketIdleTime Idle buckets are removed after this delay
+const rateBucketIdleTime = 10 * time.Minute
+
+// rateMaxBuckets Max number of buckets (least recently used ones are removed)
+const rateMaxBuckets = 100000
+
+// rateEvictRatio 1/10 of buckets are removed when max is reached
+const rateEvictRatio = 10
+
+// RateLimiter Hold token buckets of clients
+type RateLimiter struct {
+	*Context
+	classes []xdsconfig.RateLimitClass
+	buckets map[string]*tokenBucket
+	mutex   sync.Mutex
+}
+
+// tokenBucket A token bucket (refilled at rate tokens per second)
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a rate limiter (nil when disabled)
+func NewRateLimiter(ctx *Context) *RateLimiter {
+	cfg := ctx.Config.FileConf.RateLimitConf
+	if cfg.Disable || len(cfg.Classes) == 0 {
+		ctx.Log.Infof("Requests rate limiting disabled")
+		return nil
+	}
+	return &RateLimiter{
+		Context: ctx,
+		classes: cfg.Classes,
+		buckets: make(map[string]*tokenBucket),
+		mutex:   sync.NewMutex(),
+	}
+}
+
+// Check returns true when a request is allowed for a scope (IP or session),
+// otherwise a 429 error with Retry-After header is replied
+func (rl *RateLimiter) Check(c *gin.Context, scope, key string) bool {
+	if rl == nil {
+		return true
+	}
+	cl := rl.classOf(c.Request)
+	if cl == nil {
+		return true
+	}
+	limit := cl.IP
+	if scope == rateScopeSession {
+		limit = cl.Session
+	}
+	if limit.Rate <= 0 {
+		return true
+	}
+
+	ok, wait := rl.take(scope+":"+key+":"+cl.Name, limit)
+	if ok {
+		return true
+	}
+
+	rl.Log.Infof("Too many requests (%s %s, class %s) from %s %s", c.Request.Method, c.Request.URL.Path, cl.Name, scope, key)
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	apiErrorCode(c, http.StatusTooManyRequests, "Too many requests")
+	return false
+}
+
+// classOf returns the first class matching a request (nil when none)
+func (rl *RateLimiter) classOf(req *http.Request) *xdsconfig.RateLimitClass {
+	for i := range rl.classes {
+		cl := &rl.classes[i]
+		if len(cl.Methods) > 0 && !rateMatchAny(cl.Methods, func(m string) bool { return strings.EqualFold(m, req.Method) }) {
+			continue
+		}
+		if len(cl.Paths) > 0 && !rateMatchAny(cl.Paths, func(p string) bool { return strings.HasPrefix(req.URL.Path, p) }) {
+			continue
+		}
+		return cl
+	}
+	return nil
+}
+
+// take takes a token of a bucket, returns the time to wait for next token
+// when bucket is empty
+func (rl *RateLimiter) take(key string, limit xdsconfig.RateLimit) (bool, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	b, exist := rl.buckets[key]
+	if !exist {
+		if len(rl.buckets) >= rateMaxBuckets {
+			rl.evictUnsafe()
+		}
+		b = &tokenBucket{tokens: burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// cleanup removes buckets not used for a while
+func (rl *RateLimiter) cleanup() {
+	if rl == nil {
+		return
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	for key, b := range rl.buckets {
+		if time.Since(b.last) > rateBucketIdleTime {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// evictUnsafe removes least recently used buckets (must be called with
+// mutex locked)
+func (rl *RateLimiter) evictUnsafe() {
+	keys := make([]string, 0, len(rl.buckets))
+	for key := range rl.buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return rl.buckets[keys[i]].last.Before(rl.buckets[keys[j]].last)
+	})
+	nb := len(keys)/rateEvictRatio + 1
+	for _, key := range keys[:nb] {
+		delete(rl.buckets, key)
+	}
+	rl.Log.Warningf("Too many rate limit buckets (max %d), %d least recently used removed", rateMaxBuckets, nb)
+}
+
+// rateIPKey returns the key of an IP address used to limit requests (IPv6
+// addresses of a /64 network, that is usually allocated to one client, share
+// the same limit)
+func rateIPKey(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return ip
+	}
+	return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// rateMatchAny returns true when one of values matches
+func rateMatchAny(values []string, match func(string) bool) bool {
+	for _, v := range values {
+		if match(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   xdsconfig.RateLimit
+		elapsed time.Duration // elapsed time before last take
+		takes   int
+		ok      bool
+		wait    time.Duration
+	}{
+		{"burst", xdsconfig.RateLimit{Rate: 1, Burst: 3}, 0, 3, true, 0},
+		{"burst exceeded", xdsconfig.RateLimit{Rate: 1, Burst: 3}, 0, 4, false, time.Second},
+		{"slow rate", xdsconfig.RateLimit{Rate: 0.5, Burst: 2}, 0, 3, false, 2 * time.Second},
+		{"refilled", xdsconfig.RateLimit{Rate: 1, Burst: 3}, 2 * time.Second, 4, true, 0},
+		{"partially refilled", xdsconfig.RateLimit{Rate: 2, Burst: 1}, 250 * time.Millisecond, 2, false, 250 * time.Millisecond},
+		{"no burst", xdsconfig.RateLimit{Rate: 1, Burst: 0}, 0, 1, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cleanup := newTestContext(t)
+			defer cleanup()
+			rl := &RateLimiter{Context: ctx, buckets: make(map[string]*tokenBucket), mutex: sync.NewMutex()}
+
+			var ok bool
+			var wait time.Duration
+			for i := 0; i < tt.takes; i++ {
+				if i == tt.takes-1 && tt.elapsed > 0 {
+					rl.buckets["k"].last = rl.buckets["k"].last.Add(-tt.elapsed)
+				}
+				ok, wait = rl.take("k", tt.limit)
+			}
+			if ok != tt.ok {
+				t.Errorf("take() = %v, want %v", ok, tt.ok)
+			}
+			// allow some time spent between takes
+			if d := tt.wait - wait; d < 0 || d > 50*time.Millisecond {
+				t.Errorf("take() wait = %v, want %v", wait, tt.wait)
+			}
+		})
+	}
+}
+
+func TestRateLimiterMaxBuckets(t *testing.T) {
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+	rl := &RateLimiter{Context: ctx, buckets: make(map[string]*tokenBucket), mutex: sync.NewMutex()}
+	limit := xdsconfig.RateLimit{Rate: 1, Burst: 1}
+
+	for i := 0; i < rateMaxBuckets; i++ {
+		rl.take(fmt.Sprintf("k%d", i), limit)
+	}
+	rl.buckets["k0"].last = time.Now().Add(time.Hour)
+	rl.take("new", limit)
+
+	if len(rl.buckets) > rateMaxBuckets {
+		t.Fatalf("%d buckets, want at most %d", len(rl.buckets), rateMaxBuckets)
+	}
+	if _, exist := rl.buckets["k0"]; !exist {
+		t.Errorf("recently used bucket removed")
+	}
+	if _, exist := rl.buckets["new"]; !exist {
+		t.Errorf("new bucket not added")
+	}
+}
+
+func TestRateIPKey(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::ffff", "2001:db8:1:2::/64"},
+		{"::ffff:192.0.2.1", "::ffff:192.0.2.1"},
+		{"invalid", "invalid"},
+	}
+	for _, tt := range tests {
+		if got := rateIPKey(tt.ip); got != tt.want {
+			t.Errorf("rateIPKey(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestRequestClientIP(t *testing.T) {
+	proxies := []*net.IPNet{parseIPNet("10.0.0.0/8"), parseIPNet("192.0.2.1")}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "198.51.100.7:1234", nil, "198.51.100.7"},
+		{"spoofed header", "198.51.100.7:1234", []string{"203.0.113.9"}, "198.51.100.7"},
+		{"trusted proxy", "192.0.2.1:1234", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"proxy chain", "10.1.2.3:1234", []string{"203.0.113.9, 10.4.5.6"}, "203.0.113.9"},
+		{"client spoofed first", "10.1.2.3:1234", []string{"1.2.3.4, 203.0.113.9"}, "203.0.113.9"},
+		{"multiple headers", "10.1.2.3:1234", []string{"1.2.3.4", "203.0.113.9"}, "203.0.113.9"},
+		{"invalid address", "10.1.2.3:1234", []string{"garbage, 10.4.5.6"}, "10.4.5.6"},
+		{"no header", "10.1.2.3:1234", nil, "10.1.2.3"},
+		{"ipv6", "[2001:db8::1]:1234", []string{"203.0.113.9"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+			for _, f := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", f)
+			}
+			if got := requestClientIP(req, proxies); got != tt.want {
+				t.Errorf("requestClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
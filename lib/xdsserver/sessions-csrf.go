@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// State-changing requests of browsers are protected against cross-site
+// request forgery: a token bound to session is set in a cookie readable by
+// web application (double-submit, compatible with Angular XSRF strategy)
+// and must be sent back in a request header. Clients that send session ID
+// or bearer token in a header (IOW not automatically sent by browsers) are
+// not concerned, as well as non-browser clients that send no cookie.
+
+const csrfCookieName = "XSRF-TOKEN"
+const csrfHeaderName = "X-XSRF-TOKEN"
+
+// newCSRFToken returns a new random token
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// checkCSRF returns true when a request is not forged, otherwise a 403 error
+// is replied
+func (s *Sessions) checkCSRF(c *gin.Context, sess *ClientSession) bool {
+	req := c.Request
+	if s.Config.FileConf.SecurityConf.DisableCSRF || !strings.HasPrefix(req.URL.Path, "/api/") {
+		return true
+	}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+
+	// Cross-origin requests are only accepted from allowed origins
+	origin := req.Header.Get("Origin")
+	if origin != "" && !isSameOrigin(req, origin) && !s.WWWServer.corsAllowed(origin) {
+		s.Log.Infof("CSRF: origin %s not allowed (%s %s)", origin, req.Method, req.URL.Path)
+		apiErrorCode(c, http.StatusForbidden, "Origin not allowed")
+		return false
+	}
+
+	// Credentials not automatically sent by browsers
+	if req.Header.Get(sessionCookieName) != "" || bearerToken(c) != "" {
+		return true
+	}
+	// Not a browser
+	if req.Header.Get("Cookie") == "" && origin == "" {
+		return true
+	}
+
+	tok := req.Header.Get(csrfHeaderName)
+	if tok == "" || sess.csrfToken == "" ||
+		subtle.ConstantTimeCompare([]byte(tok), []byte(sess.csrfToken)) != 1 {
+		s.Log.Infof("CSRF: invalid token from %s (%s %s)", s.clientIP(c), req.Method, req.URL.Path)
+		apiErrorCode(c, http.StatusForbidden, "Invalid CSRF token")
+		return false
+	}
+	return true
+}
+
+// secureCookie returns true when cookies must have Secure attribute
+func (s *Sessions) secureCookie(c *gin.Context) bool {
+	return c.Request.TLS != nil || s.Config.FileConf.SecurityConf.SecureCookie ||
+		strings.EqualFold(c.Request.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// setCookies sets session and CSRF token cookies
+func (s *Sessions) setCookies(c *gin.Context, sess *ClientSession) {
+	secure := s.secureCookie(c)
+	// Do not set Domain to localhost (http://stackoverflow.com/questions/1134290/cookies-on-localhost-with-explicit-domain)
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    url.QueryEscape(sess.ID),
+		MaxAge:   int(sess.MaxAge),
+		Path:     "/",
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if sess.csrfToken != "" {
+		// Must be readable by web application
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name:     csrfCookieName,
+			Value:    sess.csrfToken,
+			MaxAge:   int(sess.MaxAge),
+			Path:     "/",
+			Secure:   secure,
+			HttpOnly: false,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+// isSameOrigin returns true when origin is the one of server
+func isSameOrigin(req *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+	ctx.Config.FileConf.SecurityConf.CORSOrigins = []string{"https://ide.example.com"}
+	ctx.WWWServer = &WebServer{Context: ctx}
+	s := &Sessions{Context: ctx}
+	sess := &ClientSession{ID: "sid", csrfToken: newCSRFToken()}
+
+	cookie := sessionCookieName + "=sid"
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		allowed bool
+	}{
+		{"GET with cookie", "GET", "/api/v1/folders", map[string]string{"Cookie": cookie}, true},
+		{"not an API", "POST", "/socket.io/", map[string]string{"Cookie": cookie}, true},
+		{"cookie without token", "POST", "/api/v1/folders", map[string]string{"Cookie": cookie}, false},
+		{"cookie with wrong token", "POST", "/api/v1/folders", map[string]string{"Cookie": cookie, csrfHeaderName: newCSRFToken()}, false},
+		{"cookie with token", "DELETE", "/api/v1/folders/f1", map[string]string{"Cookie": cookie, csrfHeaderName: sess.csrfToken}, true},
+		{"same origin", "POST", "/api/v1/folders", map[string]string{"Cookie": cookie, "Origin": "http://example.com", csrfHeaderName: sess.csrfToken}, true},
+		{"origin not allowed", "POST", "/api/v1/folders", map[string]string{"Cookie": cookie, "Origin": "https://evil.example.com", csrfHeaderName: sess.csrfToken}, false},
+		{"origin not allowed with bearer", "POST", "/api/v1/folders", map[string]string{"Origin": "https://evil.example.com", "Authorization": "Bearer tok"}, false},
+		{"allowed origin without token", "POST", "/api/v1/folders", map[string]string{"Origin": "https://ide.example.com"}, false},
+		{"allowed origin with token", "POST", "/api/v1/folders", map[string]string{"Cookie": cookie, "Origin": "https://ide.example.com", csrfHeaderName: sess.csrfToken}, true},
+		{"session header", "POST", "/api/v1/folders", map[string]string{"Cookie": cookie, sessionCookieName: "sid"}, true},
+		{"bearer token", "PUT", "/api/v1/folders/f1", map[string]string{"Cookie": cookie, "Authorization": "Bearer tok"}, true},
+		{"not a browser", "POST", "/api/v1/folders", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(tt.method, "http://example.com"+tt.path, nil)
+			for k, v := range tt.headers {
+				c.Request.Header.Set(k, v)
+			}
+			if ok := s.checkCSRF(c, sess); ok != tt.allowed {
+				t.Errorf("checkCSRF() = %v, want %v", ok, tt.allowed)
+			}
+			if !tt.allowed && (w.Code != http.StatusForbidden || !c.IsAborted()) {
+				t.Errorf("request refused with status %d", w.Code)
+			}
+		})
+	}
+
+	// Protection can be disabled
+	ctx.Config.FileConf.SecurityConf.DisableCSRF = true
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/api/v1/folders", nil)
+	c.Request.Header.Set("Cookie", cookie)
+	if !s.checkCSRF(c, sess) {
+		t.Errorf("checkCSRF() must accept requests when disabled")
+	}
+}
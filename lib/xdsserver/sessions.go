@@ -18,25 +18,39 @@
 package xdsserver
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/googollee/go-socket.io"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
 	uuid "github.com/satori/go.uuid"
 	"github.com/syncthing/syncthing/lib/sync"
 )
 
 const sessionCookieName = "xds-sid"
 const sessionHeaderName = "XDS-SID"
+const sessionIdentityKey = "xds-identity" // key of AuthIdentity in gin metadata
 
 const sessionMonitorTime = 10 // Time (in seconds) to schedule monitoring session tasks
 
 const initSessionMaxAge = 10 // Initial session max age in seconds
-const maxSessions = 100000   // Maximum number of sessions in sessMap map
 
-const secureCookie = false // TODO: see https://github.com/astaxie/beego/blob/master/session/session.go#L218
+const sessionEvictRatio = 100 // 1/100 of max sessions are evicted when max is reached
+
+var sfMutex = sync.NewMutex() // protects sessions file
 
 // ClientSession contains the info of a user/client session
 type ClientSession struct {
@@ -44,10 +58,37 @@ type ClientSession struct {
 	WSID     string // only one WebSocket per client/session
 	MaxAge   int64
 	IOSocket *socketio.Socket
+	User     string   // authenticated user (empty when authentication is disabled)
+	Roles    []string // roles of authenticated user
+
+	// Client info (of last request)
+	RemoteAddr string
+	UserAgent  string
 
 	// private
-	expireAt time.Time
-	useCount int64
+	expireAt  time.Time
+	createdAt time.Time
+	lastUse   time.Time
+	useCount  int64
+	csrfToken string // see sessions-csrf.go
+}
+
+// GetInfo returns the public info of a session (session ID is a credential,
+// so only its public ID is disclosed)
+func (ss *ClientSession) GetInfo() xsapiv1.SessionInfo {
+	return xsapiv1.SessionInfo{
+		ID:          sessionPublicID(ss.ID),
+		User:        ss.User,
+		Roles:       ss.Roles,
+		RemoteAddr:  ss.RemoteAddr,
+		UserAgent:   ss.UserAgent,
+		WSConnected: ss.IOSocket != nil,
+		CreatedAt:   ss.createdAt,
+		LastUse:     ss.lastUse,
+		ExpireAt:    ss.expireAt,
+		UseCount:    ss.useCount,
+		Commands:    []string{},
+	}
 }
 
 // Sessions holds client sessions
@@ -57,6 +98,11 @@ type Sessions struct {
 	sessMap      map[string]ClientSession
 	mutex        sync.Mutex
 	stop         chan struct{} // signals intentional stop
+	fileOnDisk   string        // file where sessions are saved
+	dirty        bool          // sessions changed since last save
+	maxSessions  int           // maximum number of sessions in sessMap map
+	limiter      *RateLimiter
+	proxies      []*net.IPNet // trusted reverse proxies
 }
 
 // NewClientSessions .
@@ -72,6 +118,22 @@ func NewClientSessions(ctx *Context, cookieMaxAge string) *Sessions {
 		mutex:        sync.NewMutex(),
 		stop:         make(chan struct{}),
 	}
+	s.fileOnDisk, _ = xdsconfig.SessionsFilenameGet()
+	s.maxSessions = ctx.Config.FileConf.RateLimitConf.MaxSessions
+	s.limiter = NewRateLimiter(ctx)
+	for _, p := range ctx.Config.FileConf.SecurityConf.TrustedProxies {
+		if ipNet := parseIPNet(p); ipNet != nil {
+			s.proxies = append(s.proxies, ipNet)
+		} else {
+			s.Log.Warningf("Invalid trusted proxy address: %s", p)
+		}
+	}
+
+	// Restore sessions saved by previous server instance
+	if err := s.load(); err != nil {
+		s.Log.Warningf("Cannot restore sessions: %v", err)
+	}
+
 	s.WWWServer.router.Use(s.Middleware())
 
 	// Start monitoring of sessions Map (use to manage expiration and cleanup)
@@ -83,26 +145,62 @@ func NewClientSessions(ctx *Context, cookieMaxAge string) *Sessions {
 // Stop sessions management
 func (s *Sessions) Stop() {
 	close(s.stop)
+	if err := s.Save(); err != nil {
+		s.Log.Errorf("Cannot save sessions: %v", err)
+	}
 }
 
 // Middleware is used to managed session
 func (s *Sessions) Middleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// FIXME Add CSRF management
+		// Flood protection (per remote IP, then per session)
+		if !s.limiter.Check(c, rateScopeIP, rateIPKey(s.clientIP(c))) {
+			return
+		}
 
 		// Get session
 		sess := s.Get(c)
+
+		// Authenticate client: credentials of request or else identity
+		// saved in session by a previous request
+		var id *AuthIdentity
+		if s.auth.Enabled() && authRequired(c) {
+			var err error
+			if id, err = s.auth.Authenticate(c); err != nil {
+				s.Log.Infof("Authentication failure from %s: %v", s.clientIP(c), err)
+				s.auth.reject(c, err.Error())
+				return
+			}
+			if id == nil {
+				if sess == nil || sess.User == "" {
+					s.auth.reject(c, "Authentication required")
+					return
+				}
+				id = &AuthIdentity{User: sess.User, Roles: sess.Roles, Method: "session"}
+			}
+		}
+
 		if sess == nil {
 			// Allocate a new session key and put in cookie
-			sess = s.newSession("")
+			sess = s.newSession("", c)
 		} else {
-			s.refresh(sess.ID)
+			s.refresh(sess.ID, c)
+		}
+		if !s.limiter.Check(c, rateScopeSession, sess.ID) {
+			return
+		}
+		if !s.checkCSRF(c, sess) {
+			return
+		}
+		if id != nil {
+			if id.Method != "session" {
+				s.setIdentity(sess.ID, id)
+			}
+			c.Set(sessionIdentityKey, id)
 		}
 
 		// Set session in cookie and in header
-		// Do not set Domain to localhost (http://stackoverflow.com/questions/1134290/cookies-on-localhost-with-explicit-domain)
-		c.SetCookie(sessionCookieName, sess.ID, int(sess.MaxAge), "/", "",
-			secureCookie, false)
+		s.setCookies(c, sess)
 		c.Header(sessionHeaderName, sess.ID)
 
 		// Save session id in gin metadata
@@ -142,6 +240,14 @@ func (s *Sessions) Get(c *gin.Context) *ClientSession {
 	return nil
 }
 
+// GetID returns the ID of session of a request (empty when unknown)
+func (s *Sessions) GetID(c *gin.Context) string {
+	if sess := s.Get(c); sess != nil {
+		return sess.ID
+	}
+	return ""
+}
+
 // IOSocketGet Get socketio definition from sid
 func (s *Sessions) IOSocketGet(sid string) *socketio.Socket {
 	s.mutex.Lock()
@@ -171,42 +277,248 @@ func (s *Sessions) UpdateIOSocket(sid string, so *socketio.Socket) error {
 	return nil
 }
 
+// GetAll returns a copy of all sessions
+func (s *Sessions) GetAll() []ClientSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res := []ClientSession{}
+	for _, ss := range s.sessMap {
+		res = append(res, ss)
+	}
+	return res
+}
+
+// Delete removes a session: its events subscriptions are removed and its
+// websocket is closed
+func (s *Sessions) Delete(sid string) error {
+	s.mutex.Lock()
+	sess, ok := s.sessMap[sid]
+	if ok {
+		delete(s.sessMap, sid)
+		s.dirty = true
+	}
+	s.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("Unknown session id")
+	}
+
+	s.Log.Infof("Delete session id %s (user '%s')", sid, sess.User)
+	s.release(sess)
+	return nil
+}
+
+// release removes events subscriptions of a deleted session and closes its
+// websocket
+func (s *Sessions) release(sess ClientSession) {
+	s.events.UnRegister(xsapiv1.EVTAll, 0, sess.ID)
+	if sess.IOSocket != nil {
+		(*sess.IOSocket).Disconnect()
+	}
+}
+
+// busySessions returns public IDs of sessions that started commands still
+// running (must be called with mutex unlocked, as commands lock sessions
+// while locked)
+func (s *Sessions) busySessions() map[string]bool {
+	busy := make(map[string]bool)
+	if s.maxSessions <= 0 || s.execCmds == nil {
+		return busy
+	}
+	for _, info := range s.execCmds.GetRunningInfoArr() {
+		busy[info.SessionID] = true
+	}
+	return busy
+}
+
+// evictUnsafe removes sessions when maximum number of sessions is reached,
+// evicted sessions must then be released (must be called with mutex locked).
+// Sessions never reused (eg. clients not keeping cookies) are evicted first,
+// then least recently used ones; authenticated sessions and sessions having
+// a WebSocket or running commands are evicted last.
+func (s *Sessions) evictUnsafe(busy map[string]bool) []ClientSession {
+	if s.maxSessions <= 0 || len(s.sessMap) < s.maxSessions {
+		return nil
+	}
+	// Evict a batch of sessions to not scan sessions on every new one
+	nb := len(s.sessMap) - s.maxSessions + 1 + s.maxSessions/sessionEvictRatio
+
+	rank := func(ss ClientSession) int {
+		switch {
+		case ss.User != "" || ss.IOSocket != nil || busy[sessionPublicID(ss.ID)]:
+			return 2
+		case ss.useCount == 0:
+			return 0
+		}
+		return 1
+	}
+	sessions := make([]ClientSession, 0, len(s.sessMap))
+	ranks := make(map[string]int, len(s.sessMap))
+	for _, ss := range s.sessMap {
+		sessions = append(sessions, ss)
+		ranks[ss.ID] = rank(ss)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		ri, rj := ranks[sessions[i].ID], ranks[sessions[j].ID]
+		if ri != rj {
+			return ri < rj
+		}
+		return sessions[i].lastUse.Before(sessions[j].lastUse)
+	})
+	if nb > len(sessions) {
+		nb = len(sessions)
+	}
+	for _, ss := range sessions[:nb] {
+		delete(s.sessMap, ss.ID)
+	}
+	s.dirty = true
+	s.Log.Warningf("Too many sessions (max %d), %d sessions evicted", s.maxSessions, nb)
+	return sessions[:nb]
+}
+
+// clientIP returns the IP address of client (X-Forwarded-For header is
+// only used when request is received from a trusted proxy)
+func (s *Sessions) clientIP(c *gin.Context) string {
+	return requestClientIP(c.Request, s.proxies)
+}
+
+// requestClientIP returns the IP address of client that sent a request:
+// addresses of X-Forwarded-For header are read from right to left while
+// they are trusted proxies
+func requestClientIP(req *http.Request, proxies []*net.IPNet) string {
+	ip := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	trusted := func(addr string) bool {
+		parsed := net.ParseIP(addr)
+		for _, p := range proxies {
+			if parsed != nil && p.Contains(parsed) {
+				return true
+			}
+		}
+		return false
+	}
+	if !trusted(ip) {
+		return ip
+	}
+
+	fwd := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(fwd) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(fwd[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		ip = addr
+		if !trusted(addr) {
+			break
+		}
+	}
+	return ip
+}
+
+// parseIPNet parses an IP address or a CIDR (nil when invalid)
+func parseIPNet(s string) *net.IPNet {
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		return ipNet
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// setIdentity saves the identity of authenticated client in a session
+func (s *Sessions) setIdentity(sid string, id *AuthIdentity) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if sess, ok := s.sessMap[sid]; ok {
+		if sess.User != id.User {
+			s.Log.Infof("Session %s authenticated as user %s (%s)", sid, id.User, id.Method)
+		}
+		sess.User = id.User
+		sess.Roles = id.Roles
+		s.sessMap[sid] = sess
+		s.dirty = true
+	}
+}
+
+// getIdentity returns the identity of client authenticated in a session
+// (nil when not authenticated)
+func (s *Sessions) getIdentity(sid string) *AuthIdentity {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if sess, ok := s.sessMap[sid]; ok && sess.User != "" {
+		return &AuthIdentity{User: sess.User, Roles: sess.Roles, Method: "session"}
+	}
+	return nil
+}
+
+// sessionPublicID returns the public ID of a session, used to reference it in
+// data sent to other clients (session ID is a credential, so it's never sent)
+func sessionPublicID(sid string) string {
+	if sid == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte("xds-session:" + sid))
+	return hex.EncodeToString(h[:16])
+}
+
 // nesSession Allocate a new client session
-func (s *Sessions) newSession(prefix string) *ClientSession {
+func (s *Sessions) newSession(prefix string, c *gin.Context) *ClientSession {
 	uuid := prefix + uuid.NewV4().String()
 	id := base64.URLEncoding.EncodeToString([]byte(uuid))
+	now := time.Now()
 	se := ClientSession{
-		ID:       id,
-		WSID:     "",
-		MaxAge:   initSessionMaxAge,
-		IOSocket: nil,
-		expireAt: time.Now().Add(time.Duration(initSessionMaxAge) * time.Second),
-		useCount: 0,
+		ID:         id,
+		WSID:       "",
+		MaxAge:     initSessionMaxAge,
+		IOSocket:   nil,
+		RemoteAddr: s.clientIP(c),
+		UserAgent:  c.Request.UserAgent(),
+		expireAt:   now.Add(time.Duration(initSessionMaxAge) * time.Second),
+		createdAt:  now,
+		lastUse:    now,
+		useCount:   0,
+		csrfToken:  newCSRFToken(),
 	}
+	busy := s.busySessions()
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
+	evicted := s.evictUnsafe(busy)
 	s.sessMap[se.ID] = se
-
+	s.dirty = true
 	s.Log.Debugf("NEW session (%d): %s", len(s.sessMap), id)
+	s.mutex.Unlock()
+
+	for _, ss := range evicted {
+		s.release(ss)
+	}
 	return &se
 }
 
 // refresh Move this session ID to the head of the list
-func (s *Sessions) refresh(sid string) {
+func (s *Sessions) refresh(sid string, c *gin.Context) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	sess := s.sessMap[sid]
+	sess, ok := s.sessMap[sid]
+	if !ok {
+		// deleted in the meantime
+		return
+	}
 	sess.useCount++
+	sess.lastUse = time.Now()
+	sess.RemoteAddr = s.clientIP(c)
+	sess.UserAgent = c.Request.UserAgent()
 	if sess.MaxAge < s.cookieMaxAge && sess.useCount > 1 {
 		sess.MaxAge = s.cookieMaxAge
 		sess.expireAt = time.Now().Add(time.Duration(sess.MaxAge) * time.Second)
+		s.dirty = true
 	}
 
-	// TODO - Add flood detection (like limit_req of nginx)
-	// (delayed request when to much requests in a short period of time)
-
 	s.sessMap[sid] = sess
 }
 
@@ -217,21 +529,200 @@ func (s *Sessions) monitorSessMap() {
 			s.Log.Debugln("Stop monitorSessMap")
 			return
 		case <-time.After(sessionMonitorTime * time.Second):
-				s.LogSillyf("Sessions Map size: %d", len(s.sessMap))
-				s.LogSillyf("Sessions Map : %v", s.sessMap)
-
-			if len(s.sessMap) > maxSessions {
-				s.Log.Errorln("TOO MUCH sessions, cleanup old ones !")
-			}
+			s.limiter.cleanup()
 
+			expired := []string{}
+			busy := s.busySessions()
 			s.mutex.Lock()
+			s.LogSillyf("Sessions Map size: %d", len(s.sessMap))
+			s.LogSillyf("Sessions Map : %v", s.sessMap)
+			evicted := s.evictUnsafe(busy)
 			for _, ss := range s.sessMap {
 				if ss.expireAt.Sub(time.Now()) < 0 {
 					s.Log.Debugf("Delete expired session id: %s", ss.ID)
 					delete(s.sessMap, ss.ID)
+					expired = append(expired, ss.ID)
+					s.dirty = true
 				}
 			}
+			dirty := s.dirty
 			s.mutex.Unlock()
+
+			// Remove events subscriptions of expired sessions
+			for _, sid := range expired {
+				s.events.UnRegister(xsapiv1.EVTAll, 0, sid)
+			}
+			for _, ss := range evicted {
+				s.release(ss)
+			}
+
+			if dirty {
+				if err := s.Save(); err != nil {
+					s.Log.Errorf("Cannot save sessions: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// changed marks sessions as modified (saved on disk by monitoring task)
+func (s *Sessions) changed() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.dirty = true
+	s.mutex.Unlock()
+}
+
+// Save saves sessions and their events subscriptions on disk
+func (s *Sessions) Save() error {
+	if s.fileOnDisk == "" {
+		return nil
+	}
+
+	s.mutex.Lock()
+	sessions := []ClientSession{}
+	for _, ss := range s.sessMap {
+		sessions = append(sessions, ss)
+	}
+	s.dirty = false
+	s.mutex.Unlock()
+
+	// Subscriptions are got without sessions lock (events lock is taken
+	// before sessions lock while emitting)
+	data := xmlSessions{Version: "1", Sessions: []xmlSession{}}
+	for _, ss := range sessions {
+		data.Sessions = append(data.Sessions, xmlSession{
+			ID:         ss.ID,
+			MaxAge:     ss.MaxAge,
+			ExpireAt:   ss.expireAt,
+			CreatedAt:  ss.createdAt,
+			LastUse:    ss.lastUse,
+			UseCount:   ss.useCount,
+			User:       ss.User,
+			Roles:      ss.Roles,
+			RemoteAddr: ss.RemoteAddr,
+			UserAgent:  ss.UserAgent,
+			CSRFToken:  ss.csrfToken,
+			Subs:       s.events.getSubs(ss.ID),
+		})
+	}
+
+	if err := sessionsWrite(s.fileOnDisk, &data); err != nil {
+		s.changed()
+		return err
+	}
+	return nil
+}
+
+// load restores sessions saved on disk (expired ones are ignored)
+func (s *Sessions) load() error {
+	if s.fileOnDisk == "" {
+		return nil
+	}
+	if _, err := os.Stat(s.fileOnDisk); os.IsNotExist(err) {
+		return nil
+	}
+
+	data := xmlSessions{}
+	if err := sessionsRead(s.fileOnDisk, &data); err != nil {
+		return err
+	}
+
+	nb := 0
+	now := time.Now()
+	for _, xs := range data.Sessions {
+		if xs.ID == "" || xs.ExpireAt.Before(now) {
+			continue
 		}
+		if err := s.events.restoreSubs(xs.ID, xs.Subs); err != nil {
+			s.Log.Warningf("Cannot restore events subscriptions of session %s: %v", xs.ID, err)
+		}
+		sess := ClientSession{
+			ID:         xs.ID,
+			MaxAge:     xs.MaxAge,
+			User:       xs.User,
+			Roles:      xs.Roles,
+			RemoteAddr: xs.RemoteAddr,
+			UserAgent:  xs.UserAgent,
+			expireAt:   xs.ExpireAt,
+			createdAt:  xs.CreatedAt,
+			lastUse:    xs.LastUse,
+			useCount:   xs.UseCount,
+			csrfToken:  xs.CSRFToken,
+		}
+		if sess.csrfToken == "" {
+			sess.csrfToken = newCSRFToken()
+		}
+		s.mutex.Lock()
+		s.sessMap[xs.ID] = sess
+		s.mutex.Unlock()
+		nb++
+	}
+	s.mutex.Lock()
+	s.dirty = nb != len(data.Sessions)
+	s.mutex.Unlock()
+	s.Log.Infof("Sessions restored from %s: %d", s.fileOnDisk, nb)
+	return nil
+}
+
+// xmlSessions Sessions saved on disk
+type xmlSessions struct {
+	XMLName  xml.Name     `xml:"sessions"`
+	Version  string       `xml:"version,attr"`
+	Sessions []xmlSession `xml:"session"`
+}
+
+type xmlSession struct {
+	ID         string          `xml:"id,attr"`
+	MaxAge     int64           `xml:"maxAge"`
+	ExpireAt   time.Time       `xml:"expireAt"`
+	CreatedAt  time.Time       `xml:"createdAt"`
+	LastUse    time.Time       `xml:"lastUse"`
+	UseCount   int64           `xml:"useCount"`
+	User       string          `xml:"user,omitempty"`
+	Roles      []string        `xml:"role"`
+	RemoteAddr string          `xml:"remoteAddr,omitempty"`
+	UserAgent  string          `xml:"userAgent,omitempty"`
+	CSRFToken  string          `xml:"csrfToken,omitempty"`
+	Subs       []eventSubSaved `xml:"subscription"`
+}
+
+// sessionsRead reads sessions from disk
+func sessionsRead(file string, data *xmlSessions) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return xml.NewDecoder(fd).Decode(data)
+}
+
+// sessionsWrite writes sessions on disk (file is replaced atomically and only
+// readable by server user, session IDs are credentials)
+func sessionsWrite(file string, data *xmlSessions) error {
+	sfMutex.Lock()
+	defer sfMutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(fd)
+	enc.Indent("", "  ")
+	err = enc.Encode(data)
+	if errC := fd.Close(); err == nil {
+		err = errC
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
 	}
+	return os.Rename(tmp, file)
 }
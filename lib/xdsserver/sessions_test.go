@@ -0,0 +1,112 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googollee/go-socket.io"
+)
+
+func TestSessionPublicID(t *testing.T) {
+	sids := []string{
+		"NTJlMzc0YjMtMzA2Yy00ZTYzLWFhNTYtZDNhNzMxYWY3ZjQw",
+		"NTJlMzc0YjMtMzA2Yy00ZTYzLWFhNTYtZDNhNzMxYWY3ZjQx",
+	}
+	pids := map[string]bool{}
+	for _, sid := range sids {
+		pid := sessionPublicID(sid)
+		if !sessionPublicIDRegexp.MatchString(pid) || pid == "" {
+			t.Errorf("invalid public ID %q", pid)
+		}
+		if strings.Contains(pid, sid) || strings.Contains(sid, pid) {
+			t.Errorf("public ID %q reveals session ID", pid)
+		}
+		if pid != sessionPublicID(sid) {
+			t.Errorf("public ID of %s is not stable", sid)
+		}
+		pids[pid] = true
+	}
+	if len(pids) != len(sids) {
+		t.Errorf("public IDs collision")
+	}
+	if sessionPublicID("") != "" {
+		t.Errorf("public ID of no session must be empty")
+	}
+	// Session IDs saved by previous versions must be hashed when loaded
+	if sessionPublicIDRegexp.MatchString(sids[0]) {
+		t.Errorf("session ID must not look like a public ID")
+	}
+}
+
+func TestSessionInfoHidesID(t *testing.T) {
+	sid := "NTJlMzc0YjMtMzA2Yy00ZTYzLWFhNTYtZDNhNzMxYWY3ZjQw"
+	ss := ClientSession{ID: sid, WSID: "ws1"}
+	info := ss.GetInfo()
+	if info.ID != sessionPublicID(sid) {
+		t.Errorf("GetInfo() ID = %q, want public ID %q", info.ID, sessionPublicID(sid))
+	}
+	if data, _ := json.Marshal(info); strings.Contains(string(data), sid) || strings.Contains(string(data), "ws1") {
+		t.Errorf("session info discloses session or WebSocket ID: %s", data)
+	}
+}
+
+func TestSessionsEvict(t *testing.T) {
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+
+	var so socketio.Socket
+	now := time.Now()
+	s := &Sessions{Context: ctx, sessMap: make(map[string]ClientSession), maxSessions: 6}
+	for i, ss := range []ClientSession{
+		{ID: "auth", User: "me"},
+		{ID: "ws", IOSocket: &so},
+		{ID: "busy", useCount: 3},
+		{ID: "used-old", useCount: 3},
+		{ID: "used-new", useCount: 3},
+		{ID: "new"},
+	} {
+		ss.lastUse = now.Add(time.Duration(i) * time.Second)
+		s.sessMap[ss.ID] = ss
+	}
+
+	busy := map[string]bool{sessionPublicID("busy"): true}
+	evicted := []string{}
+	for _, ss := range s.evictUnsafe(busy) {
+		evicted = append(evicted, ss.ID)
+	}
+	if strings.Join(evicted, ",") != "new" {
+		t.Errorf("evicted %v, want [new] (never reused)", evicted)
+	}
+
+	// Sessions reused are evicted before protected ones
+	s.maxSessions = 4
+	evicted = evicted[:0]
+	for _, ss := range s.evictUnsafe(busy) {
+		evicted = append(evicted, ss.ID)
+	}
+	if strings.Join(evicted, ",") != "used-old,used-new" {
+		t.Errorf("evicted %v, want [used-old used-new]", evicted)
+	}
+	if len(s.sessMap) != 3 {
+		t.Errorf("%d sessions kept, want 3", len(s.sessMap))
+	}
+}
@@ -0,0 +1,281 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// Events (and commands exit) are POSTed as xsapiv1.EventMsg JSON payload to
+// webhooks defined in server config. Deliveries of a webhook are done in
+// order by a dedicated goroutine and retried with an exponential backoff,
+// deliveries that definitively failed are logged in a dead-letter file.
+
+const (
+	webhookQueueSize  = 1000
+	webhookTimeout    = 10 * time.Second
+	webhookMinBackoff = 1 * time.Second
+	webhookMaxBackoff = 5 * time.Minute
+)
+
+// HTTP headers set in webhook requests
+const (
+	webhookHeaderEvent     = "X-XDS-Event"
+	webhookHeaderDelivery  = "X-XDS-Delivery"
+	webhookHeaderSignature = "X-XDS-Signature"
+)
+
+// Webhooks Hold webhooks defined in server config
+type Webhooks struct {
+	*Context
+	hooks     []*webhook
+	client    *http.Client
+	deadMutex sync.Mutex
+}
+
+// webhook A target of events
+type webhook struct {
+	cfg     xdsconfig.WebhookConfig
+	events  map[string]bool
+	filter  *EventFilter
+	queue   chan webhookDelivery
+	dropped []webhookDelivery // deliveries dropped because queue was full
+	lost    int               // dropped deliveries not kept (too many)
+	mutex   sync.Mutex        // protect dropped and lost
+}
+
+// webhookDelivery An event to deliver
+type webhookDelivery struct {
+	id      string
+	evType  string
+	payload []byte
+}
+
+// webhookDeadLetter Entry of dead-letter file
+type webhookDeadLetter struct {
+	Time     string          `json:"time"`
+	URL      string          `json:"url"`
+	ID       string          `json:"id"`
+	Event    string          `json:"event"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// NewWebhooks creates webhooks defined in server config and starts their
+// delivery goroutine
+func NewWebhooks(ctx *Context) (*Webhooks, error) {
+	w := &Webhooks{
+		Context:   ctx,
+		hooks:     []*webhook{},
+		client:    &http.Client{Timeout: webhookTimeout},
+		deadMutex: sync.NewMutex(),
+	}
+
+	for _, cfg := range ctx.Config.FileConf.EventsConf.Webhooks {
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("Webhook URL must be set")
+		}
+		h := &webhook{
+			cfg:    cfg,
+			events: make(map[string]bool),
+			queue:  make(chan webhookDelivery, webhookQueueSize),
+			mutex:  sync.NewMutex(),
+		}
+		for _, ev := range cfg.Events {
+			h.events[ev] = true
+		}
+		if cfg.Filter != "" {
+			var err error
+			if h.filter, err = NewEventFilter(cfg.Filter); err != nil {
+				return nil, fmt.Errorf("Webhook %s: %v", cfg.URL, err)
+			}
+		}
+		w.hooks = append(w.hooks, h)
+		go w.deliver(h)
+
+		ctx.Log.Infof("Webhook: %s (events %v)", cfg.URL, cfg.Events)
+	}
+	return w, nil
+}
+
+// Send queues an event message to webhooks interested by it (never blocks)
+func (w *Webhooks) Send(msg xsapiv1.EventMsg) {
+	if w == nil || len(w.hooks) == 0 {
+		return
+	}
+
+	// Sessions of clients are never disclosed to webhooks
+	msg.FromSessionID = ""
+
+	var payload []byte
+	var fields map[string]interface{}
+	for _, h := range w.hooks {
+		if len(h.events) > 0 && !h.events[msg.Type] {
+			continue
+		}
+		if h.filter != nil {
+			if fields == nil {
+				fields = eventFields(msg.Data)
+			}
+			if !h.filter.Match(fields) {
+				continue
+			}
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(msg); err != nil {
+				w.Log.Errorf("Cannot encode webhook payload: %v", err)
+				return
+			}
+		}
+
+		d := webhookDelivery{id: uuid.NewV4().String(), evType: msg.Type, payload: payload}
+		select {
+		case h.queue <- d:
+		default:
+			// Written to dead-letter file by delivery goroutine
+			h.mutex.Lock()
+			if len(h.dropped) < webhookQueueSize {
+				h.dropped = append(h.dropped, d)
+			} else {
+				h.lost++
+			}
+			h.mutex.Unlock()
+		}
+	}
+}
+
+// deliver delivers events queued for a webhook
+func (w *Webhooks) deliver(h *webhook) {
+	maxRetries := w.Config.FileConf.EventsConf.WebhookRetries
+	for d := range h.queue {
+		backoff := webhookMinBackoff
+		attempt := 0
+		for {
+			attempt++
+			retry, err := w.post(h, d)
+			if err == nil {
+				break
+			}
+			if !retry || attempt > maxRetries {
+				w.deadLetter(h, d, attempt, err)
+				break
+			}
+			w.Log.Debugf("Webhook %s: delivery %s failed (retry in %v): %v", h.cfg.URL, d.id, backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > webhookMaxBackoff {
+				backoff = webhookMaxBackoff
+			}
+		}
+		w.flushDropped(h)
+	}
+}
+
+// flushDropped writes deliveries dropped while queue was full in
+// dead-letter file
+func (w *Webhooks) flushDropped(h *webhook) {
+	h.mutex.Lock()
+	dropped, lost := h.dropped, h.lost
+	h.dropped, h.lost = nil, 0
+	h.mutex.Unlock()
+
+	for _, d := range dropped {
+		w.deadLetter(h, d, 0, fmt.Errorf("delivery queue full"))
+	}
+	if lost > 0 {
+		w.Log.Errorf("Webhook %s: %d deliveries lost (delivery queue full)", h.cfg.URL, lost)
+	}
+}
+
+// post sends a delivery, returns whether it can be retried on error
+func (w *Webhooks) post(h *webhook, d webhookDelivery) (bool, error) {
+	req, err := http.NewRequest("POST", h.cfg.URL, bytes.NewReader(d.payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookHeaderEvent, d.evType)
+	req.Header.Set(webhookHeaderDelivery, d.id)
+	if h.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.cfg.Secret))
+		mac.Write(d.payload)
+		req.Header.Set(webhookHeaderSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("HTTP status %s", resp.Status)
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+// deadLetter logs a delivery that failed
+func (w *Webhooks) deadLetter(h *webhook, d webhookDelivery, attempts int, err error) {
+	w.Log.Errorf("Webhook %s: delivery %s of %s failed after %d attempt(s): %v", h.cfg.URL, d.id, d.evType, attempts, err)
+
+	file := w.Config.FileConf.EventsConf.WebhookDeadLetter
+	if file == "" {
+		return
+	}
+	line, _ := json.Marshal(webhookDeadLetter{
+		Time:     time.Now().Format(time.RFC3339),
+		URL:      h.cfg.URL,
+		ID:       d.id,
+		Event:    d.evType,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Payload:  json.RawMessage(d.payload),
+	})
+
+	w.deadMutex.Lock()
+	defer w.deadMutex.Unlock()
+	os.MkdirAll(filepath.Dir(file), 0755)
+	fd, errF := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if errF != nil {
+		w.Log.Errorf("Cannot write webhook dead-letter file: %v", errF)
+		return
+	}
+	defer fd.Close()
+	fd.Write(append(line, '\n'))
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// webhookRequest A request received by test webhook server
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// newTestWebhooks starts a webhook server replying statuses in order (last
+// one is then always replied)
+func newTestWebhooks(t *testing.T, ctx *Context, cfg xdsconfig.WebhookConfig, statuses ...int) (*Webhooks, chan webhookRequest, func()) {
+	reqs := make(chan webhookRequest, 10)
+	nb := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		status := statuses[len(statuses)-1]
+		if nb < len(statuses) {
+			status = statuses[nb]
+		}
+		nb++
+		w.WriteHeader(status)
+		reqs <- webhookRequest{header: r.Header, body: body}
+	}))
+	cfg.URL = srv.URL
+	ctx.Config.FileConf.EventsConf.Webhooks = []xdsconfig.WebhookConfig{cfg}
+	w, err := NewWebhooks(ctx)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return w, reqs, srv.Close
+}
+
+// waitWebhookRequest returns next request received by test webhook server
+func waitWebhookRequest(t *testing.T, reqs chan webhookRequest) webhookRequest {
+	select {
+	case r := <-reqs:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+	return webhookRequest{}
+}
+
+func TestWebhookPayload(t *testing.T) {
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+	secret := "s3cret"
+	w, reqs, stop := newTestWebhooks(t, ctx, xdsconfig.WebhookConfig{Secret: secret}, http.StatusOK)
+	defer stop()
+
+	w.Send(xsapiv1.EventMsg{
+		Type:          xsapiv1.ExecExitEvent,
+		FromSessionID: "0123456789abcdef0123456789abcdef",
+		Data:          newExecExitJSONMsg(xsapiv1.ExecExitMsg{CmdID: "cmd1", Code: 2, Error: fmt.Errorf("exit status 2")}),
+	})
+	r := waitWebhookRequest(t, reqs)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(r.body)
+	if sig := r.header.Get(webhookHeaderSignature); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("invalid signature %q", sig)
+	}
+	if ev := r.header.Get(webhookHeaderEvent); ev != xsapiv1.ExecExitEvent {
+		t.Errorf("event header = %q, want %q", ev, xsapiv1.ExecExitEvent)
+	}
+
+	var msg struct {
+		SessionID string `json:"sessionID"`
+		Data      struct {
+			CmdID string `json:"cmdID"`
+			Code  int    `json:"code"`
+			Error string `json:"error"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(r.body, &msg); err != nil {
+		t.Fatalf("invalid payload %s: %v", r.body, err)
+	}
+	if msg.SessionID != "" {
+		t.Errorf("session ID sent to webhook: %q", msg.SessionID)
+	}
+	if msg.Data.CmdID != "cmd1" || msg.Data.Code != 2 || msg.Data.Error != "exit status 2" {
+		t.Errorf("invalid payload %s", r.body)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+		dead     bool
+	}{
+		{"success", []int{http.StatusNoContent}, 1, false},
+		{"retried", []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK}, 3, false},
+		{"not retried", []int{http.StatusBadRequest}, 1, true},
+		{"max retries", []int{http.StatusBadGateway}, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cleanup := newTestContext(t)
+			defer cleanup()
+			deadFile := filepath.Join(ctx.Config.FileConf.ShareRootDir, "dead.log")
+			ctx.Config.FileConf.EventsConf.WebhookDeadLetter = deadFile
+			ctx.Config.FileConf.EventsConf.WebhookRetries = 2
+			w, reqs, stop := newTestWebhooks(t, ctx, xdsconfig.WebhookConfig{}, tt.statuses...)
+			defer stop()
+
+			w.Send(xsapiv1.EventMsg{Type: xsapiv1.EVTFolderChange, Data: map[string]string{"id": "f1"}})
+			for i := 0; i < tt.attempts; i++ {
+				waitWebhookRequest(t, reqs)
+			}
+			select {
+			case <-reqs:
+				t.Fatalf("more than %d attempts", tt.attempts)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			// Dead letter is written after last reply is processed
+			var data []byte
+			for i := 0; i < 20; i++ {
+				if data, _ = ioutil.ReadFile(deadFile); len(data) > 0 || !tt.dead {
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			if dead := strings.Contains(string(data), `"event":"`+xsapiv1.EVTFolderChange+`"`); dead != tt.dead {
+				t.Errorf("dead letter written = %v, want %v (%s)", dead, tt.dead, data)
+			}
+		})
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+	deadFile := filepath.Join(ctx.Config.FileConf.ShareRootDir, "dead.log")
+	ctx.Config.FileConf.EventsConf.WebhookDeadLetter = deadFile
+
+	// Delivery goroutine not started
+	h := &webhook{
+		cfg:    xdsconfig.WebhookConfig{URL: "http://localhost:1"},
+		events: map[string]bool{},
+		queue:  make(chan webhookDelivery, 1),
+		mutex:  sync.NewMutex(),
+	}
+	w := &Webhooks{Context: ctx, hooks: []*webhook{h}, deadMutex: sync.NewMutex()}
+
+	w.Send(xsapiv1.EventMsg{Type: xsapiv1.EVTFolderChange, Data: map[string]string{"id": "f1"}})
+	w.Send(xsapiv1.EventMsg{Type: xsapiv1.EVTFolderChange, Data: map[string]string{"id": "f2"}})
+	if len(h.dropped) != 1 {
+		t.Fatalf("%d deliveries dropped, want 1", len(h.dropped))
+	}
+	if _, err := os.Stat(deadFile); err == nil {
+		t.Errorf("dead letter must not be written by Send")
+	}
+
+	w.flushDropped(h)
+	data, _ := ioutil.ReadFile(deadFile)
+	if !strings.Contains(string(data), `"f2"`) || strings.Contains(string(data), `"f1"`) || len(h.dropped) != 0 {
+		t.Errorf("invalid dead letters: %s", data)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// Certificates (and CAs of client certificates) are loaded for each new TLS
+// connection from memory and reloaded on SIGHUP or when files change, so
+// running connections (and commands) are not affected by a reload.
+
+const tlsWatchPeriod = 10 * time.Second            // period of files changes checking
+const tlsSelfSignedValidity = 365 * 24 * time.Hour // validity of generated certificates
+
+// tlsVersions Supported values of minVersion setting
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsNextProtos Protocols negotiated with clients (ALPN)
+var tlsNextProtos = []string{"h2", "http/1.1"}
+
+// tlsCerts Hold certificate and client CAs currently served
+type tlsCerts struct {
+	*Context
+	cfg      xdsconfig.TLSConfig
+	base     *tls.Config
+	current  *tls.Config
+	modTimes map[string]time.Time
+	mutex    sync.Mutex
+}
+
+// newTLSConfig returns the TLS config of web server and starts monitoring
+// of certificate files
+func newTLSConfig(ctx *Context) (*tls.Config, error) {
+	cfg := ctx.Config.FileConf.TLSConf
+
+	minVersion, ok := tlsVersions[cfg.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("Invalid TLS minVersion '%s' (supported: 1.0, 1.1, 1.2 or 1.3)", cfg.MinVersion)
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("TLS certFile and keyFile must be set")
+	}
+	if _, err := os.Stat(cfg.CertFile); os.IsNotExist(err) && cfg.SelfSigned {
+		if err := tlsGenerateSelfSigned(cfg.CertFile, cfg.KeyFile); err != nil {
+			return nil, fmt.Errorf("Cannot generate self-signed certificate: %v", err)
+		}
+		ctx.Log.Warningf("Self-signed certificate generated: %s", cfg.CertFile)
+	}
+
+	tc := &tlsCerts{
+		Context:  ctx,
+		cfg:      cfg,
+		base:     &tls.Config{MinVersion: minVersion, NextProtos: tlsNextProtos},
+		modTimes: make(map[string]time.Time),
+		mutex:    sync.NewMutex(),
+	}
+	if err := tc.reload(); err != nil {
+		return nil, err
+	}
+
+	go tc.monitor()
+
+	// Config returned for a connection replaces this one, so it must also
+	// hold protocols negotiated by http.Server (HTTP/2). GetCertificate is
+	// never called then, but ListenAndServeTLS("", "") of older Go versions
+	// only accepts it as certificate source.
+	return &tls.Config{
+		MinVersion: minVersion,
+		NextProtos: tlsNextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			tc.mutex.Lock()
+			defer tc.mutex.Unlock()
+			return tc.current.Clone(), nil
+		},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			tc.mutex.Lock()
+			defer tc.mutex.Unlock()
+			return &tc.current.Certificates[0], nil
+		},
+	}, nil
+}
+
+// reload loads certificate and client CAs (current ones are kept on error)
+func (tc *tlsCerts) reload() error {
+	cert, err := tls.LoadX509KeyPair(tc.cfg.CertFile, tc.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Cannot load TLS certificate: %v", err)
+	}
+
+	cfg := tc.base.Clone()
+	cfg.Certificates = []tls.Certificate{cert}
+	if tc.cfg.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(tc.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("Cannot load TLS client CAs: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("No certificate found in TLS client CAs file %s", tc.cfg.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	tc.mutex.Lock()
+	tc.current = cfg
+	tc.mutex.Unlock()
+
+	if x, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		tc.Log.Infof("TLS certificate loaded: %s (expires %s)", x.Subject.CommonName, x.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// monitor reloads certificates on SIGHUP or when a file changes
+func (tc *tlsCerts) monitor() {
+	sigHup := make(chan os.Signal, 1)
+	signal.Notify(sigHup, syscall.SIGHUP)
+
+	tc.changed() // init modification times
+	for {
+		select {
+		case <-sigHup:
+			tc.Log.Infof("SIGHUP received, reload TLS certificate")
+		case <-time.After(tlsWatchPeriod):
+			if !tc.changed() {
+				continue
+			}
+			tc.Log.Infof("TLS certificate files changed, reload them")
+		}
+		if err := tc.reload(); err != nil {
+			tc.Log.Errorf("%v (keep current certificate)", err)
+		}
+	}
+}
+
+// changed returns true when a certificate file has been modified
+func (tc *tlsCerts) changed() bool {
+	res := false
+	for _, f := range []string{tc.cfg.CertFile, tc.cfg.KeyFile, tc.cfg.ClientCAFile} {
+		if f == "" {
+			continue
+		}
+		st, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if prev, ok := tc.modTimes[f]; ok && !prev.Equal(st.ModTime()) {
+			res = true
+		}
+		tc.modTimes[f] = st.ModTime()
+	}
+	return res
+}
+
+// tlsGenerateSelfSigned generates a self-signed certificate (ECDSA P-256)
+// valid for localhost and host name
+func tlsGenerateSelfSigned(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "xds-server", Organization: []string{"XDS self-signed"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(tlsSelfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	if hostname != "" && hostname != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+			return err
+		}
+	}
+	// Key is written first, so that a certificate always has its key
+	if err := tlsWritePEM(keyFile, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+	return tlsWritePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+// tlsWritePEM writes a PEM file
+func tlsWritePEM(file, pemType string, der []byte, perm os.FileMode) error {
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(fd, &pem.Block{Type: pemType, Bytes: der}); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
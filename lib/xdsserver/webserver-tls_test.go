@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestTLSConfigHTTP2(t *testing.T) {
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+	dir := ctx.Config.FileConf.ShareRootDir
+	ctx.Config.FileConf.TLSConf.CertFile = filepath.Join(dir, "server.crt")
+	ctx.Config.FileConf.TLSConf.KeyFile = filepath.Join(dir, "server.key")
+	ctx.Config.FileConf.TLSConf.SelfSigned = true
+	ctx.Config.FileConf.TLSConf.MinVersion = "1.2"
+
+	tlsCfg, err := newTLSConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		TLSConfig: tlsCfg,
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("protocol = %s, want HTTP/2", resp.Proto)
+	}
+}
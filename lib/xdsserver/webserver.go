@@ -24,11 +24,13 @@ import (
 	"os"
 
 	"path"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
 	"github.com/googollee/go-socket.io"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
 )
 
 // WebServer .
@@ -96,10 +98,9 @@ func (s *WebServer) Serve() error {
 
 	s.router.GET("/socket.io/", s.socketHandler)
 	s.router.POST("/socket.io/", s.socketHandler)
-	/* TODO: do we want to support ws://...  ?
-	s.router.Handle("WS", "/socket.io/", s.socketHandler)
-	s.router.Handle("WSS", "/socket.io/", s.socketHandler)
-	*/
+
+	// Plain WebSocket (for clients that don't support socket.io)
+	s.router.GET(xsapiv1.WSRoute, s.wsHandler)
 
 	// Web Application (serve on / )
 	idxFile := path.Join(s.Config.FileConf.WebAppDir, indexFilename)
@@ -115,11 +116,26 @@ func (s *WebServer) Serve() error {
 
 	// Serve in the background
 	serveError := make(chan error, 1)
+	srv := &http.Server{
+		Addr:    ":" + s.Config.FileConf.HTTPPort,
+		Handler: s.router,
+	}
+	scheme := "http"
+	if s.Config.FileConf.TLSConf.Enable {
+		if srv.TLSConfig, err = newTLSConfig(s.Context); err != nil {
+			return err
+		}
+		scheme = "https"
+	}
 	go func() {
-		msg := fmt.Sprintf("Web Server running on localhost:%s ...\n", s.Config.FileConf.HTTPPort)
+		msg := fmt.Sprintf("Web Server running on %s://localhost:%s ...\n", scheme, s.Config.FileConf.HTTPPort)
 		s.Log.Infof(msg)
 		fmt.Printf(msg)
-		serveError <- http.ListenAndServe(":"+s.Config.FileConf.HTTPPort, s.router)
+		if srv.TLSConfig != nil {
+			serveError <- srv.ListenAndServeTLS("", "")
+		} else {
+			serveError <- srv.ListenAndServe()
+		}
 	}()
 
 	// Wait for stop, restart or error signals
@@ -159,11 +175,22 @@ func (s *WebServer) middlewareXDSDetails() gin.HandlerFunc {
 // CORS middleware
 func (s *WebServer) middlewareCORS() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		allowOrigin := s.corsAllowOrigin(c.Request.Header.Get("Origin"))
+		if allowOrigin != "" {
+			c.Header("Access-Control-Allow-Origin", allowOrigin)
+			if allowOrigin != "*" {
+				c.Header("Access-Control-Allow-Credentials", "true")
+				c.Header("Vary", "Origin")
+			}
+			c.Header("Access-Control-Expose-Headers", sessionHeaderName)
+		}
+
 		if c.Request.Method == "OPTIONS" {
-			c.Header("Access-Control-Allow-Origin", "*")
-			c.Header("Access-Control-Allow-Headers", "Content-Type")
-			c.Header("Access-Control-Allow-Methods", "GET, POST, DELETE")
-			c.Header("Access-Control-Max-Age", cookieMaxAge)
+			if allowOrigin != "" {
+				c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, "+sessionHeaderName+", "+csrfHeaderName)
+				c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+				c.Header("Access-Control-Max-Age", cookieMaxAge)
+			}
 			c.AbortWithStatus(204)
 			return
 		}
@@ -172,6 +199,32 @@ func (s *WebServer) middlewareCORS() gin.HandlerFunc {
 	}
 }
 
+// corsAllowed returns true when cross-origin requests of an origin are allowed
+func (s *WebServer) corsAllowed(origin string) bool {
+	return s.corsAllowOrigin(origin) != ""
+}
+
+// corsAllowOrigin returns the value of Access-Control-Allow-Origin header
+// for an origin (empty when origin is not allowed, credentials are only
+// allowed for origins explicitly listed in server config)
+func (s *WebServer) corsAllowOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	allowAny := false
+	for _, o := range s.Config.FileConf.SecurityConf.CORSOrigins {
+		if o == "*" {
+			allowAny = true
+		} else if strings.EqualFold(strings.TrimRight(o, "/"), origin) {
+			return origin
+		}
+	}
+	if allowAny {
+		return "*"
+	}
+	return ""
+}
+
 // socketHandler is the handler for the "main" websocket connection
 func (s *WebServer) socketHandler(c *gin.Context) {
 
@@ -198,3 +251,33 @@ func (s *WebServer) socketHandler(c *gin.Context) {
 
 	s.sIOServer.ServeHTTP(c.Writer, c.Request)
 }
+
+// wsHandler is the handler for plain WebSocket (RFC 6455) connection
+func (s *WebServer) wsHandler(c *gin.Context) {
+
+	// Retrieve user session
+	sess := s.sessions.Get(c)
+	if sess == nil {
+		c.JSON(500, gin.H{"error": "Cannot retrieve session"})
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		s.Log.Errorf("WS upgrade error: %v", err)
+		return
+	}
+
+	wso := NewWSSocket(conn, c.Request, s.Log)
+	var so socketio.Socket = wso
+	s.Log.Debugf("WS Connected (SID=%v)", so.Id())
+	s.sessions.UpdateIOSocket(sess.ID, &so)
+
+	so.On("disconnection", func() {
+		s.Log.Debugf("WS disconnected (SID=%v)", so.Id())
+		s.sessions.UpdateIOSocket(sess.ID, nil)
+	})
+
+	// Blocking till connection is closed
+	wso.Serve()
+}
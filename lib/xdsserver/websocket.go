@@ -0,0 +1,245 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+	"github.com/iotbzh/xds-server/lib/xsapiv1"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Plain WebSocket (RFC 6455) implementation of socketio.Socket interface,
+// so that such connection can be used everywhere a socket.io one is used
+// (see xsapiv1/websocket.go for framing definition)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 30 * time.Second
+	wsMaxMsgSize = 1024 * 1024
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// WSSocket .
+type WSSocket struct {
+	id       string
+	conn     *websocket.Conn
+	req      *http.Request
+	log      *logrus.Logger
+	handlers map[string]interface{}
+	rooms    []string
+	mutex    sync.Mutex // protect handlers and rooms
+	wMutex   sync.Mutex // only one concurrent writer is allowed
+	stop     chan struct{}
+}
+
+// NewWSSocket creates a new WSSocket from an established connection
+func NewWSSocket(conn *websocket.Conn, req *http.Request, log *logrus.Logger) *WSSocket {
+	return &WSSocket{
+		id:       uuid.NewV4().String(),
+		conn:     conn,
+		req:      req,
+		log:      log,
+		handlers: make(map[string]interface{}),
+		rooms:    []string{},
+		stop:     make(chan struct{}),
+	}
+}
+
+// Id returns the socket ID
+func (so *WSSocket) Id() string {
+	return so.id
+}
+
+// Rooms returns the rooms joined by this socket
+func (so *WSSocket) Rooms() []string {
+	so.mutex.Lock()
+	defer so.mutex.Unlock()
+	return so.rooms
+}
+
+// Request returns the initial HTTP request
+func (so *WSSocket) Request() *http.Request {
+	return so.req
+}
+
+// On registers the handler of an event; handler is a function that takes
+// zero or one argument (JSON decoded from data field of received message)
+func (so *WSSocket) On(event string, f interface{}) error {
+	ft := reflect.TypeOf(f)
+	if ft == nil || ft.Kind() != reflect.Func || ft.NumIn() > 1 {
+		return fmt.Errorf("invalid handler for event %s", event)
+	}
+	so.mutex.Lock()
+	defer so.mutex.Unlock()
+	so.handlers[event] = f
+	return nil
+}
+
+// Emit sends an event to the client
+func (so *WSSocket) Emit(event string, args ...interface{}) error {
+	var data interface{}
+	if len(args) == 1 {
+		data = args[0]
+	} else if len(args) > 1 {
+		data = args
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(xsapiv1.WSMessage{Event: event, Data: raw})
+	if err != nil {
+		return err
+	}
+	return so.write(websocket.TextMessage, msg)
+}
+
+// Join joins a room
+func (so *WSSocket) Join(room string) error {
+	so.mutex.Lock()
+	defer so.mutex.Unlock()
+	for _, r := range so.rooms {
+		if r == room {
+			return nil
+		}
+	}
+	so.rooms = append(so.rooms, room)
+	return nil
+}
+
+// Leave leaves a room
+func (so *WSSocket) Leave(room string) error {
+	so.mutex.Lock()
+	defer so.mutex.Unlock()
+	for i, r := range so.rooms {
+		if r == room {
+			so.rooms = append(so.rooms[:i], so.rooms[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Disconnect closes the connection
+func (so *WSSocket) Disconnect() {
+	so.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	so.conn.Close()
+}
+
+// BroadcastTo is not supported by plain WebSocket
+func (so *WSSocket) BroadcastTo(room, event string, args ...interface{}) error {
+	return fmt.Errorf("BroadcastTo not supported on plain WebSocket")
+}
+
+// Serve reads and dispatches received messages till connection is closed
+// (blocking call), "disconnection" handler is called on exit
+func (so *WSSocket) Serve() {
+	defer func() {
+		close(so.stop)
+		so.conn.Close()
+		so.call("disconnection", nil)
+	}()
+
+	so.conn.SetReadLimit(wsMaxMsgSize)
+	so.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	so.conn.SetPongHandler(func(string) error {
+		return so.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	go so.pingLoop()
+
+	for {
+		_, data, err := so.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				so.log.Errorf("WS SID=%v Error : %v", so.id, err)
+			}
+			return
+		}
+
+		msg := xsapiv1.WSMessage{}
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Event == "" {
+			so.log.Warningf("WS SID=%v invalid message received: %v", so.id, err)
+			continue
+		}
+		if err := so.call(msg.Event, msg.Data); err != nil {
+			so.log.Warningf("WS SID=%v event %s: %v", so.id, msg.Event, err)
+		}
+	}
+}
+
+// call invokes the handler registered for an event
+func (so *WSSocket) call(event string, data json.RawMessage) error {
+	so.mutex.Lock()
+	f, exist := so.handlers[event]
+	so.mutex.Unlock()
+	if !exist {
+		return nil
+	}
+
+	fv := reflect.ValueOf(f)
+	args := []reflect.Value{}
+	if fv.Type().NumIn() == 1 {
+		arg := reflect.New(fv.Type().In(0))
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, arg.Interface()); err != nil {
+				return fmt.Errorf("cannot decode data: %v", err)
+			}
+		}
+		args = append(args, arg.Elem())
+	}
+	fv.Call(args)
+	return nil
+}
+
+// pingLoop sends periodically ping to detect dead connections
+func (so *WSSocket) pingLoop() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-so.stop:
+			return
+		case <-ticker.C:
+			if err := so.write(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// write sends a message (only one concurrent writer is allowed)
+func (so *WSSocket) write(msgType int, data []byte) error {
+	so.wMutex.Lock()
+	defer so.wMutex.Unlock()
+	so.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return so.conn.WriteMessage(msgType, data)
+}
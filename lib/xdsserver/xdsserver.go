@@ -23,6 +23,7 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -49,9 +50,12 @@ type Context struct {
 	SThgInotCmd   *exec.Cmd
 	mfolders      *Folders
 	sdks          *SDKs
+	execCmds      *ExecCommands
 	WWWServer     *WebServer
 	sessions      *Sessions
 	events        *Events
+	webhooks      *Webhooks
+	auth          *Auth
 	Exit          chan os.Signal
 }
 
@@ -130,6 +134,9 @@ func (ctx *Context) Run() (int, error) {
 	}
 
 	// Create events management
+	if ctx.webhooks, err = NewWebhooks(ctx); err != nil {
+		return -1, err
+	}
 	ctx.events = NewEvents(ctx)
 
 	// Create syncthing instance when section "syncthing" is present in server-config.json
@@ -178,6 +185,19 @@ func (ctx *Context) Run() (int, error) {
 		ctx.Config.SupportedSharing[xsapiv1.TypeCloudSync] = true
 	}
 
+	// CIFS/SMB folders are supported when mount helper is available
+	if helper := strings.Fields(ctx.Config.FileConf.CifsConf.MountHelper); len(helper) > 0 {
+		if _, err := exec.LookPath(helper[0]); err == nil {
+			ctx.Config.SupportedSharing[xsapiv1.TypeCifsSmb] = true
+		} else {
+			ctx.Log.Infof("CIFS folders not supported (%s not found)", helper[0])
+		}
+	}
+	if _, err := exec.LookPath("git"); err == nil {
+		ctx.Config.SupportedSharing[xsapiv1.TypeGit] = true
+	}
+	ctx.Config.SupportedSharing[xsapiv1.TypeRsyncHTTP] = true
+
 	// Init model folder
 	ctx.mfolders = FoldersNew(ctx)
 
@@ -192,9 +212,20 @@ func (ctx *Context) Run() (int, error) {
 		return -6, err
 	}
 
+	// Init executed commands (and load history)
+	ctx.execCmds, err = NewExecCommands(ctx)
+	if err != nil {
+		return -6, err
+	}
+
 	// Create Web Server
 	ctx.WWWServer = NewWebServer(ctx)
 
+	// Authentication of clients
+	if ctx.auth, err = NewAuth(ctx); err != nil {
+		return -8, err
+	}
+
 	// Sessions manager
 	ctx.sessions = NewClientSessions(ctx, cookieMaxAge)
 
@@ -224,6 +255,12 @@ func handlerSigTerm(ctx *Context) {
 		ctx.Log.Infof("Stoping Syncthing-inotify... (PID %d)", ctx.SThgInotCmd.Process.Pid)
 		ctx.SThg.StopInotify()
 	}
+	if ctx.sessions != nil {
+		ctx.Log.Infof("Saving sessions...")
+		if err := ctx.sessions.Save(); err != nil {
+			ctx.Log.Errorf("Cannot save sessions: %v", err)
+		}
+	}
 	if ctx.WWWServer != nil {
 		ctx.Log.Infof("Stoping Web server...")
 		ctx.WWWServer.Stop()
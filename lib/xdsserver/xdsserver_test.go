@@ -0,0 +1,47 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdsserver
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/iotbzh/xds-server/lib/xdsconfig"
+)
+
+// newTestContext returns a server context which share dir is a temporary
+// directory (removed by returned function)
+func newTestContext(t *testing.T) (*Context, func()) {
+	dir, err := ioutil.TempDir("", "xds-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &Context{
+		Config: &xdsconfig.Config{
+			FileConf: xdsconfig.FileConfig{
+				ShareRootDir:     dir,
+				PathMappingRoots: []string{dir},
+			},
+		},
+		Log:       logrus.New(),
+		LogSillyf: func(format string, args ...interface{}) {},
+	}
+	return ctx, func() { os.RemoveAll(dir) }
+}
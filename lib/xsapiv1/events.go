@@ -25,19 +25,32 @@ import (
 // EventRegisterArgs Parameters (json format) of /events/register command
 type EventRegisterArgs struct {
 	Name   string `json:"name"`
-	Filter string `json:"filter"`
+	Filter string `json:"filter"` // only send events which data match filter (eg. "id=<folderID>")
+	Since  uint64 `json:"since"`  // replay events which sequence number is greater than since (0: no replay)
+	Epoch  string `json:"epoch"`  // epoch of since (as returned by a previous register), events are replayed from the beginning when server restarted
+}
+
+// EventRegisterReply Reply of /events/register command
+type EventRegisterReply struct {
+	Status    string `json:"status"`
+	ID        int    `json:"id"`        // subscription ID
+	Seq       uint64 `json:"seq"`       // sequence number of last event emitted
+	Epoch     string `json:"epoch"`     // changed when server restarts (sequence numbers restart from 1)
+	Truncated bool   `json:"truncated"` // some events requested by since are not available anymore
+	SessionID string `json:"sessionID"` // public ID of client session (as set in sessionID of events)
 }
 
 // EventUnRegisterArgs Parameters of /events/unregister command
 type EventUnRegisterArgs struct {
 	Name string `json:"name"`
-	ID   int    `json:"id"`
+	ID   int    `json:"id"` // subscription ID returned by register (0 for all)
 }
 
 // EventMsg Message send
 type EventMsg struct {
+	Seq           uint64      `json:"seq"` // sequence number (incremented for each event)
 	Time          string      `json:"time"`
-	FromSessionID string      `json:"sessionID"` // Session ID of client who produce this event
+	FromSessionID string      `json:"sessionID"` // Public ID of session of client who produce this event
 	Type          string      `json:"type"`
 	Data          interface{} `json:"data"` // Data
 }
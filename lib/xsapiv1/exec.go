@@ -17,20 +17,35 @@
 
 package xsapiv1
 
+import "time"
+
 type (
 	// ExecArgs JSON parameters of /exec command
 	ExecArgs struct {
-		ID              string   `json:"id" binding:"required"`
-		SdkID           string   `json:"sdkID"` // sdk ID to use for setting env
-		CmdID           string   `json:"cmdID"` // command unique ID
-		Cmd             string   `json:"cmd" binding:"required"`
-		Args            []string `json:"args"`
-		Env             []string `json:"env"`
-		RPath           string   `json:"rpath"`           // relative path into project
-		TTY             bool     `json:"tty"`             // Use a tty, specific to gdb --tty option
-		TTYGdbserverFix bool     `json:"ttyGdbserverFix"` // Set to true to activate gdbserver workaround about inferior output
-		ExitImmediate   bool     `json:"exitImmediate"`   // when true, exit event sent immediately when command exited (IOW, don't wait file synchronization)
-		CmdTimeout      int      `json:"timeout"`         // command completion timeout in Second
+		ID              string     `json:"id" binding:"required"`
+		SdkID           string     `json:"sdkID"` // sdk ID to use for setting env
+		CmdID           string     `json:"cmdID"` // command unique ID
+		Cmd             string     `json:"cmd" binding:"required"`
+		Args            []string   `json:"args"`
+		Env             []string   `json:"env"`
+		RPath           string     `json:"rpath"`           // relative path into project
+		TTY             bool       `json:"tty"`             // Use a tty, specific to gdb --tty option
+		TTYGdbserverFix bool       `json:"ttyGdbserverFix"` // Set to true to activate gdbserver workaround about inferior output
+		ExitImmediate   bool       `json:"exitImmediate"`   // when true, exit event sent immediately when command exited (IOW, don't wait file synchronization)
+		CmdTimeout      int        `json:"timeout"`         // command completion timeout in Second
+		Stream          string     `json:"stream"`          // stream output in HTTP response (ExecStreamSSE or ExecStreamNDJSON)
+		Priority        int        `json:"priority"`        // priority when command is queued (higher first, only used with priority queue order, bounded by server)
+		Limits          ExecLimits `json:"limits"`          // resource limits (bounded by server limits)
+		Network         bool       `json:"network"`         // allow network access when command is executed in sandbox
+	}
+
+	// ExecLimits Resource limits of a command (0 means no limit)
+	ExecLimits struct {
+		Memory     int64 `json:"memory"`     // memory ceiling in bytes
+		CPUShare   int   `json:"cpuShare"`   // CPU share in percent of one CPU (eg. 200 for 2 CPUs)
+		Pids       int   `json:"pids"`       // max number of processes
+		OutputSize int64 `json:"outputSize"` // max size of output (stdout+stderr) in bytes
+		WallTime   int   `json:"wallTime"`   // max execution time in seconds
 	}
 
 	// ExecResult JSON result of /exec command
@@ -66,6 +81,49 @@ type (
 		Timestamp string `json:"timestamp"`
 		Code      int    `json:"code"`
 		Error     error  `json:"error"`
+		Limit     string `json:"limit"` // limit hit by command (ExecLimitXxx) or empty
+
+		Diagnostics *ExecDiagSummary `json:"diagnostics,omitempty"` // diagnostics found in output
+	}
+
+	// ExecDiagnostic Diagnostic (error, warning...) reported by a compiler
+	// or a build tool and found in command output
+	ExecDiagnostic struct {
+		Tool     string `json:"tool"`     // ExecDiagToolXxx
+		File     string `json:"file"`     // file path (client side), may be empty
+		Line     int    `json:"line"`     // 0 when unknown
+		Column   int    `json:"column"`   // 0 when unknown
+		Severity string `json:"severity"` // ExecDiagError, ExecDiagWarning or ExecDiagNote
+		Message  string `json:"message"`
+	}
+
+	// ExecDiagnosticMsg Message sent when a diagnostic is found in output
+	ExecDiagnosticMsg struct {
+		CmdID     string `json:"cmdID"`
+		Timestamp string `json:"timestamp"`
+		ExecDiagnostic
+	}
+
+	// ExecDiagSummary Summary of diagnostics found in output of a command
+	ExecDiagSummary struct {
+		Errors    int              `json:"errors"`
+		Warnings  int              `json:"warnings"`
+		Items     []ExecDiagnostic `json:"items"`
+		Truncated bool             `json:"truncated"` // true when some items were dropped
+	}
+
+	// ExecQueueMsg Message sent when a command is queued (or its position in
+	// queue changed) and when a queued command is started
+	ExecQueueMsg struct {
+		CmdID     string `json:"cmdID"`
+		Timestamp string `json:"timestamp"`
+		Position  int    `json:"position"` // position in queue (1 = next started command, 0 = started)
+	}
+
+	// ExecStreamMsg Message sent in HTTP response of /exec command in stream mode
+	ExecStreamMsg struct {
+		Event string      `json:"event"` // ExecOutEvent, ExecExitEvent, ExecQueuedEvent or ExecStartedEvent
+		Data  interface{} `json:"data"`  // ExecOutMsg, ExecExitMsg or ExecQueueMsg
 	}
 
 	// ExecSignalArgs JSON parameters of /exec/signal command
@@ -73,6 +131,73 @@ type (
 		CmdID  string `json:"cmdID" binding:"required"`  // command id
 		Signal string `json:"signal" binding:"required"` // signal number
 	}
+
+	// ExecAttachArgs JSON parameters of /attach command
+	ExecAttachArgs struct {
+		CmdID string `json:"cmdID" binding:"required"` // command id
+	}
+
+	// ExecAttachResult JSON result of /attach command
+	ExecAttachResult struct {
+		Status string `json:"status"` // status OK
+		CmdID  string `json:"cmdID"`  // command unique ID
+	}
+
+	// ExecCommandInfo Information about a command executed by /exec (result of /history)
+	ExecCommandInfo struct {
+		CmdID     string     `json:"cmdID"`
+		Cmd       string     `json:"cmd"`
+		Args      []string   `json:"args"`
+		CmdLine   string     `json:"cmdLine"` // full command line executed on server
+		RPath     string     `json:"rpath"`
+		FolderID  string     `json:"folderID"`
+		SdkID     string     `json:"sdkID"`
+		SessionID string     `json:"sessionID"` // public ID of session of client attached to this command
+		PID       int        `json:"pid"`
+		State     string     `json:"state"`
+		StartTime time.Time  `json:"startTime"`
+		EndTime   time.Time  `json:"endTime"`
+		Timeout   int        `json:"timeout"`  // command completion timeout in Second
+		Priority  int        `json:"priority"` // priority in queue
+		Limits    ExecLimits `json:"limits"`   // resource limits applied to command
+		LimitHit  string     `json:"limitHit"` // limit hit by command (ExecLimitXxx) or empty
+		Code      int        `json:"code"`
+		Error     string     `json:"error"`
+	}
+)
+
+// Stream mode of /exec command (output is sent in HTTP response instead of WS)
+const (
+	ExecStreamSSE    = "sse"    // Server-Sent Events (text/event-stream)
+	ExecStreamNDJSON = "ndjson" // newline-delimited JSON of ExecStreamMsg
+)
+
+// Limits reported in exit message when hit by a command
+const (
+	ExecLimitMemory   = "memory"
+	ExecLimitPids     = "pids"
+	ExecLimitOutput   = "outputSize"
+	ExecLimitWallTime = "wallTime"
+)
+
+// Tools and severities of diagnostics found in command output
+const (
+	ExecDiagToolGcc   = "gcc" // gcc or clang
+	ExecDiagToolLd    = "ld"
+	ExecDiagToolCMake = "cmake"
+	ExecDiagToolMake  = "make"
+
+	ExecDiagError   = "error"
+	ExecDiagWarning = "warning"
+	ExecDiagNote    = "note"
+)
+
+// Command state definition
+const (
+	ExecStateQueued   = "Queued"
+	ExecStateRunning  = "Running"
+	ExecStateStopping = "Stopping"
+	ExecStateExited   = "Exited"
 )
 
 const (
@@ -85,6 +210,17 @@ const (
 	// ExecExitEvent Event send in WS when program exited
 	ExecExitEvent = "exec:exit"
 
+	// ExecQueuedEvent Event send in WS when command is queued (concurrency
+	// limit reached) or when its position in queue changed
+	ExecQueuedEvent = "exec:queued"
+
+	// ExecStartedEvent Event send in WS when a queued command is started
+	ExecStartedEvent = "exec:started"
+
+	// ExecDiagnosticEvent Event send in WS when a diagnostic (compiler error,
+	// warning...) is found in command output
+	ExecDiagnosticEvent = "exec:diagnostic"
+
 	// ExecInferiorInEvent Event send in WS when characters are sent to an inferior (used by gdb inferior/tty)
 	ExecInferiorInEvent = "exec:inferior-input"
 
@@ -24,6 +24,8 @@ const (
 	TypePathMap   = "PathMap"
 	TypeCloudSync = "CloudSync"
 	TypeCifsSmb   = "CIFS"
+	TypeGit       = "Git"
+	TypeRsyncHTTP = "RsyncHTTP"
 )
 
 // Folder Status definition
@@ -33,6 +35,8 @@ const (
 	StatusEnable      = "Enable"
 	StatusPause       = "Pause"
 	StatusSyncing     = "Syncing"
+	StatusErrorMount  = "ErrorMount"
+	StatusDeleted     = "Deleted" // only used in folder-change event
 )
 
 // FolderConfig is the config for one folder
@@ -46,6 +50,16 @@ type FolderConfig struct {
 	DefaultSdk string     `json:"defaultSdk"`
 	ClientData string     `json:"clientData"` // free form field that can used by client
 
+	AllowNetwork bool `json:"allowNetwork"` // network allowed to commands executed in sandbox
+
+	// Access control (when authentication is enabled): folder is accessible
+	// by its owner and by users or roles of ACL (all users when no owner)
+	Owner string           `json:"owner"`
+	ACL   []FolderACLEntry `json:"acl"`
+
+	// Additional paths translated between client and server (in order)
+	PathMappings []PathMappingConfig `json:"pathMappings"`
+
 	// Not exported fields from REST API point of view
 	RootPath string `json:"-"`
 
@@ -56,11 +70,34 @@ type FolderConfig struct {
 	// Specific data depending on which Type is used
 	DataPathMap   PathMapConfig   `json:"dataPathMap,omitempty"`
 	DataCloudSync CloudSyncConfig `json:"dataCloudSync,omitempty"`
+	DataCifs      CifsConfig      `json:"dataCifs,omitempty"`
+	DataGit       GitConfig       `json:"dataGit,omitempty"`
 }
 
 // FolderConfigUpdatableFields List fields that can be updated using Update function
+// (only Ref of DataGit can be changed)
 var FolderConfigUpdatableFields = []string{
-	"Label", "DefaultSdk", "ClientData",
+	"Label", "DefaultSdk", "ClientData", "AllowNetwork", "PathMappings",
+	"Owner", "ACL", "DataGit",
+}
+
+// Folder access granted by an ACL entry
+const (
+	FolderAccessRead = "read" // browse folder
+	FolderAccessExec = "exec" // browse, synchronize and execute commands in folder
+)
+
+// FolderACLEntry Access granted to a user or to users having a role
+type FolderACLEntry struct {
+	User   string `json:"user,omitempty"`
+	Role   string `json:"role,omitempty"`
+	Access string `json:"access"` // FolderAccessRead or FolderAccessExec
+}
+
+// PathMappingConfig A client path and its equivalent path on server
+type PathMappingConfig struct {
+	ClientPath string `json:"clientPath"`
+	ServerPath string `json:"serverPath"`
 }
 
 // PathMapConfig Path mapping specific data
@@ -72,6 +109,25 @@ type PathMapConfig struct {
 	CheckContent string `json:"checkContent" xml:"-"`
 }
 
+// CifsConfig CIFS/SMB specific data
+type CifsConfig struct {
+	Share       string `json:"share"`       // share to mount (eg. //server/share/subdir)
+	Credentials string `json:"credentials"` // name of credentials defined in server config
+
+	// Not saved fields (computed by server)
+	MountPoint  string `json:"-" xml:"-"`
+	MountStatus string `json:"mountStatus" xml:"-"` // last mount error
+}
+
+// GitConfig Git specific data
+type GitConfig struct {
+	URL string `json:"url"` // repository to clone
+	Ref string `json:"ref"` // branch, tag or commit to check out (default: remote HEAD)
+
+	// Not saved fields (computed by server)
+	Commit string `json:"commit" xml:"-"` // commit currently checked out
+}
+
 // CloudSyncConfig CloudSync (AKA Syncthing) specific data
 type CloudSyncConfig struct {
 	SyncThingID string `json:"syncThingID"`
@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+// RsyncHTTP folders: client pushes the manifest of its files, then for each
+// missing or modified file, gets the block signatures of the file on server
+// and uploads a delta that reuses identical blocks.
+//
+// Weak checksum of a block is the rsync rolling checksum:
+//   a = sum(b[i]) mod 2^16, b = sum((n-i)*b[i]) mod 2^16, weak = a + b<<16
+// Strong checksum of a block and hash of a file are SHA-256 (hex encoded).
+
+// RsyncFileEntry Description of a file of a RsyncHTTP folder manifest
+type RsyncFileEntry struct {
+	Size  int64  `json:"size"`
+	Mode  uint32 `json:"mode"`  // permission bits
+	Mtime int64  `json:"mtime"` // modification time (unix time in seconds)
+	Hash  string `json:"hash"`  // SHA-256 of content
+}
+
+// RsyncManifest JSON parameter of PUT /rsync/:id/manifest
+type RsyncManifest struct {
+	// Regular files of folder, key is path relative to folder root
+	// ('/' separated)
+	Files map[string]RsyncFileEntry `json:"files"`
+}
+
+// RsyncStatus Result of GET and PUT /rsync/:id/manifest and POST /rsync/:id/delta
+type RsyncStatus struct {
+	Version  int64                     `json:"version"`  // incremented each time manifest is pushed
+	Files    map[string]RsyncFileEntry `json:"files"`    // files of manifest present on server
+	Missing  []string                  `json:"missing"`  // files of manifest to upload
+	Removed  []string                  `json:"removed"`  // files removed because removed from manifest
+	IsInSync bool                      `json:"isInSync"` // all files of manifest are on server
+}
+
+// RsyncBlockSum Checksums of a block of a file
+type RsyncBlockSum struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// RsyncSignature Result of GET /rsync/:id/signature
+type RsyncSignature struct {
+	Path      string          `json:"path"`
+	Hash      string          `json:"hash"` // hash of file (to be used as BaseHash of delta)
+	Size      int64           `json:"size"`
+	BlockSize int             `json:"blockSize"`
+	Blocks    []RsyncBlockSum `json:"blocks"`
+}
+
+// RsyncDeltaOp An operation of a delta: either copy Count blocks of base
+// file starting at Block or write literal Data
+type RsyncDeltaOp struct {
+	Block int    `json:"block"`
+	Count int    `json:"count"`
+	Data  []byte `json:"data,omitempty"` // base64 encoded in JSON
+}
+
+// RsyncDeltaArgs JSON parameters of POST /rsync/:id/delta
+// (literal data of a delta is limited, so a big new file is uploaded as
+// several deltas, each one copying blocks of the previous partial upload)
+type RsyncDeltaArgs struct {
+	Path      string         `json:"path"`
+	BaseHash  string         `json:"baseHash"`  // hash of signature used to compute delta (empty when no block copied)
+	BlockSize int            `json:"blockSize"` // block size of signature
+	Ops       []RsyncDeltaOp `json:"ops"`
+	File      RsyncFileEntry `json:"file"` // expected result
+}
@@ -0,0 +1,35 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+import "time"
+
+// SessionInfo Info of a client session (returned by GET /sessions)
+type SessionInfo struct {
+	ID          string    `json:"id"` // public ID of session (as set in sessionID of events and commands)
+	User        string    `json:"user"`
+	Roles       []string  `json:"roles"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	UserAgent   string    `json:"userAgent"`
+	WSConnected bool      `json:"wsConnected"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastUse     time.Time `json:"lastUse"`
+	ExpireAt    time.Time `json:"expireAt"`
+	UseCount    int64     `json:"useCount"`
+	Commands    []string  `json:"commands"` // IDs of running commands
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright (C) 2017 "IoT.bzh"
+ * Author Sebastien Douheret <sebastien@iot.bzh>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xsapiv1
+
+import "encoding/json"
+
+// Plain WebSocket (RFC 6455) support
+//
+// Clients that don't embed a socket.io library can connect to WSRoute using
+// a standard WebSocket. Such connection is bound to the client session
+// exactly like socket.io one (session ID is passed in xds-sid cookie or
+// header, see XDS-SID header returned by any REST API call).
+//
+// All messages are JSON text frames of type WSMessage, in both directions:
+//
+//   server -> client: exec:output, exec:exit, exec:inferior-output and all
+//                     event:* messages (same data than socket.io events)
+//     {"event": "exec:output", "data": {"cmdID": "...", "stdout": "...", ...}}
+//
+//   client -> server: exec:input and exec:inferior-input
+//     {"event": "exec:input", "data": "some characters\n"}
+//
+// Server sends WebSocket ping every 30 seconds, connection is closed when
+// client doesn't answer (pong) within 60 seconds.
+
+// WSRoute Route of plain WebSocket endpoint
+const WSRoute = "/ws"
+
+// WSMessage JSON frame exchanged over plain WebSocket
+type WSMessage struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}